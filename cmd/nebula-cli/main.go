@@ -8,17 +8,43 @@ import (
 
 	messages "messages"
 	nh_util "nh_util"
+	router "router"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/config"
 )
 
 type m map[string]interface{}
 
+// Sends to the router api of the unit at ip. With a shared secret over plain
+// http, else over mutual TLS with the Nebula certificate of this unit
+func send(ip string, path string, jsonData []byte, secret string, configPath string) ([]byte, error) {
+	if secret != "" {
+		message, err, _ := nh_util.Nh_http_send_auth_req("http://"+ip+":11000"+path, jsonData, secret)
+		return message, err
+	}
+	c := config.NewC()
+	err := c.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	id, err := router.LoadNebulaIdentity(c.GetString("pki.ca", ""), c.GetString("pki.cert", ""), c.GetString("pki.key", ""))
+	if err != nil {
+		return nil, err
+	}
+	return id.Post(ip, path, jsonData)
+}
+
 func main() {
 	ipaddress := flag.String("ipaddress", "", "Destination IP Address")
 	iname := flag.String("iname", "", "Bridge interface name of the repeater")
 	miname := flag.String("miname", "", "Mesh interface name of the repeater")
 	command := flag.String("command", "", "Command")
 	fwver := flag.String("fwver", "", "Firmware version")
-	data := flag.String("data", "", "Data")
+	data := flag.String("data", "", "Data. For wake, the MAC Address or the name of the client")
+	secret := flag.String("secret", "", "Shared secret of the router api. Without it the Nebula certificate of the unit is used")
+	configPath := flag.String("config", nebula.GetConfigFileDir(), "Nebula config with the certificate of the unit")
+	tokenfile := flag.String("tokenfile", "", "For register_repeater, file to save the token the capture daemon posts /radios with")
 	flag.Parse()
 
 	if *ipaddress == "" {
@@ -48,7 +74,7 @@ func main() {
 			return
 		}
 
-		message, err, _ := nh_util.Nh_http_send_req("http://"+*ipaddress+":11000/command", jsonData)
+		message, err := send(*ipaddress, "/command", jsonData, *secret, *configPath)
 		if err == nil {
 			if *command != "check_wireless" {
 				fmt.Println(string(message))
@@ -112,7 +138,7 @@ func main() {
 			fmt.Println("Error while unmarhsalling the wireless messages")
 			return
 		}
-		messages.Set_wireless(msg)
+		fmt.Println(messages.Set_wireless(msg))
 		return
 	case "register_repeater":
 		mac, err := nh_util.NH_get_macaddress(*iname)
@@ -150,9 +176,47 @@ func main() {
 			return
 		}
 
-		message, err, _ := nh_util.Nh_http_send_req("http://"+*ipaddress+":11000/register_repeater", jsonData)
+		message, err := send(*ipaddress, "/register_repeater", jsonData, *secret, *configPath)
+		if err != nil {
+			fmt.Println("Error while sending register_repeater to the server", err.Error())
+			return
+		}
+		fmt.Println(string(message))
+		if *tokenfile != "" {
+			var status struct {
+				Token string `json:"token"`
+			}
+			err = json.Unmarshal(message, &status)
+			if err != nil || status.Token == "" {
+				fmt.Println("Error no token in the register_repeater response")
+				return
+			}
+			err = nh_util.NH_dump_to_file(*tokenfile, []byte(status.Token), 0600)
+			if err != nil {
+				fmt.Println("Error while saving the token", err.Error())
+			}
+		}
+	case "wake":
+		if *data == "" {
+			fmt.Println("Wake needs the MAC Address or the name of the client")
+			return
+		}
+		jc = m{
+			"type": "wake_client",
+			"Mbody": m{
+				"client": *data,
+			},
+		}
+
+		jsonData, err := json.Marshal(jc)
+		if err != nil {
+			fmt.Println("Error while marshalling data...", err.Error())
+			return
+		}
+
+		message, err := send(*ipaddress, "/wakeclient", jsonData, *secret, *configPath)
 		if err != nil {
-			fmt.Println("Error while sending register_repeater to the server")
+			fmt.Println("Error while sending wake to the server", err.Error())
 			return
 		}
 		fmt.Println(string(message))
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
@@ -154,6 +155,32 @@ func (c *Control) GetRouterPublicIP(vpnIp iputil.VpnIp, pending bool) *ControlHo
 	return &ch
 }
 
+// VerifyPeerCert returns the certificate name of the host behind vpnIp if it has a tunnel with us and its
+// certificate is still valid for our CA pool
+func (c *Control) VerifyPeerCert(ip net.IP) (string, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", fmt.Errorf("not an ipv4 address: %s", ip)
+	}
+	hostinfo, err := c.f.hostMap.QueryVpnIp(iputil.Ip2VpnIp(ip4), c.f.networkID)
+	if err != nil {
+		return "", err
+	}
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.peerCert == nil {
+		return "", fmt.Errorf("no certificate for %s", ip)
+	}
+	caPool := c.f.caPool[c.f.networkID]
+	if caPool == nil {
+		return "", fmt.Errorf("no ca pool for network %d", c.f.networkID)
+	}
+	peerCert := hostinfo.ConnectionState.peerCert
+	valid, err := peerCert.Verify(time.Now(), caPool)
+	if !valid {
+		return "", fmt.Errorf("certificate of %s is not valid: %v", ip, err)
+	}
+	return peerCert.Details.Name, nil
+}
+
 func (c *Control) GetHostInfoByVpnIp(vpnIp iputil.VpnIp, pending bool) *ControlHostInfo {
 	var hm *HostMap
 	if pending {
@@ -36,6 +36,24 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 	}
 	rs, err := router.NewRouterServer(l)
 	if err == nil {
+		interval := c.GetDuration("router.telemetry_interval", 30*time.Second)
+		serr := rs.SetTelemetrySources(c.GetStringSlice("router.telemetry_sources", []string{"push"}), interval)
+		if serr != nil {
+			// A bad router section must not keep the tunnel down
+			l.WithError(serr).Error("Invalid router.telemetry_sources, falling back to push")
+			rs.SetTelemetrySources([]string{"push"}, interval)
+		}
+	}
+	if err == nil {
+		rs.SetDNSQueryLog(c.GetBool("router.dns_query_log", false))
+		// The other units of the mesh use the router api over mutual TLS with
+		// the Nebula certificate of this unit
+		id, ierr := router.LoadNebulaIdentity(c.GetString("pki.ca", ""), c.GetString("pki.cert", ""), c.GetString("pki.key", ""))
+		if ierr != nil {
+			l.WithError(ierr).Error("Router api over TLS is disabled")
+		} else {
+			rs.SetIdentity(id)
+		}
 		go rs.StartRouterServer()
 	} else {
 		return nil, nil, err
@@ -468,5 +486,8 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		dnsStart = dnsMain(l, hostMap, c)
 	}
 
-	return &Control{ifce, l, cancel, sshStart, statsStart, dnsStart, nil}, rs, nil
+	control := &Control{ifce, l, cancel, sshStart, statsStart, dnsStart, nil}
+	// Let Nebula peers use the router api over their tunnels
+	rs.SetPeerVerifier(tunCidr, control.VerifyPeerCert)
+	return control, rs, nil
 }
@@ -4,6 +4,7 @@ import (
 	"container/ring"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	nh_util "nh_util"
 
@@ -13,19 +14,34 @@ import (
 const MAX_NUM_OF_CLIENTS = 128
 const MAX_NUM_OF_BLOCK_CATEGORIES = 128
 
+// Categories known to the firmware. Used till the router has fetched the category registry
+var DefaultBlockCategories = []string{
+	"malware", "adult", "amongus", "banuba", "facebook", "instagram", "parlor", "roblox",
+	"snapchat", "tellonym", "tiktok", "tinder", "youtube", "zoomerang", "discord", "fifamobile",
+}
+
 type m map[string]interface{}
 
 // Connected client info
 type ClientInfo struct {
-	MACAddress    string `json:macaddress,omitempty`
-	IPAddress     string `json:ipaddress,omitempty`
-	Name          string `json:name,omitempty`
-	Type          int    `json:type,omitempty`
-	Channel       int    `json:channel,omitempty`
-	SignalQuality int    `json:signalquality,omitempty`
-	Paused        bool   `json:paused,omitempty`
-	IsRepeater    bool   `json:isrepeater,omitempty`
-	Lastseen      int64  `json:lastseen,omitempty`
+	MACAddress     string     `json:macaddress,omitempty`
+	IPAddress      string     `json:ipaddress,omitempty`
+	Name           string     `json:name,omitempty`
+	Type           int        `json:type,omitempty`
+	Channel        int        `json:channel,omitempty`
+	SignalQuality  int        `json:signalquality,omitempty`
+	Paused         bool       `json:paused,omitempty`
+	IsRepeater     bool       `json:isrepeater,omitempty`
+	Lastseen       int64      `json:lastseen,omitempty`
+	Quota          *QuotaInfo `json:"quota,omitempty"`
+	Vendor         string     `json:"vendor,omitempty"`
+	TypeConfidence int        `json:"typeconfidence,omitempty"`
+	TypeManual     bool       `json:"typemanual,omitempty"`
+	Profile        string     `json:"profile,omitempty"`
+	Person         string     `json:"person,omitempty"`
+	Home           bool       `json:"home,omitempty"`
+	Approval       string     `json:"approval,omitempty"`
+	Group          string     `json:"group,omitempty"`
 }
 
 type ClientsInfoMessage struct {
@@ -116,6 +132,465 @@ type StatsMessage struct {
 	Mbody InnerStatsMessage `json:Mbody`
 }
 
+type InnerUsageMessage struct {
+	MACAddress string `json:"macaddress,omitempty"`
+	Period     string `json:"period,omitempty"`
+}
+
+type UsageMessage struct {
+	Type  string            `json:"type"`
+	Mbody InnerUsageMessage `json:"Mbody"`
+}
+
+// Count is the number of top and blocked domains per client, 20 by default
+type InnerDNSActivityMessage struct {
+	MACAddress string `json:"macaddress,omitempty"`
+	Count      int    `json:"count,omitempty"`
+}
+
+type DNSActivityMessage struct {
+	Type  string                  `json:"type"`
+	Mbody InnerDNSActivityMessage `json:"Mbody"`
+}
+
+// Duration is in seconds. OnExpiry is what happens to the guest network when
+// the last pass expires: disable (default) or rotate the key
+type GuestPassInnerMessage struct {
+	Id       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	OnExpiry string `json:"onexpiry,omitempty"`
+}
+
+type GuestPassMessage struct {
+	Type  string                `json:"type"`
+	Mbody GuestPassInnerMessage `json:"Mbody"`
+}
+
+// Qr is the WIFI: payload of the QR code joining the guest network
+type GuestPassInfo struct {
+	Id      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+	Ssid    string `json:"ssid"`
+	Key     string `json:"key"`
+	Qr      string `json:"qr"`
+}
+
+type PresenceDeviceInfo struct {
+	MACAddress string `json:"macaddress"`
+	Person     string `json:"person"`
+	Name       string `json:"name,omitempty"`
+	Home       bool   `json:"home"`
+	Lastseen   int64  `json:"lastseen,omitempty"`
+}
+
+// Since is when the person arrived, or left when not home
+type PersonPresenceInfo struct {
+	Person  string               `json:"person"`
+	Home    bool                 `json:"home"`
+	Since   int64                `json:"since"`
+	Devices []PresenceDeviceInfo `json:"devices"`
+}
+
+type PresenceInfo struct {
+	GracePeriod int64                `json:"graceperiod"`
+	People      []PersonPresenceInfo `json:"people"`
+}
+
+// Devices are all the person devices. GracePeriod is in seconds
+type PresenceInnerMessage struct {
+	GracePeriod int64                `json:"graceperiod"`
+	Devices     []PresenceDeviceInfo `json:"devices"`
+}
+
+type PresenceMessage struct {
+	Type  string               `json:"type"`
+	Mbody PresenceInnerMessage `json:"Mbody"`
+}
+
+// Period is hour (default) or day. Count is the number of top destinations, 20 by default
+type InnerFlowsMessage struct {
+	MACAddress string `json:"macaddress,omitempty"`
+	Period     string `json:"period,omitempty"`
+	Count      int    `json:"count,omitempty"`
+}
+
+type FlowsMessage struct {
+	Type  string            `json:"type"`
+	Mbody InnerFlowsMessage `json:"Mbody"`
+}
+
+// Host is the domain the address was resolved from, when the client looked it up
+type FlowDestinationInfo struct {
+	Ip       string `json:"ip,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Proto    int    `json:"proto,omitempty"`
+	Host     string `json:"host,omitempty"`
+	BytesIn  uint64 `json:"bytesin"`
+	BytesOut uint64 `json:"bytesout"`
+}
+
+// Top destinations of a client. Other adds up the traffic to the rest
+type ClientFlowsInfo struct {
+	MACAddress   string                `json:"macaddress"`
+	Name         string                `json:"name"`
+	Period       string                `json:"period"`
+	BytesIn      uint64                `json:"bytesin"`
+	BytesOut     uint64                `json:"bytesout"`
+	Destinations []FlowDestinationInfo `json:"destinations"`
+	Other        FlowDestinationInfo   `json:"other"`
+}
+
+// Versioned archive of the router state. Payload is encrypted with AES-GCM under
+// a key derived from the passphrase when Encrypted is set
+type ConfigArchive struct {
+	Version   int    `json:"version"`
+	Created   int64  `json:"created"`
+	Fwver     string `json:"fwver,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+	Salt      []byte `json:"salt,omitempty"`
+	Nonce     []byte `json:"nonce,omitempty"`
+	Payload   []byte `json:"payload"`
+}
+
+// export_config encrypts the archive with the passphrase. Without one the
+// archive is not encrypted and leaves out the Wi-Fi keys. import_config needs
+// it for encrypted archives. Archive is only used by import_config
+type ConfigInnerMessage struct {
+	Passphrase string         `json:"passphrase,omitempty"`
+	Archive    *ConfigArchive `json:"archive,omitempty"`
+}
+
+type ConfigMessage struct {
+	Type  string             `json:"type"`
+	Mbody ConfigInnerMessage `json:"Mbody"`
+}
+
+type ClientGroupInfo struct {
+	Name      string         `json:"name"`
+	Clients   []string       `json:"clients"`
+	Paused    bool           `json:"paused"`
+	Schedules []ScheduleInfo `json:"schedules"`
+	Profile   string         `json:"profile,omitempty"`
+}
+
+// Name is used by create_group and delete_group. assign_group moves Clients into
+// the group, or out of any group for an empty Name. pause_group uses Pause
+type GroupInnerMessage struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients,omitempty"`
+	Pause   bool     `json:"pause,omitempty"`
+}
+
+type GroupMessage struct {
+	Type  string            `json:"type"`
+	Mbody GroupInnerMessage `json:"Mbody"`
+}
+
+// Schedules and the filtering profile for all the members of the group
+type GroupPolicyInnerMessage struct {
+	Name      string         `json:"name"`
+	Schedules []ScheduleInfo `json:"schedules"`
+	Profile   string         `json:"profile,omitempty"`
+}
+
+type GroupPolicyMessage struct {
+	Type  string                  `json:"type"`
+	Mbody GroupPolicyInnerMessage `json:"Mbody"`
+}
+
+// Enabled turns the traffic anomaly detectors on. AutoPause pauses the client on a detection
+type AnomalyConfigInfo struct {
+	Enabled   bool `json:"enabled"`
+	AutoPause bool `json:"autopause"`
+}
+
+type AnomalyConfigMessage struct {
+	Type  string            `json:"type"`
+	Mbody AnomalyConfigInfo `json:"Mbody"`
+}
+
+// Client is the MAC Address or the name of the client
+type WakeClientInnerMessage struct {
+	Client string `json:"client"`
+}
+
+type WakeClientMessage struct {
+	Type  string                 `json:"type"`
+	Mbody WakeClientInnerMessage `json:"Mbody"`
+}
+
+// Clients waiting for approval. Quarantine is the mode the client is held in
+type PendingClientInfo struct {
+	MACAddress   string `json:"macaddress"`
+	IPAddress    string `json:"ipaddress"`
+	Name         string `json:"name"`
+	Vendor       string `json:"vendor,omitempty"`
+	Type         int    `json:"type"`
+	Quarantine   string `json:"quarantine"`
+	PendingSince int64  `json:"pendingsince"`
+	Lastseen     int64  `json:"lastseen"`
+}
+
+type QuarantineInfo struct {
+	Mode    string              `json:"mode"`
+	Pending []PendingClientInfo `json:"pending"`
+}
+
+// Mode is off, pause or internet (internet only, no LAN)
+type QuarantineInnerMessage struct {
+	Mode string `json:"mode"`
+}
+
+type QuarantineMessage struct {
+	Type  string                 `json:"type"`
+	Mbody QuarantineInnerMessage `json:"Mbody"`
+}
+
+// Approve false rejects the client. Rejected clients stay paused
+type ApproveClientInnerMessage struct {
+	MACAddress string `json:"macaddress"`
+	Approve    bool   `json:"approve"`
+}
+
+type ApproveClientMessage struct {
+	Type  string                    `json:"type"`
+	Mbody ApproveClientInnerMessage `json:"Mbody"`
+}
+
+type InnerStationHistoryMessage struct {
+	MACAddress string `json:"macaddress"`
+}
+
+type StationHistoryMessage struct {
+	Type  string                     `json:"type"`
+	Mbody InnerStationHistoryMessage `json:"Mbody"`
+}
+
+type StationSampleInfo struct {
+	Tstamp  int64  `json:"tstamp"`
+	Rssi    int    `json:"rssi"`
+	Channel int    `json:"channel"`
+	Node    string `json:"node"`
+}
+
+type StationRoamInfo struct {
+	Tstamp    int64  `json:"tstamp"`
+	FromNode  string `json:"fromnode"`
+	ToNode    string `json:"tonode"`
+	FromBssid string `json:"frombssid"`
+	ToBssid   string `json:"tobssid"`
+	Rssi      int    `json:"rssi"`
+}
+
+// RSSI samples of a wireless client and its roams between the router and the repeaters
+type StationHistoryInfo struct {
+	MACAddress string              `json:"macaddress"`
+	Node       string              `json:"node"`
+	NodeName   string              `json:"nodename"`
+	Bssid      string              `json:"bssid"`
+	Rssi       int                 `json:"rssi"`
+	Lastseen   int64               `json:"lastseen"`
+	Sticky     bool                `json:"sticky"`
+	WeakSince  int64               `json:"weaksince,omitempty"`
+	Samples    []StationSampleInfo `json:"samples"`
+	Roams      []StationRoamInfo   `json:"roams"`
+}
+
+type UsageEntryInfo struct {
+	Tstamp   int64  `json:"tstamp"`
+	BytesIn  uint64 `json:"bytesin"`
+	BytesOut uint64 `json:"bytesout"`
+}
+
+// Usage history of a client for the requested period (minute, hour, day or month)
+type ClientUsageInfo struct {
+	MACAddress string           `json:"macaddress"`
+	Period     string           `json:"period"`
+	Entries    []UsageEntryInfo `json:"entries"`
+}
+
+type DNSDomainInfo struct {
+	Domain   string `json:"domain"`
+	Queries  uint64 `json:"queries"`
+	Blocked  uint64 `json:"blocked"`
+	Category string `json:"category,omitempty"`
+	Lastseen int64  `json:"lastseen"`
+}
+
+// Domains a client has been reaching and the ones the filtering stopped, with
+// the blocklist category that stopped them
+type DNSActivityInfo struct {
+	MACAddress     string          `json:"macaddress"`
+	Name           string          `json:"name"`
+	Since          int64           `json:"since"`
+	Queries        uint64          `json:"queries"`
+	Blocked        uint64          `json:"blocked"`
+	TopDomains     []DNSDomainInfo `json:"topdomains"`
+	BlockedDomains []DNSDomainInfo `json:"blockeddomains"`
+}
+
+type ScheduleInfo struct {
+	Days  []int  `json:"days"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type ClientSchedulesInfo struct {
+	MACAddress string         `json:"macaddress"`
+	Schedules  []ScheduleInfo `json:"schedules"`
+}
+
+type ScheduleMessage struct {
+	Type  string              `json:"type"`
+	Mbody ClientSchedulesInfo `json:"Mbody"`
+}
+
+// Daily quota shared by the listed clients. Zero limits are unlimited.
+type QuotaInfo struct {
+	Name         string   `json:"name"`
+	Clients      []string `json:"clients"`
+	DailyBytes   uint64   `json:"dailybytes"`
+	DailyMinutes int      `json:"dailyminutes"`
+	ResetTime    string   `json:"resettime,omitempty"`
+	UsedBytes    uint64   `json:"usedbytes"`
+	UsedMinutes  int      `json:"usedminutes"`
+	Exceeded     bool     `json:"exceeded"`
+}
+
+type QuotasInnerMessage struct {
+	Quotas []QuotaInfo `json:"quotas"`
+}
+
+type QuotasMessage struct {
+	Type  string             `json:"type"`
+	Mbody QuotasInnerMessage `json:"Mbody"`
+}
+
+// Source of blocked IPs. Kind is url, file or user. Entries are the IPs and
+// CIDRs of the user feed
+type IPBlocklistFeedInfo struct {
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind"`
+	Source    string   `json:"source,omitempty"`
+	Entries   []string `json:"entries,omitempty"`
+	Updated   int64    `json:"updated,omitempty"`
+	Attempted int64    `json:"attempted,omitempty"`
+	Count     int      `json:"count,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type IPBlocklistInnerMessage struct {
+	Feeds []IPBlocklistFeedInfo `json:"feeds"`
+}
+
+type IPBlocklistMessage struct {
+	Type  string                  `json:"type"`
+	Mbody IPBlocklistInnerMessage `json:"Mbody"`
+}
+
+// Channel change suggested by the router for one of its radios or a repeater's
+type ChannelRecommendationInfo struct {
+	Node             string `json:"node"`
+	NodeName         string `json:"nodename"`
+	Radio            string `json:"radio"`
+	Band             string `json:"band"`
+	Current          int    `json:"current"`
+	Recommended      int    `json:"recommended"`
+	CurrentScore     int    `json:"currentscore"`
+	RecommendedScore int    `json:"recommendedscore"`
+	Reason           string `json:"reason"`
+	Tstamp           int64  `json:"tstamp"`
+	Applied          bool   `json:"applied"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Mode is off, recommend or auto. In auto the recommendations are applied
+// between QuietStart and QuietEnd ("HH:MM")
+type ChannelPlanInfo struct {
+	Mode            string                      `json:"mode"`
+	QuietStart      string                      `json:"quietstart"`
+	QuietEnd        string                      `json:"quietend"`
+	Planned         int64                       `json:"planned,omitempty"`
+	Recommendations []ChannelRecommendationInfo `json:"recommendations"`
+}
+
+type ChannelPlanMessage struct {
+	Type  string          `json:"type"`
+	Mbody ChannelPlanInfo `json:"Mbody"`
+}
+
+// Wireless settings saved before a change. Keys are left out of the listing
+type WirelessSnapshotInfo struct {
+	Version int    `json:"version"`
+	Tstamp  int64  `json:"tstamp"`
+	Reason  string `json:"reason"`
+	Ssid2   string `json:"ssid2,omitempty"`
+	Ssid5   string `json:"ssid5,omitempty"`
+	Ssid52  string `json:"ssid52,omitempty"`
+	Gssid2  string `json:"gssid2,omitempty"`
+}
+
+type RestoreWirelessInnerMessage struct {
+	Version int `json:"version"`
+}
+
+type RestoreWirelessMessage struct {
+	Type  string                      `json:"type"`
+	Mbody RestoreWirelessInnerMessage `json:"Mbody"`
+}
+
+// Signed firmware image to upgrade the router and its repeaters to. Signature is
+// the hex ed25519 signature of the image's sha256 digest
+type UpgradeInnerMessage struct {
+	Url       string `json:"url"`
+	Version   string `json:"version"`
+	Sha256    string `json:"sha256,omitempty"`
+	Signature string `json:"signature"`
+}
+
+type UpgradeMessage struct {
+	Type  string              `json:"type"`
+	Mbody UpgradeInnerMessage `json:"Mbody"`
+}
+
+type UpgradeTargetInfo struct {
+	Mac         string `json:"mac"`
+	Name        string `json:"name"`
+	Ip          string `json:"ip,omitempty"`
+	IsRoot      bool   `json:"isroot,omitempty"`
+	FromVersion string `json:"fromversion"`
+	State       string `json:"state"`
+	Error       string `json:"error,omitempty"`
+}
+
+type UpgradeStatusInfo struct {
+	State       string              `json:"state"`
+	Version     string              `json:"version,omitempty"`
+	PrevVersion string              `json:"prevversion,omitempty"`
+	Url         string              `json:"url,omitempty"`
+	Started     int64               `json:"started,omitempty"`
+	Updated     int64               `json:"updated,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	Targets     []UpgradeTargetInfo `json:"targets"`
+}
+
+// Root router or repeater with the stations associated to it and the repeaters below it
+type TopologyNode struct {
+	Mac          string         `json:"mac"`
+	Name         string         `json:"name,omitempty"`
+	Ip           string         `json:"ip,omitempty"`
+	Fwver        string         `json:"fwver,omitempty"`
+	IsRoot       bool           `json:"isroot,omitempty"`
+	Online       bool           `json:"online"`
+	Lastseen     int64          `json:"lastseen,omitempty"`
+	BackhaulRssi int            `json:"backhaulrssi,omitempty"`
+	Stations     []string       `json:"stations"`
+	Children     []TopologyNode `json:"children"`
+}
+
 type ClientsMessage struct {
 	Type  string              `json:type`
 	Mbody ClientsInnerMessage `json:Mbody`
@@ -126,6 +601,33 @@ type BlocklistMessage struct {
 	Mbody BlocklistInnerMessage `json:Mbody`
 }
 
+// Category of blocked domains from the registry. Source is the url of its
+// domain list, empty for the lists maintained by the firmware scripts
+type BlockCategoryInfo struct {
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+}
+
+// Categories and custom domains blocked for the clients of the profile.
+// Clients in no profile get the network wide blocklist
+type FilterProfileInfo struct {
+	Name       string   `json:"name"`
+	Categories []string `json:"categories"`
+	Domains    []string `json:"domains"`
+	Clients    []string `json:"clients"`
+}
+
+type FilterProfilesInnerMessage struct {
+	Profiles []FilterProfileInfo `json:"profiles"`
+}
+
+type FilterProfilesMessage struct {
+	Type  string                     `json:"type"`
+	Mbody FilterProfilesInnerMessage `json:"Mbody"`
+}
+
 type InnerRouterEventMessage struct {
 	Etype      int    `json:etype,omitempty`
 	IPAddress  string `json:ipaddress,omitempty`
@@ -133,6 +635,7 @@ type InnerRouterEventMessage struct {
 	Name       string `json:name,omitempty`
 	Extra      string `json:extra,omitempty`
 	Tstamp     int64  `json:tstamp,omitempty`
+	Source     string `json:"source,omitempty"`
 }
 
 type RouterEventMessage struct {
@@ -140,6 +643,31 @@ type RouterEventMessage struct {
 	Mbody InnerRouterEventMessage `json:mbody,omitempty`
 }
 
+// Router event as recorded in the event journal
+type EventInfo struct {
+	Seq        uint64 `json:"seq"`
+	Etype      int    `json:"etype"`
+	IPAddress  string `json:"ipaddress,omitempty"`
+	MACAddress string `json:"macaddress,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Extra      string `json:"extra,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Tstamp     int64  `json:"tstamp"`
+}
+
+// Events after Since, or the latest ones without it
+type InnerEventsMessage struct {
+	Since      uint64 `json:"since,omitempty"`
+	Etypes     []int  `json:"etypes,omitempty"`
+	MACAddress string `json:"macaddress,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+type EventsMessage struct {
+	Type  string             `json:"type"`
+	Mbody InnerEventsMessage `json:"Mbody"`
+}
+
 type Event struct {
 	EType       int
 	EName       string
@@ -148,6 +676,7 @@ type Event struct {
 	Extra       string
 	Active      bool
 	Tstamp      int64
+	Source      string
 }
 
 func process_get_wireless_message() string {
@@ -165,8 +694,24 @@ func process_get_wireless_message() string {
 	return string(jsonData)
 }
 
+// Reads the shared secret of the local router api
+func Router_api_secret() string {
+	if api_secret_file == "" {
+		return ""
+	}
+	secret, err := nh_util.NH_read_file(api_secret_file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(secret))
+}
+
+func send_router_req(path string, req []byte) ([]byte, error, int) {
+	return nh_util.Nh_http_send_auth_req("http://127.0.0.1:11000"+path, req, Router_api_secret())
+}
+
 func Get_client_message(mbody *ClientsInnerMessage) error {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/clients", []byte(""))
+	data, err, _ := send_router_req("/clients", []byte(""))
 	if err != nil {
 		return err
 	}
@@ -195,7 +740,263 @@ func process_clients_get_message(l *logrus.Logger) string {
 }
 
 func get_client_stats(req []byte) string {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/clistats", req)
+	data, err, _ := send_router_req("/clistats", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_client_usage(req []byte) string {
+	data, err, _ := send_router_req("/usage", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func export_config(req []byte) string {
+	data, err, _ := send_router_req("/exportconfig", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func import_config(req []byte) string {
+	data, err, _ := send_router_req("/importconfig", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_groups() string {
+	data, err, _ := send_router_req("/groups", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func group_req(path string, req []byte) string {
+	data, err, _ := send_router_req(path, req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_anomaly_config() string {
+	data, err, _ := send_router_req("/getanomalyconfig", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_anomaly_config(req []byte) string {
+	data, err, _ := send_router_req("/setanomalyconfig", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_client_flows(req []byte) string {
+	data, err, _ := send_router_req("/flows", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_dns_activity(req []byte) string {
+	data, err, _ := send_router_req("/dnsactivity", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_block_categories() string {
+	data, err, _ := send_router_req("/blockcategories", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_filter_profiles() string {
+	data, err, _ := send_router_req("/getfilterprofiles", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_filter_profiles(req []byte) string {
+	data, err, _ := send_router_req("/setfilterprofiles", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func create_guest_pass(req []byte) string {
+	data, err, _ := send_router_req("/createguestpass", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func list_guest_passes() string {
+	data, err, _ := send_router_req("/guestpasses", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func revoke_guest_pass(req []byte) string {
+	data, err, _ := send_router_req("/revokeguestpass", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_pending_clients() string {
+	data, err, _ := send_router_req("/getquarantine", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_quarantine(req []byte) string {
+	data, err, _ := send_router_req("/setquarantine", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func approve_client(req []byte) string {
+	data, err, _ := send_router_req("/approveclient", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func wake_client(req []byte) string {
+	data, err, _ := send_router_req("/wakeclient", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_presence() string {
+	data, err, _ := send_router_req("/getpresence", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_presence(req []byte) string {
+	data, err, _ := send_router_req("/setpresence", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_station_history(req []byte) string {
+	data, err, _ := send_router_req("/stationhistory", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_schedules(req []byte) string {
+	data, err, _ := send_router_req("/getschedules", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_schedules(req []byte) string {
+	data, err, _ := send_router_req("/setschedules", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_quotas() string {
+	data, err, _ := send_router_req("/getquotas", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_quotas(req []byte) string {
+	data, err, _ := send_router_req("/setquotas", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_ip_blocklist() string {
+	data, err, _ := send_router_req("/getipblocklist", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_ip_blocklist(req []byte) string {
+	data, err, _ := send_router_req("/setipblocklist", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_events(req []byte) string {
+	data, err, _ := send_router_req("/getevents", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_channel_plan() string {
+	data, err, _ := send_router_req("/getchannelplan", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func set_channel_plan(req []byte) string {
+	data, err, _ := send_router_req("/setchannelplan", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_topology() string {
+	data, err, _ := send_router_req("/topology", []byte(""))
 	if err != nil {
 		return nh_util.NH_getErrorStatusString(err.Error())
 	}
@@ -203,7 +1004,7 @@ func get_client_stats(req []byte) string {
 }
 
 func get_repeaters() string {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/repeaters", []byte(""))
+	data, err, _ := send_router_req("/repeaters", []byte(""))
 	if err != nil {
 		return nh_util.NH_getErrorStatusString(err.Error())
 	}
@@ -211,7 +1012,7 @@ func get_repeaters() string {
 }
 
 func pause_client(req []byte) string {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/pause", req)
+	data, err, _ := send_router_req("/pause", req)
 	if err != nil {
 		fmt.Println("Error...", err.Error())
 		return nh_util.NH_getErrorStatusString(err.Error())
@@ -220,7 +1021,7 @@ func pause_client(req []byte) string {
 }
 
 func set_client_details(req []byte) string {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/setclientdetails", req)
+	data, err, _ := send_router_req("/setclientdetails", req)
 	if err != nil {
 		fmt.Println("Error...", err.Error())
 		return nh_util.NH_getErrorStatusString(err.Error())
@@ -228,14 +1029,32 @@ func set_client_details(req []byte) string {
 	return string(data)
 }
 
-func upgrade_fw() string {
-	args := []string{"&"}
-	status := nh_util.NH_read_cmd_output(fw_upgrade_cmd, args)
-	return "{\"status\": \"" + status + "\"}"
+// Without an image the unit upgrades itself with its update script, as
+// upgrade_fw did before the router managed upgrades
+func upgrade_fw(req []byte) string {
+	var message UpgradeMessage
+	if json.Unmarshal(req, &message) != nil || message.Mbody.Url == "" {
+		args := []string{"&"}
+		status := nh_util.NH_read_cmd_output(fw_upgrade_cmd, args)
+		return "{\"status\": \"" + status + "\"}"
+	}
+	data, err, _ := send_router_req("/upgrade", req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
+}
+
+func get_upgrade_status() string {
+	data, err, _ := send_router_req("/upgradestatus", []byte(""))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(data)
 }
 
 func upload_logs() string {
-	data, err, _ := nh_util.Nh_http_send_req("http://127.0.0.1:11000/uploadlogs", []byte(""))
+	data, err, _ := send_router_req("/uploadlogs", []byte(""))
 	if err != nil {
 		fmt.Println("Error...", err.Error())
 		return nh_util.NH_getErrorStatusString(err.Error())
@@ -243,7 +1062,7 @@ func upload_logs() string {
 	return string(data)
 }
 
-func newEvent(Events *ring.Ring, l *logrus.Logger, etype int, ip string, mac string, name string, extra string, tstamp int64) {
+func newEvent(Events *ring.Ring, l *logrus.Logger, etype int, ip string, mac string, name string, extra string, tstamp int64, source string) {
 	event := &Event{
 		EType:       etype,
 		EIPAddress:  ip,
@@ -252,6 +1071,7 @@ func newEvent(Events *ring.Ring, l *logrus.Logger, etype int, ip string, mac str
 		Extra:       extra,
 		Tstamp:      tstamp,
 		Active:      true,
+		Source:      source,
 	}
 	l.Error("Event...", event)
 	Events.Value = event
@@ -266,7 +1086,7 @@ func handle_router_event(data []byte, l *logrus.Logger, Events *ring.Ring) strin
 	}
 	newEvent(Events, l, routerEventMessage.Mbody.Etype, routerEventMessage.Mbody.IPAddress,
 		routerEventMessage.Mbody.MACAddress, routerEventMessage.Mbody.Name,
-		routerEventMessage.Mbody.Extra, routerEventMessage.Mbody.Tstamp)
+		routerEventMessage.Mbody.Extra, routerEventMessage.Mbody.Tstamp, routerEventMessage.Mbody.Source)
 	return ""
 }
 
@@ -289,6 +1109,15 @@ func ProcessMessage(data []byte, l *logrus.Logger, Events *ring.Ring) string {
 		return Set_wireless(message.Mbody)
 	case "get_wireless":
 		return process_get_wireless_message()
+	case "list_wireless_snapshots":
+		return list_wireless_snapshots()
+	case "restore_wireless":
+		var restoreMessage RestoreWirelessMessage
+		err = json.Unmarshal(data, &restoreMessage)
+		if err != nil {
+			return nh_util.NH_getErrorStatusString(err.Error())
+		}
+		return restore_wireless(restoreMessage.Mbody)
 	case "get_clients":
 		return process_clients_get_message(l)
 	case "set_client_details":
@@ -310,12 +1139,86 @@ func ProcessMessage(data []byte, l *logrus.Logger, Events *ring.Ring) string {
 			return nh_util.NH_getErrorStatusString(err.Error())
 		}
 		return set_blocklist(blocklistMessage.Mbody)
+	case "get_block_categories":
+		return get_block_categories()
+	case "get_filter_profiles":
+		return get_filter_profiles()
+	case "set_filter_profiles":
+		return set_filter_profiles(data)
 	case "get_client_stats":
 		return get_client_stats(data)
+	case "get_client_usage":
+		return get_client_usage(data)
+	case "export_config":
+		return export_config(data)
+	case "import_config":
+		return import_config(data)
+	case "get_groups":
+		return get_groups()
+	case "create_group":
+		return group_req("/creategroup", data)
+	case "delete_group":
+		return group_req("/deletegroup", data)
+	case "assign_group":
+		return group_req("/assigngroup", data)
+	case "pause_group":
+		return group_req("/pausegroup", data)
+	case "set_group_policy":
+		return group_req("/setgrouppolicy", data)
+	case "get_anomaly_config":
+		return get_anomaly_config()
+	case "set_anomaly_config":
+		return set_anomaly_config(data)
+	case "get_client_flows":
+		return get_client_flows(data)
+	case "get_dns_activity":
+		return get_dns_activity(data)
+	case "create_guest_pass":
+		return create_guest_pass(data)
+	case "list_guest_passes":
+		return list_guest_passes()
+	case "revoke_guest_pass":
+		return revoke_guest_pass(data)
+	case "get_pending_clients":
+		return get_pending_clients()
+	case "set_quarantine":
+		return set_quarantine(data)
+	case "approve_client":
+		return approve_client(data)
+	case "wake_client":
+		return wake_client(data)
+	case "get_presence":
+		return get_presence()
+	case "set_presence":
+		return set_presence(data)
+	case "get_station_history":
+		return get_station_history(data)
+	case "get_schedules":
+		return get_schedules(data)
+	case "set_schedules":
+		return set_schedules(data)
+	case "get_quotas":
+		return get_quotas()
+	case "set_quotas":
+		return set_quotas(data)
+	case "get_ip_blocklist":
+		return get_ip_blocklist()
+	case "set_ip_blocklist":
+		return set_ip_blocklist(data)
+	case "get_events":
+		return get_events(data)
+	case "get_channel_plan":
+		return get_channel_plan()
+	case "set_channel_plan":
+		return set_channel_plan(data)
+	case "get_topology":
+		return get_topology()
 	case "get_repeaters":
 		return get_repeaters()
 	case "upgrade_fw":
-		return upgrade_fw()
+		return upgrade_fw(data)
+	case "get_upgrade_status":
+		return get_upgrade_status()
 	case "router_event":
 		return handle_router_event(data, l, Events)
 	case "upload_logs":
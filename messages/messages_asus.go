@@ -8,6 +8,9 @@ const get_wireless_script = "/jffs/nearhop/sbin/get_wireless.sh"
 const get_blocklist_cmd = "/jffs/nearhop/sbin/get_block_urllist.sh"
 const set_blocklist_cmd = "/jffs/nearhop/sbin/set_block_urllist.sh"
 const fw_upgrade_cmd = "/jffs/nearhop/sbin/fw_update.sh"
+const wireless_snapshots_dir = "/jffs/nearhop/wireless_snapshots/"
+const block_categories_file = "/jffs/nearhop/block_categories.json"
+const api_secret_file = "/jffs/nearhop/api_secret"
 
 func start_onboarding_ap(start int) string {
 	return ""
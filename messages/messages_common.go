@@ -6,22 +6,11 @@ package messages
 import (
 	"encoding/json"
 	"fmt"
-	"os/exec"
 	"strings"
 
 	nh_util "nh_util"
 )
 
-func get_wireless() string {
-	out, err := exec.Command(get_wireless_script).Output()
-
-	if err != nil {
-		return nh_util.NH_getErrorStatusString(err.Error())
-	}
-	out1 := strings.TrimSuffix(string(out), "\n")
-	return string(out1)
-}
-
 func parseSettings(settings string) (map[string]string, error) {
 	entries := strings.Split(settings, "\n")
 	settingsMap := make(map[string]string)
@@ -95,91 +84,59 @@ func Get_wireless_message(message *InnerMessage) error {
 	return nil
 }
 
-func Set_wireless(message InnerMessage) string {
-	exec.Command(set_wireless_script,
-		"--ssid2", message.Ssid2,
-		"--ssid5", message.Ssid5,
-		"--ssid52", message.Ssid52,
-		"--key2", message.Key2,
-		"--key5", message.Key5,
-		"--key52", message.Key52,
-		"--gssid2", message.Gssid2,
-		"--gssid5", message.Gssid5,
-		"--gssid52", message.Gssid52,
-		"--gkey2", message.Gkey2,
-		"--gkey5", message.Gkey5,
-		"--gkey52", message.Gkey52,
-		"--chan2", message.Chan2,
-		"--chan51", message.Chan51,
-		"--chan52", message.Chan52,
-		"--chan6", message.Chan6,
-		"--chanwidth2", message.Chanwidth2,
-		"--chanwidth51", message.Chanwidth51,
-		"--chanwidth52", message.Chanwidth52,
-		"--chanwidth6", message.Chanwidth6,
-		"--chanwidth6", message.Chanwidth6,
-		"--encryption", message.Encryption,
-		"--gencryption", message.Gencryption,
-		"--disabled2", message.Disabled2,
-		"--disabled5", message.Disabled5,
-		"--disabled52", message.Disabled52,
-		"--meshssid", message.Meshid,
-		"--meshkey", message.Meshkey,
-	).Run()
-
-	status := "{\"status\": \"success\"}"
-	return status
+// Names of the categories in the registry cached by the router
+func blockCategoryNames() []string {
+	content, err := nh_util.NH_read_file(block_categories_file)
+	if err != nil {
+		return DefaultBlockCategories
+	}
+	var categories []BlockCategoryInfo
+	err = json.Unmarshal(content, &categories)
+	if err != nil || len(categories) == 0 {
+		return DefaultBlockCategories
+	}
+	names := make([]string, 0, len(categories))
+	for _, category := range categories {
+		names = append(names, category.Name)
+	}
+	return names
 }
 
-func get_blocklist() string {
-	var Domains [MAX_NUM_OF_BLOCK_CATEGORIES]BlockListMessageEntry
-
-	args := []string{}
-	cmd := get_blocklist_cmd
-	settings := nh_util.NH_read_cmd_output(cmd, args)
+// The network wide blocklist category settings
+func Get_blocklist_message(message *BlocklistInnerMessage) error {
+	settings := read_blocklist()
 	if settings == "" {
-		status := "Error while getting blocklist settings"
-		return nh_util.NH_getErrorStatusString(status)
+		return fmt.Errorf("Error while getting blocklist settings")
 	}
 
 	settingsMap, err := parseSettings(settings)
 	if err != nil {
-		return "Error while parsing blocklist settings"
+		return fmt.Errorf("Error while parsing blocklist settings")
+	}
+	categories := blockCategoryNames()
+	if len(categories) > MAX_NUM_OF_BLOCK_CATEGORIES {
+		categories = categories[:MAX_NUM_OF_BLOCK_CATEGORIES]
+	}
+	message.Domains = make([]BlockListMessageEntry, len(categories))
+	for i, name := range categories {
+		message.Domains[i].Domain = name
+		message.Domains[i].Blocked = settingsMap["block"+name]
+	}
+	return nil
+}
+
+func Set_blocklist(message BlocklistInnerMessage) string {
+	return set_blocklist(message)
+}
+
+func get_blocklist() string {
+	var message BlocklistInnerMessage
+	err := Get_blocklist_message(&message)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
 	}
-	Domains[0].Domain = "malware"
-	Domains[0].Blocked = settingsMap["blockmalware"]
-	Domains[1].Domain = "adult"
-	Domains[1].Blocked = settingsMap["blockadult"]
-	Domains[2].Domain = "amongus"
-	Domains[2].Blocked = settingsMap["blockamongus"]
-	Domains[3].Domain = "banuba"
-	Domains[3].Blocked = settingsMap["blockbanuba"]
-	Domains[4].Domain = "facebook"
-	Domains[4].Blocked = settingsMap["blockfacebook"]
-	Domains[5].Domain = "instagram"
-	Domains[5].Blocked = settingsMap["blockinstagram"]
-	Domains[6].Domain = "parlor"
-	Domains[6].Blocked = settingsMap["blockparlor"]
-	Domains[7].Domain = "roblox"
-	Domains[7].Blocked = settingsMap["blockroblox"]
-	Domains[8].Domain = "snapchat"
-	Domains[8].Blocked = settingsMap["blocksnapchat"]
-	Domains[9].Domain = "tellonym"
-	Domains[9].Blocked = settingsMap["blocktellonym"]
-	Domains[10].Domain = "tiktok"
-	Domains[10].Blocked = settingsMap["blocktiktok"]
-	Domains[11].Domain = "tinder"
-	Domains[11].Blocked = settingsMap["blocktinder"]
-	Domains[12].Domain = "youtube"
-	Domains[12].Blocked = settingsMap["blockyoutube"]
-	Domains[13].Domain = "zoomerang"
-	Domains[13].Blocked = settingsMap["blockzoomerang"]
-	Domains[14].Domain = "discord"
-	Domains[14].Blocked = settingsMap["blockdiscord"]
-	Domains[15].Domain = "fifamobile"
-	Domains[15].Blocked = settingsMap["blockfifamobile"]
 
-	jsonData, err := json.Marshal(Domains[:16])
+	jsonData, err := json.Marshal(message.Domains)
 	if err != nil {
 		return nh_util.NH_getErrorStatusString(err.Error())
 	}
@@ -195,6 +152,6 @@ func set_blocklist(message BlocklistInnerMessage) string {
 		args[2*i] = message.Domains[i].Domain
 		args[2*i+1] = message.Domains[i].Blocked
 	}
-	exec.Command(set_blocklist_cmd, args...).Run()
+	write_blocklist(args)
 	return ""
 }
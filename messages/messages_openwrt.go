@@ -14,6 +14,9 @@ const get_wireless_script = "/sbin/get_wireless.sh"
 const get_blocklist_cmd = "/sbin/get_block_urllist.sh"
 const set_blocklist_cmd = "/sbin/set_block_urllist.sh"
 const fw_upgrade_cmd = "/sbin/fw_update.sh"
+const wireless_snapshots_dir = "/etc/nearhop/wireless_snapshots/"
+const block_categories_file = "/etc/nearhop/block_categories.json"
+const api_secret_file = "/etc/nearhop/api_secret"
 
 func openwrt_process_wireless_message(json_message string) string {
 	return ""
@@ -1,8 +1,9 @@
-//go:build !openwrt && !asus
-// +build !openwrt,!asus
+//go:build !openwrt && !asus && !sim
+// +build !openwrt,!asus,!sim
 
 package messages
 
+const api_secret_file = ""
 const fw_upgrade_cmd = ""
 
 func Get_wireless_message(message *InnerMessage) error {
@@ -13,10 +14,26 @@ func Set_wireless(message InnerMessage) string {
 	return ""
 }
 
+func list_wireless_snapshots() string {
+	return ""
+}
+
+func restore_wireless(message RestoreWirelessInnerMessage) string {
+	return ""
+}
+
 func start_onboarding_ap(start int) string {
 	return ""
 }
 
+func Get_blocklist_message(message *BlocklistInnerMessage) error {
+	return nil
+}
+
+func Set_blocklist(message BlocklistInnerMessage) string {
+	return ""
+}
+
 func get_blocklist() string {
 	return ""
 }
@@ -0,0 +1,75 @@
+//go:build router && !sim
+// +build router,!sim
+
+package messages
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	nh_util "nh_util"
+)
+
+func get_wireless() string {
+	out, err := exec.Command(get_wireless_script).Output()
+
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	out1 := strings.TrimSuffix(string(out), "\n")
+	return string(out1)
+}
+
+func applyWireless(message InnerMessage) error {
+	out, err := exec.Command(set_wireless_script,
+		"--ssid2", message.Ssid2,
+		"--ssid5", message.Ssid5,
+		"--ssid52", message.Ssid52,
+		"--key2", message.Key2,
+		"--key5", message.Key5,
+		"--key52", message.Key52,
+		"--gssid2", message.Gssid2,
+		"--gssid5", message.Gssid5,
+		"--gssid52", message.Gssid52,
+		"--gkey2", message.Gkey2,
+		"--gkey5", message.Gkey5,
+		"--gkey52", message.Gkey52,
+		"--chan2", message.Chan2,
+		"--chan51", message.Chan51,
+		"--chan52", message.Chan52,
+		"--chan6", message.Chan6,
+		"--chanwidth2", message.Chanwidth2,
+		"--chanwidth51", message.Chanwidth51,
+		"--chanwidth52", message.Chanwidth52,
+		"--chanwidth6", message.Chanwidth6,
+		"--encryption", message.Encryption,
+		"--gencryption", message.Gencryption,
+		"--disabled2", message.Disabled2,
+		"--disabled5", message.Disabled5,
+		"--disabled52", message.Disabled52,
+		"--gdisabled2", message.Gdisabled2,
+		"--gdisabled5", message.Gdisabled5,
+		"--gdisabled52", message.Gdisabled52,
+		"--meshssid", message.Meshid,
+		"--meshkey", message.Meshkey,
+	).CombinedOutput()
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if output == "" {
+			output = err.Error()
+		}
+		return fmt.Errorf("set_wireless failed: %s", output)
+	}
+	return nil
+}
+
+func read_blocklist() string {
+	args := []string{}
+	cmd := get_blocklist_cmd
+	return nh_util.NH_read_cmd_output(cmd, args)
+}
+
+func write_blocklist(args []string) {
+	exec.Command(set_blocklist_cmd, args...).Run()
+}
@@ -0,0 +1,163 @@
+//go:build sim
+// +build sim
+
+package messages
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Simulated router for development and tests. The wireless and blocklist
+// settings are kept in memory instead of going through the scripts. The
+// files are under the base of the simulated router, see Sim_set_base
+var wireless_snapshots_dir = "/tmp/nearhop_sim/wireless_snapshots/"
+var block_categories_file = "/tmp/nearhop_sim/block_categories.json"
+var api_secret_file = "/tmp/nearhop_sim/api_secret"
+
+const fw_upgrade_cmd = "true"
+
+var simStarted = time.Now()
+
+var simSettings = struct {
+	sync.Mutex
+	wireless  map[string]string
+	blocklist map[string]string
+}{}
+
+func init() {
+	Sim_reset_settings()
+}
+
+// Keeps the files under dir, the base of the simulated router
+func Sim_set_base(dir string) {
+	wireless_snapshots_dir = dir + "wireless_snapshots/"
+	block_categories_file = dir + "block_categories.json"
+	api_secret_file = dir + "api_secret"
+}
+
+// Back to the settings of a new router. Tests call it between cases
+func Sim_reset_settings() {
+	simSettings.Lock()
+	defer simSettings.Unlock()
+	simSettings.wireless = map[string]string{
+		"ssid2":       "NearhopSim",
+		"ssid5":       "NearhopSim",
+		"ssid52":      "NearhopSim",
+		"key2":        "simulated-key",
+		"key5":        "simulated-key",
+		"key52":       "simulated-key",
+		"gssid2":      "NearhopSim-Guest",
+		"gssid5":      "NearhopSim-Guest",
+		"gssid52":     "NearhopSim-Guest",
+		"gkey2":       "simulated-guest",
+		"gkey5":       "simulated-guest",
+		"gkey52":      "simulated-guest",
+		"disabled2":   "0",
+		"disabled5":   "0",
+		"disabled52":  "0",
+		"gdisabled2":  "1",
+		"gdisabled5":  "1",
+		"gdisabled52": "1",
+		"meshid":      "NearhopSim-Mesh",
+		"meshkey":     "simulated-mesh",
+		"chan2":       "6",
+		"chan51":      "36",
+		"chan52":      "149",
+		"chan6":       "0",
+		"chanwidth2":  "20",
+		"chanwidth51": "80",
+		"chanwidth52": "80",
+		"chanwidth6":  "0",
+		"encryption":  "psk2",
+		"gencryption": "psk2",
+		"fwupdate":    "0",
+		"fwversion":   "sim-1.0.0",
+		"model":       "Simulated router",
+	}
+	simSettings.blocklist = make(map[string]string)
+	for _, name := range DefaultBlockCategories {
+		simSettings.blocklist["block"+name] = "0"
+	}
+}
+
+// key=value lines, as get_wireless.sh prints them
+func simDump(settings map[string]string) string {
+	lines := make([]string, 0, len(settings))
+	for key, value := range settings {
+		lines = append(lines, key+"="+value)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func get_wireless() string {
+	simSettings.Lock()
+	defer simSettings.Unlock()
+	simSettings.wireless["uptime"] = fmt.Sprintf("%d", int64(time.Since(simStarted).Seconds()))
+	return simDump(simSettings.wireless)
+}
+
+func applyWireless(message InnerMessage) error {
+	simSettings.Lock()
+	defer simSettings.Unlock()
+	settings := map[string]string{
+		"ssid2":       message.Ssid2,
+		"ssid5":       message.Ssid5,
+		"ssid52":      message.Ssid52,
+		"key2":        message.Key2,
+		"key5":        message.Key5,
+		"key52":       message.Key52,
+		"gssid2":      message.Gssid2,
+		"gssid5":      message.Gssid5,
+		"gssid52":     message.Gssid52,
+		"gkey2":       message.Gkey2,
+		"gkey5":       message.Gkey5,
+		"gkey52":      message.Gkey52,
+		"chan2":       message.Chan2,
+		"chan51":      message.Chan51,
+		"chan52":      message.Chan52,
+		"chan6":       message.Chan6,
+		"chanwidth2":  message.Chanwidth2,
+		"chanwidth51": message.Chanwidth51,
+		"chanwidth52": message.Chanwidth52,
+		"chanwidth6":  message.Chanwidth6,
+		"encryption":  message.Encryption,
+		"gencryption": message.Gencryption,
+		"disabled2":   message.Disabled2,
+		"disabled5":   message.Disabled5,
+		"disabled52":  message.Disabled52,
+		"gdisabled2":  message.Gdisabled2,
+		"gdisabled5":  message.Gdisabled5,
+		"gdisabled52": message.Gdisabled52,
+		"meshid":      message.Meshid,
+		"meshkey":     message.Meshkey,
+	}
+	for key, value := range settings {
+		simSettings.wireless[key] = value
+	}
+	return nil
+}
+
+func read_blocklist() string {
+	simSettings.Lock()
+	defer simSettings.Unlock()
+	return simDump(simSettings.blocklist)
+}
+
+// Pairs of category and blocked, as set_block_urllist.sh takes them
+func write_blocklist(args []string) {
+	simSettings.Lock()
+	defer simSettings.Unlock()
+	for i := 0; i+1 < len(args); i += 2 {
+		simSettings.blocklist["block"+args[i]] = args[i+1]
+	}
+}
+
+func start_onboarding_ap(start int) string {
+	status := "{\"status\": \"success\"}"
+	return status
+}
@@ -0,0 +1,336 @@
+//go:build router
+// +build router
+
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	nh_util "nh_util"
+)
+
+// Oldest snapshots are removed beyond this
+const MAX_WIRELESS_SNAPSHOTS = 10
+
+const MAX_SSID_LENGTH = 32
+const MIN_KEY_LENGTH = 8
+const MAX_KEY_LENGTH = 63
+
+// Wireless settings as they were before a set_wireless or restore_wireless
+type WirelessSnapshot struct {
+	Version  int
+	Tstamp   int64
+	Reason   string
+	Settings InnerMessage
+}
+
+var weakKeys = map[string]bool{
+	"12345678":   true,
+	"123456789":  true,
+	"1234567890": true,
+	"password":   true,
+	"password1":  true,
+	"qwertyui":   true,
+	"qwertyuiop": true,
+	"abcd1234":   true,
+	"iloveyou":   true,
+}
+
+// 5GHz channels and the widest channel width each of them can be part of
+var channels5 = map[int]int{
+	36: 160, 40: 160, 44: 160, 48: 160, 52: 160, 56: 160, 60: 160, 64: 160,
+	100: 160, 104: 160, 108: 160, 112: 160, 116: 160, 120: 160, 124: 160, 128: 160,
+	132: 80, 136: 80, 140: 80, 144: 80,
+	149: 80, 153: 80, 157: 80, 161: 80,
+	165: 20,
+}
+
+func validateSsid(name string, ssid string) error {
+	if ssid == "" {
+		return nil
+	}
+	if len(ssid) > MAX_SSID_LENGTH {
+		return fmt.Errorf("%s is longer than %d bytes", name, MAX_SSID_LENGTH)
+	}
+	for _, c := range ssid {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%s has invalid characters", name)
+		}
+	}
+	return nil
+}
+
+func openEncryption(encryption string) bool {
+	return encryption == "none" || encryption == "open"
+}
+
+func validateKey(name string, key string, encryption string) error {
+	if key == "" || openEncryption(encryption) {
+		return nil
+	}
+	if len(key) == 64 && isHex(key) {
+		// Raw PSK
+		return nil
+	}
+	if len(key) < MIN_KEY_LENGTH || len(key) > MAX_KEY_LENGTH {
+		return fmt.Errorf("%s must be %d to %d characters long", name, MIN_KEY_LENGTH, MAX_KEY_LENGTH)
+	}
+	for _, c := range key {
+		if c < 32 || c > 126 {
+			return fmt.Errorf("%s has invalid characters", name)
+		}
+	}
+	if weakKeys[strings.ToLower(key)] || strings.Count(key, key[:1]) == len(key) {
+		return fmt.Errorf("%s is too weak", name)
+	}
+	return nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a channel or width setting. 0 is auto and -1 an invalid value.
+// Widths are accepted with the mode prefix, say HT40 or VHT80
+func parseRadioSetting(value string) int {
+	value = strings.TrimLeft(strings.ToUpper(value), "EHTV")
+	if value == "" || value == "AUTO" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+func validateRadio(band string, chanstr string, widthstr string) error {
+	if chanstr == "" && widthstr == "" {
+		return nil
+	}
+	channel := parseRadioSetting(chanstr)
+	width := parseRadioSetting(widthstr)
+	if channel < 0 {
+		return fmt.Errorf("Invalid %s channel %s", band, chanstr)
+	}
+	if width < 0 {
+		return fmt.Errorf("Invalid %s channel width %s", band, widthstr)
+	}
+	switch band {
+	case "2.4GHz":
+		if channel > 14 {
+			return fmt.Errorf("Invalid 2.4GHz channel %d", channel)
+		}
+		if width != 0 && width != 20 && width != 40 {
+			return fmt.Errorf("Invalid 2.4GHz channel width %d", width)
+		}
+	case "5GHz":
+		if width != 0 && width != 20 && width != 40 && width != 80 && width != 160 {
+			return fmt.Errorf("Invalid 5GHz channel width %d", width)
+		}
+		if channel == 0 {
+			return nil
+		}
+		maxwidth, ok := channels5[channel]
+		if !ok {
+			return fmt.Errorf("Invalid 5GHz channel %d", channel)
+		}
+		if width > maxwidth {
+			return fmt.Errorf("Channel %d can't be used with %dMHz width", channel, width)
+		}
+	case "6GHz":
+		if channel != 0 && (channel > 233 || channel%4 != 1) {
+			return fmt.Errorf("Invalid 6GHz channel %d", channel)
+		}
+		if width != 0 && width != 20 && width != 40 && width != 80 && width != 160 && width != 320 {
+			return fmt.Errorf("Invalid 6GHz channel width %d", width)
+		}
+	}
+	return nil
+}
+
+// Keys are only checked when they change, a weak key already in use does
+// not hold back the other settings
+func validateWireless(message InnerMessage, current InnerMessage) error {
+	ssids := []struct{ name, value string }{
+		{"ssid2", message.Ssid2}, {"ssid5", message.Ssid5}, {"ssid52", message.Ssid52},
+		{"gssid2", message.Gssid2}, {"gssid5", message.Gssid5}, {"gssid52", message.Gssid52},
+		{"meshid", message.Meshid},
+	}
+	for _, ssid := range ssids {
+		if err := validateSsid(ssid.name, ssid.value); err != nil {
+			return err
+		}
+	}
+	keys := []struct{ name, value, old, encryption string }{
+		{"key2", message.Key2, current.Key2, message.Encryption}, {"key5", message.Key5, current.Key5, message.Encryption},
+		{"key52", message.Key52, current.Key52, message.Encryption},
+		{"gkey2", message.Gkey2, current.Gkey2, message.Gencryption}, {"gkey5", message.Gkey5, current.Gkey5, message.Gencryption},
+		{"gkey52", message.Gkey52, current.Gkey52, message.Gencryption},
+		{"meshkey", message.Meshkey, current.Meshkey, ""},
+	}
+	for _, key := range keys {
+		if key.value == key.old {
+			continue
+		}
+		if err := validateKey(key.name, key.value, key.encryption); err != nil {
+			return err
+		}
+	}
+	radios := []struct{ band, channel, width string }{
+		{"2.4GHz", message.Chan2, message.Chanwidth2},
+		{"5GHz", message.Chan51, message.Chanwidth51},
+		{"5GHz", message.Chan52, message.Chanwidth52},
+		{"6GHz", message.Chan6, message.Chanwidth6},
+	}
+	for _, radio := range radios {
+		if err := validateRadio(radio.band, radio.channel, radio.width); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func wirelessSnapshotFile(version int) string {
+	return wireless_snapshots_dir + strconv.Itoa(version) + ".json"
+}
+
+// Returns the snapshots, newest first
+func readWirelessSnapshots() []WirelessSnapshot {
+	snapshots := make([]WirelessSnapshot, 0)
+	files, _ := ioutil.ReadDir(wireless_snapshots_dir)
+	for _, file := range files {
+		content, err := nh_util.NH_read_file(wireless_snapshots_dir + file.Name())
+		if err != nil {
+			continue
+		}
+		var snapshot WirelessSnapshot
+		if json.Unmarshal(content, &snapshot) != nil || snapshot.Version == 0 {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Version > snapshots[j].Version
+	})
+	return snapshots
+}
+
+// Saves the current wireless settings as the next version
+func snapshotWireless(reason string, current InnerMessage) error {
+	snapshots := readWirelessSnapshots()
+	version := 1
+	if len(snapshots) > 0 {
+		version = snapshots[0].Version + 1
+	}
+	snapshot := WirelessSnapshot{
+		Version:  version,
+		Tstamp:   time.Now().Unix(),
+		Reason:   reason,
+		Settings: current,
+	}
+	sbytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	nh_util.NH_create_dir(wireless_snapshots_dir, 0700)
+	err = nh_util.NH_dump_to_file(wirelessSnapshotFile(version), sbytes, 0600)
+	if err != nil {
+		return err
+	}
+	for i := MAX_WIRELESS_SNAPSHOTS - 1; i < len(snapshots); i++ {
+		os.Remove(wirelessSnapshotFile(snapshots[i].Version))
+	}
+	return nil
+}
+
+// Snapshots the settings about to be replaced. A failure is logged and does
+// not block the change, the settings may be what needs fixing
+func snapshotCurrentWireless(reason string) {
+	var current InnerMessage
+	err := Get_wireless_message(&current)
+	if err == nil {
+		err = snapshotWireless(reason, current)
+	}
+	if err != nil {
+		fmt.Println("Error while saving the current wireless settings, no snapshot taken:", err.Error())
+	}
+}
+
+func Set_wireless(message InnerMessage) string {
+	var current InnerMessage
+	err := Get_wireless_message(&current)
+	if err != nil {
+		// Every key is checked then, as if all were new
+		fmt.Println("Error while reading the current wireless settings:", err.Error())
+		current = InnerMessage{}
+	}
+	err = validateWireless(message, current)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	snapshotCurrentWireless("set_wireless")
+	err = applyWireless(message)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+
+	status := "{\"status\": \"success\"}"
+	return status
+}
+
+func list_wireless_snapshots() string {
+	snapshots := readWirelessSnapshots()
+	infos := make([]WirelessSnapshotInfo, len(snapshots))
+	for i, snapshot := range snapshots {
+		infos[i] = WirelessSnapshotInfo{
+			Version: snapshot.Version,
+			Tstamp:  snapshot.Tstamp,
+			Reason:  snapshot.Reason,
+			Ssid2:   snapshot.Settings.Ssid2,
+			Ssid5:   snapshot.Settings.Ssid5,
+			Ssid52:  snapshot.Settings.Ssid52,
+			Gssid2:  snapshot.Settings.Gssid2,
+		}
+	}
+	jsonData, err := json.Marshal(infos)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return string(jsonData)
+}
+
+// Puts back the settings of the snapshot. The settings replaced are snapshotted too
+// so that the restore itself can be undone
+func restore_wireless(message RestoreWirelessInnerMessage) string {
+	content, err := nh_util.NH_read_file(wirelessSnapshotFile(message.Version))
+	if err != nil {
+		return nh_util.NH_getErrorStatusString("No such wireless snapshot")
+	}
+	var snapshot WirelessSnapshot
+	err = json.Unmarshal(content, &snapshot)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	snapshotCurrentWireless("restore_wireless " + strconv.Itoa(message.Version))
+	err = applyWireless(snapshot.Settings)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+
+	status := "{\"status\": \"success\"}"
+	return status
+}
@@ -0,0 +1,51 @@
+//go:build router && sim
+// +build router,sim
+
+package messages
+
+import (
+	"encoding/json"
+	"testing"
+
+	nh_util "nh_util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSimWireless(t *testing.T) InnerMessage {
+	Sim_set_base(t.TempDir() + "/")
+	Sim_reset_settings()
+	var settings InnerMessage
+	assert.Nil(t, Get_wireless_message(&settings))
+	return settings
+}
+
+func TestSetWirelessSnapshots(t *testing.T) {
+	settings := newSimWireless(t)
+	settings.Ssid2 = "Upstairs"
+	assert.Contains(t, Set_wireless(settings), "success")
+
+	var infos []WirelessSnapshotInfo
+	assert.Nil(t, json.Unmarshal([]byte(list_wireless_snapshots()), &infos))
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "NearhopSim", infos[0].Ssid2)
+
+	assert.Contains(t, restore_wireless(RestoreWirelessInnerMessage{Version: infos[0].Version}), "success")
+	var current InnerMessage
+	assert.Nil(t, Get_wireless_message(&current))
+	assert.Equal(t, "NearhopSim", current.Ssid2)
+}
+
+func TestSetWirelessWithoutSnapshot(t *testing.T) {
+	settings := newSimWireless(t)
+	// The snapshots can't be written. The settings can still be changed
+	assert.Nil(t, nh_util.NH_dump_to_file(wireless_snapshots_dir[:len(wireless_snapshots_dir)-1], []byte("not a dir"), 0600))
+	settings.Ssid2 = "Upstairs"
+	assert.Contains(t, Set_wireless(settings), "success")
+	var current InnerMessage
+	assert.Nil(t, Get_wireless_message(&current))
+	assert.Equal(t, "Upstairs", current.Ssid2)
+
+	settings.Key2 = "12345678"
+	assert.Contains(t, Set_wireless(settings), "too weak")
+}
@@ -207,8 +207,16 @@ func NH_http_get_req(url string) ([]byte, error) {
 }
 
 func Nh_http_send_req(url string, jsonData []byte) ([]byte, error, int) {
+	return Nh_http_send_auth_req(url, jsonData, "")
+}
+
+// Same as Nh_http_send_req, with the token sent as a bearer token when it is not empty
+func Nh_http_send_auth_req(url string, jsonData []byte, token string) ([]byte, error, int) {
 	request, error := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	client := &http.Client{}
 	resp, error := client.Do(request)
@@ -4,6 +4,10 @@
 package router
 
 import (
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,11 +19,35 @@ type RouterEvent struct {
 	Active bool
 }
 
+type PeerVerifier func(ip net.IP) (string, error)
+
+type NebulaIdentity struct {
+}
+
+func LoadNebulaIdentity(caPathOrPEM string, certPathOrPEM string, keyPathOrPEM string) (*NebulaIdentity, error) {
+	return &NebulaIdentity{}, nil
+}
+
+func (id *NebulaIdentity) Name() string {
+	return ""
+}
+
+func (id *NebulaIdentity) Post(ip string, path string, jsonData []byte) ([]byte, error) {
+	return nil, fmt.Errorf("Not a router")
+}
+
 func NewRouterServer(l1 *logrus.Logger) (*RouterServer, error) {
 	rs := &RouterServer{}
 	return rs, nil
 }
 
+func (rs *RouterServer) SetDNSQueryLog(enable bool) {
+}
+
+func (rs *RouterServer) SetTelemetrySources(names []string, interval time.Duration) error {
+	return nil
+}
+
 func (rs *RouterServer) StartRouterServer() error {
 	return nil
 }
@@ -28,6 +56,12 @@ func (rs *RouterServer) GetNextEvent() *RouterEvent {
 	return nil
 }
 
+func (rs *RouterServer) SetPeerVerifier(network *net.IPNet, verifier PeerVerifier) {
+}
+
+func (rs *RouterServer) SetIdentity(id *NebulaIdentity) {
+}
+
 func (rs *RouterServer) ShallUploadLogs() bool {
 	return false
 }
@@ -0,0 +1,332 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const (
+	ANOMALY_PORTSCAN = "portscan"
+	ANOMALY_FANOUT   = "fanout"
+	ANOMALY_BEACON   = "beacon"
+	ANOMALY_SPIKE    = "spike"
+)
+
+// Port scan: this many ports of one host in a minute
+const ANOMALY_PORTSCAN_WINDOW = 60
+const ANOMALY_PORTSCAN_PORTS = 30
+const ANOMALY_PORTSCAN_MAX_HOSTS = 256
+
+// Fan-out: this many destinations in 5 minutes, and several times the usual
+const ANOMALY_FANOUT_WINDOW = 5 * 60
+const ANOMALY_FANOUT_MIN_DESTINATIONS = 100
+const ANOMALY_FANOUT_FACTOR = 5
+
+// Beaconing: contacts to an address nobody looked up, at a steady interval
+const ANOMALY_BEACON_CONTACTS = 8
+const ANOMALY_BEACON_MIN_INTERVAL = 30
+const ANOMALY_BEACON_MAX_INTERVAL = 60 * 60
+const ANOMALY_BEACON_JITTER = 0.15
+const ANOMALY_BEACON_MAX_DESTINATIONS = 64
+
+// Spike: a 5 minute bucket this many deviations above the moving average
+const ANOMALY_SPIKE_BUCKET = 5 * 60
+const ANOMALY_SPIKE_WARMUP = 12
+const ANOMALY_SPIKE_DEVIATIONS = 4
+const ANOMALY_SPIKE_FACTOR = 5
+const ANOMALY_SPIKE_MIN_BYTES = 50 * 1024 * 1024
+const ANOMALY_BASELINE_ALPHA = 0.1
+
+// One event per client and detector in this time
+const ANOMALY_COOLDOWN = 60 * 60
+
+type AnomalyConfig struct {
+	Enabled   bool
+	AutoPause bool
+}
+
+type beaconState struct {
+	last      int64
+	intervals []int64
+}
+
+// Per client state of the detectors. Kept in memory only
+type anomalyState struct {
+	scanStart     int64
+	scanPorts     map[string]map[int]bool
+	fanoutStart   int64
+	destinations  map[string]bool
+	baselineDests float64
+	fanoutWindows int
+	bucketStart   int64
+	bucketBytes   uint64
+	meanBytes     float64
+	varBytes      float64
+	buckets       int
+	active        map[string]bool
+	beacons       map[string]*beaconState
+	alerted       map[string]int64
+}
+
+func newAnomalyState() *anomalyState {
+	return &anomalyState{
+		scanPorts:    make(map[string]map[int]bool),
+		destinations: make(map[string]bool),
+		active:       make(map[string]bool),
+		beacons:      make(map[string]*beaconState),
+		alerted:      make(map[string]int64),
+	}
+}
+
+func (tel *Telemetry) readAnomalyConfig() {
+	tel.anomaly = AnomalyConfig{Enabled: true}
+	content, err := nh_util.NH_read_file(DB_ANOMALY_FILE)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &tel.anomaly)
+	if err != nil {
+		tel.l.Error("Error while unmarshalling anomaly config", err)
+	}
+}
+
+func publicIP(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsMulticast() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsUnspecified()
+}
+
+// Many ports of one host within a minute
+func (as *anomalyState) checkPortScan(device Device, now int64) string {
+	if now-as.scanStart >= ANOMALY_PORTSCAN_WINDOW {
+		as.scanStart = now
+		as.scanPorts = make(map[string]map[int]bool)
+	}
+	for _, conn := range device.Conn {
+		ports := as.scanPorts[conn.R_ip]
+		if ports == nil {
+			if len(as.scanPorts) >= ANOMALY_PORTSCAN_MAX_HOSTS {
+				continue
+			}
+			ports = make(map[int]bool)
+			as.scanPorts[conn.R_ip] = ports
+		}
+		ports[conn.R_port] = true
+		if len(ports) >= ANOMALY_PORTSCAN_PORTS {
+			as.scanPorts[conn.R_ip] = make(map[int]bool)
+			return fmt.Sprintf("%d ports of %s probed within %d seconds", len(ports), conn.R_ip, ANOMALY_PORTSCAN_WINDOW)
+		}
+	}
+	return ""
+}
+
+// Many more destinations than the client usually talks to
+func (as *anomalyState) checkFanout(device Device, now int64) string {
+	if now-as.fanoutStart >= ANOMALY_FANOUT_WINDOW {
+		if as.fanoutStart != 0 {
+			n := float64(len(as.destinations))
+			if as.fanoutWindows == 0 {
+				as.baselineDests = n
+			} else {
+				as.baselineDests += ANOMALY_BASELINE_ALPHA * (n - as.baselineDests)
+			}
+			as.fanoutWindows++
+		}
+		as.fanoutStart = now
+		as.destinations = make(map[string]bool)
+	}
+	threshold := ANOMALY_FANOUT_FACTOR * int(math.Ceil(as.baselineDests))
+	if threshold < ANOMALY_FANOUT_MIN_DESTINATIONS {
+		threshold = ANOMALY_FANOUT_MIN_DESTINATIONS
+	}
+	for _, conn := range device.Conn {
+		if len(as.destinations) > threshold {
+			// Already reported for this window
+			break
+		}
+		as.destinations[conn.R_ip] = true
+		if len(as.destinations) > threshold {
+			return fmt.Sprintf("%d destinations within %d minutes, usually %.0f", len(as.destinations), ANOMALY_FANOUT_WINDOW/60, as.baselineDests)
+		}
+	}
+	return ""
+}
+
+func steadyIntervals(intervals []int64) (int64, bool) {
+	sorted := append([]int64{}, intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if median < ANOMALY_BEACON_MIN_INTERVAL || median > ANOMALY_BEACON_MAX_INTERVAL {
+		return 0, false
+	}
+	for _, interval := range intervals {
+		if math.Abs(float64(interval-median)) > ANOMALY_BEACON_JITTER*float64(median) {
+			return 0, false
+		}
+	}
+	return median, true
+}
+
+// New connections to an address that was never looked up in DNS, at a steady
+// interval. Clouds of the IoT devices are reached by name and are left out
+// Called with the telemetry lock held
+func (tel *Telemetry) checkBeacon(as *anomalyState, device Device, now int64) string {
+	active := make(map[string]bool)
+	alert := ""
+	for _, conn := range device.Conn {
+		key := fmt.Sprintf("%s:%d", conn.R_ip, conn.R_port)
+		active[key] = true
+		if as.active[key] || !publicIP(conn.R_ip) || tel.dnsName(conn.R_ip) != "" {
+			continue
+		}
+		b := as.beacons[key]
+		if b == nil {
+			if len(as.beacons) >= ANOMALY_BEACON_MAX_DESTINATIONS {
+				as.evictBeacon()
+			}
+			b = &beaconState{}
+			as.beacons[key] = b
+		} else {
+			b.intervals = append(b.intervals, now-b.last)
+			if len(b.intervals) > ANOMALY_BEACON_CONTACTS {
+				b.intervals = b.intervals[1:]
+			}
+		}
+		b.last = now
+		if len(b.intervals) < ANOMALY_BEACON_CONTACTS || alert != "" {
+			continue
+		}
+		if interval, ok := steadyIntervals(b.intervals); ok {
+			alert = fmt.Sprintf("%s contacted every %d seconds without a DNS lookup", key, interval)
+			b.intervals = b.intervals[:0]
+		}
+	}
+	as.active = active
+	return alert
+}
+
+func (as *anomalyState) evictBeacon() {
+	var oldest string
+	var last int64
+	for key, b := range as.beacons {
+		if oldest == "" || b.last < last {
+			oldest = key
+			last = b.last
+		}
+	}
+	delete(as.beacons, oldest)
+}
+
+// Bytes in 5 minutes well above the moving average of the client
+func (as *anomalyState) checkSpike(device Device, now int64) string {
+	bytesin, bytesout := deviceBytes(device)
+	bucket := now - now%ANOMALY_SPIKE_BUCKET
+	if as.bucketStart == bucket {
+		as.bucketBytes += bytesin + bytesout
+		return ""
+	}
+	alert := ""
+	if as.bucketStart != 0 {
+		b := float64(as.bucketBytes)
+		stddev := math.Sqrt(as.varBytes)
+		if as.buckets >= ANOMALY_SPIKE_WARMUP && as.bucketBytes >= ANOMALY_SPIKE_MIN_BYTES &&
+			b > as.meanBytes+ANOMALY_SPIKE_DEVIATIONS*stddev && b > ANOMALY_SPIKE_FACTOR*as.meanBytes {
+			alert = fmt.Sprintf("%s in 5 minutes, usually %s", nh_util.NH_convert_into_xB(as.bucketBytes), nh_util.NH_convert_into_xB(uint64(as.meanBytes)))
+		}
+		if as.buckets == 0 {
+			as.meanBytes = b
+		} else {
+			diff := b - as.meanBytes
+			as.meanBytes += ANOMALY_BASELINE_ALPHA * diff
+			as.varBytes = (1 - ANOMALY_BASELINE_ALPHA) * (as.varBytes + ANOMALY_BASELINE_ALPHA*diff*diff)
+		}
+		as.buckets++
+	}
+	as.bucketStart = bucket
+	as.bucketBytes = bytesin + bytesout
+	return alert
+}
+
+// Raises ANOMALYEVENT and pauses the client when configured to. The pause is
+// for a person to lift, the schedules, quota and group holding the client let
+// go of it
+// Called with the telemetry lock held
+func (tel *Telemetry) reportAnomaly(client *RouterClient, as *anomalyState, detector string, explanation string, now int64) {
+	if now-as.alerted[detector] < ANOMALY_COOLDOWN {
+		return
+	}
+	as.alerted[detector] = now
+	tel.l.WithField("mac", client.MACAddress).WithField("detector", detector).Info(explanation)
+	tel.newEvent(ANOMALYEVENT, explanation, client, detector)
+	if !tel.anomaly.AutoPause {
+		return
+	}
+	client.releaseHolds()
+	paused := client.Paused
+	client.Paused = true
+	err := dumpClientStats(client)
+	if err != nil {
+		tel.l.Error("Error while saving (anomaly) the client details", client.MACAddress)
+	}
+	if !paused {
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, true)
+	}
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) detectAnomalies(device Device, now int64) {
+	client := tel.RouterClients[device.Mac]
+	if !tel.anomaly.Enabled || client == nil || client.IsRepeater {
+		return
+	}
+	as := tel.anomalies[device.Mac]
+	if as == nil {
+		as = newAnomalyState()
+		tel.anomalies[device.Mac] = as
+	}
+	alerts := map[string]string{
+		ANOMALY_PORTSCAN: as.checkPortScan(device, now),
+		ANOMALY_FANOUT:   as.checkFanout(device, now),
+		ANOMALY_BEACON:   tel.checkBeacon(as, device, now),
+		ANOMALY_SPIKE:    as.checkSpike(device, now),
+	}
+	for _, detector := range []string{ANOMALY_PORTSCAN, ANOMALY_FANOUT, ANOMALY_BEACON, ANOMALY_SPIKE} {
+		if alerts[detector] != "" {
+			tel.reportAnomaly(client, as, detector, alerts[detector], now)
+		}
+	}
+}
+
+func (tel *Telemetry) anomalyConfigJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+	return json.Marshal(messages.AnomalyConfigInfo{
+		Enabled:   tel.anomaly.Enabled,
+		AutoPause: tel.anomaly.AutoPause,
+	})
+}
+
+func (tel *Telemetry) setAnomalyConfig(info messages.AnomalyConfigInfo) string {
+	tel.Lock()
+	defer tel.Unlock()
+	tel.anomaly.Enabled = info.Enabled
+	tel.anomaly.AutoPause = info.AutoPause
+	abytes, err := json.Marshal(tel.anomaly)
+	if err == nil {
+		err = nh_util.NH_dump_to_file(DB_ANOMALY_FILE, abytes, 0644)
+	}
+	if err != nil {
+		tel.l.Error("Error while saving anomaly config", err)
+		return nh_util.NH_getErrorStatusString("Error while saving anomaly config")
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func anomalyEvents(rs *RouterServer) []string {
+	detectors := make([]string, 0)
+	for _, ev := range rs.tel.Journal.query(EventFilter{Etypes: []int{int(ANOMALYEVENT)}}) {
+		detectors = append(detectors, ev.Source)
+	}
+	return detectors
+}
+
+func detect(rs *RouterServer, conns []Con, now int64) {
+	rs.tel.Lock()
+	defer rs.tel.Unlock()
+	rs.tel.detectAnomalies(Device{Mac: testMac, Conn: conns}, now)
+}
+
+func portScan(host string) []Con {
+	conns := make([]Con, 0, ANOMALY_PORTSCAN_PORTS)
+	for port := 1; port <= ANOMALY_PORTSCAN_PORTS; port++ {
+		conns = append(conns, Con{R_ip: host, R_port: port, Proto: 6})
+	}
+	return conns
+}
+
+func TestAnomalyPortScan(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	// After the round of the simulator
+	now := time.Now().Unix() + ANOMALY_PORTSCAN_WINDOW
+
+	// Ports probed over more than a minute are no scan
+	detect(rs, portScan("192.168.1.101")[:20], now)
+	detect(rs, portScan("192.168.1.101")[20:], now+ANOMALY_PORTSCAN_WINDOW)
+	assert.Empty(t, anomalyEvents(rs))
+
+	detect(rs, portScan("192.168.1.101"), now+2*ANOMALY_PORTSCAN_WINDOW)
+	assert.Equal(t, []string{ANOMALY_PORTSCAN}, anomalyEvents(rs))
+	// Once per cooldown
+	detect(rs, portScan("192.168.1.103"), now+3*ANOMALY_PORTSCAN_WINDOW)
+	assert.Equal(t, []string{ANOMALY_PORTSCAN}, anomalyEvents(rs))
+	assert.False(t, sim.Paused(testMac))
+}
+
+func TestAnomalyBeacon(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	beacon := []Con{{R_ip: "203.0.113.50", R_port: 8443, Proto: 6}}
+	now := time.Now().Unix() + ANOMALY_PORTSCAN_WINDOW
+	for i := 0; i <= ANOMALY_BEACON_CONTACTS; i++ {
+		detect(rs, beacon, now)
+		detect(rs, nil, now+30)
+		now += 300
+	}
+	assert.Equal(t, []string{ANOMALY_BEACON}, anomalyEvents(rs))
+
+	// Not for an address the client looked up
+	rs, sim = newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	rs.tel.Lock()
+	rs.tel.dnsNames["203.0.113.50"] = "updates.example.com"
+	rs.tel.Unlock()
+	for i := 0; i <= ANOMALY_BEACON_CONTACTS; i++ {
+		detect(rs, beacon, now)
+		detect(rs, nil, now+30)
+		now += 300
+	}
+	assert.Empty(t, anomalyEvents(rs))
+}
+
+func TestAnomalyAutoPause(t *testing.T) {
+	rs, sim := newScheduledRouter(t)
+	status := rs.tel.setAnomalyConfig(messages.AnomalyConfigInfo{Enabled: true, AutoPause: true})
+	assert.Equal(t, "", status)
+
+	// The schedule paused the client. The anomaly keeps it paused after the window
+	rs.tel.applySchedules(inBedtime)
+	detect(rs, portScan("192.168.1.101"), time.Now().Unix()+ANOMALY_PORTSCAN_WINDOW)
+	assert.Equal(t, []string{ANOMALY_PORTSCAN}, anomalyEvents(rs))
+	rs.tel.applySchedules(afterBedtime)
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
@@ -0,0 +1,171 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	nh_util "nh_util"
+)
+
+const API_SECRET_LENGTH = 32
+
+// Returns the name in the peer's Nebula certificate when ip is the VPN IP of
+// a tunnel whose certificate is signed by the CA the tunnel trusts
+type PeerVerifier func(ip net.IP) (string, error)
+
+// Reads the shared secret used by the local daemons, creating one on first boot
+func loadAPISecret() (string, error) {
+	secret, err := nh_util.NH_read_file(DB_API_SECRET_FILE)
+	if err == nil && len(strings.TrimSpace(string(secret))) > 0 {
+		return strings.TrimSpace(string(secret)), nil
+	}
+	b := make([]byte, API_SECRET_LENGTH)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	s := hex.EncodeToString(b)
+	err = nh_util.NH_dump_to_file(DB_API_SECRET_FILE, []byte(s+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// A repeater gets a token when it registers. Only the hash of it is kept
+func newRepeaterToken() (string, string, error) {
+	b := make([]byte, API_SECRET_LENGTH)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, tokenHash(token), nil
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MAC of the repeater the token was given to, empty for none
+func (tel *Telemetry) repeaterOfToken(token string) string {
+	hash := []byte(tokenHash(token))
+	tel.RLock()
+	defer tel.RUnlock()
+	for _, repeater := range tel.Repeaters {
+		if repeater.TokenHash != "" && subtle.ConstantTimeCompare([]byte(repeater.TokenHash), hash) == 1 {
+			return repeater.Mac
+		}
+	}
+	return ""
+}
+
+// network is the Nebula address of this unit. Peers are only verified on
+// requests that reach us on that address, from inside the network
+func (rs *RouterServer) SetPeerVerifier(network *net.IPNet, verifier PeerVerifier) {
+	rs.vpnnet = network
+	rs.verifier = verifier
+}
+
+// Lets the other units of the mesh use the api over mutual TLS. Must be set
+// before the server is started
+func (rs *RouterServer) SetIdentity(id *NebulaIdentity) {
+	rs.identity = id
+	// The root sends commands to the repeaters with it
+	rs.tel.Lock()
+	rs.tel.identity = id
+	rs.tel.Unlock()
+}
+
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Local address the request came in on
+func localIP(r *http.Request) net.IP {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	return addrIP(addr.String())
+}
+
+// True when the request came in over the Nebula tun
+func (rs *RouterServer) overTunnel(local net.IP, remote net.IP) bool {
+	if rs.vpnnet == nil || local == nil {
+		return false
+	}
+	return local.Equal(rs.vpnnet.IP) && rs.vpnnet.Contains(remote)
+}
+
+// Paths a repeater token is good for. The capture daemon of a repeater posts
+// its radios to the root with it
+var repeaterTokenPaths = map[string]bool{
+	"/radios": true,
+}
+
+// Accepts another unit of the mesh over mutual TLS, the shared secret of the
+// daemons of this unit or a repeater token as a bearer token, or a Nebula
+// peer reaching us over its tunnel. Returns who made the request
+func (rs *RouterServer) authorize(r *http.Request) (string, error) {
+	ip := addrIP(r.RemoteAddr)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid remote address %s", r.RemoteAddr)
+	}
+	if r.TLS != nil {
+		if rs.identity == nil {
+			return "", fmt.Errorf("No Nebula identity")
+		}
+		return rs.identity.peerName(r.TLS)
+	}
+	auth := r.Header.Get("Authorization")
+	bearer := strings.HasPrefix(auth, "Bearer ")
+	if bearer {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if rs.secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(rs.secret)) == 1 {
+			return "secret", nil
+		}
+		if mac := rs.tel.repeaterOfToken(token); mac != "" && repeaterTokenPaths[r.URL.Path] {
+			return "repeater " + mac, nil
+		}
+	}
+	local := localIP(r)
+	if rs.verifier == nil || !rs.overTunnel(local, ip) {
+		if bearer {
+			return "", fmt.Errorf("Invalid shared secret")
+		}
+		return "", fmt.Errorf("No credentials")
+	}
+	name, err := rs.verifier(ip)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (rs *RouterServer) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := rs.authorize(r)
+		if err != nil {
+			rs.l.WithField("remote", r.RemoteAddr).WithField("path", r.URL.Path).Error("Rejected router api request: ", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString("Unauthorized"))
+			return
+		}
+		handler(w, r)
+	}
+}
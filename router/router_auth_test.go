@@ -0,0 +1,60 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func authorizeRequest(rs *RouterServer, path string, bearer string) (string, error) {
+	r := httptest.NewRequest("POST", path, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	return rs.authorize(r)
+}
+
+func TestAuthorize(t *testing.T) {
+	rs, _ := newSimRouter(t)
+	rs.secret = "daemon secret"
+
+	// Loopback alone is no credential
+	_, err := authorizeRequest(rs, "/pause", "")
+	assert.NotNil(t, err)
+	_, err = authorizeRequest(rs, "/pause", "wrong")
+	assert.NotNil(t, err)
+	who, err := authorizeRequest(rs, "/pause", "daemon secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", who)
+
+	repeaters := len(rs.tel.Repeaters)
+	// A repeater gets a token for its capture daemon when it registers
+	var status struct {
+		Status string `json:"status"`
+		Token  string `json:"token"`
+	}
+	message := RepeaterMessage{Type: "register_repeater", Name: "repeater", Mac: "f0:25:b7:10:30:01", MMac: "f2:25:b7:10:30:01", Ip: "192.168.1.2", Fwver: "1.0"}
+	assert.Nil(t, json.Unmarshal(post(t, rs.registerRepeater, message), &status))
+	assert.Equal(t, "success", status.Status)
+	assert.NotEqual(t, "", status.Token)
+	assert.NotEqual(t, status.Token, rs.tel.Repeaters[message.Mac].TokenHash)
+
+	who, err = authorizeRequest(rs, "/radios", status.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "repeater "+message.Mac, who)
+	// The token is only good for /radios
+	_, err = authorizeRequest(rs, "/pause", status.Token)
+	assert.NotNil(t, err)
+
+	// Registering again replaces the token
+	assert.Nil(t, json.Unmarshal(post(t, rs.registerRepeater, message), &status))
+	_, err = authorizeRequest(rs, "/radios", status.Token)
+	assert.Nil(t, err)
+	assert.Len(t, rs.tel.Repeaters, repeaters+1)
+}
@@ -0,0 +1,330 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+
+	"github.com/slackhq/nebula/cidr"
+	"github.com/slackhq/nebula/iputil"
+)
+
+const (
+	BLOCKLIST_FEED_URL  = "url"
+	BLOCKLIST_FEED_FILE = "file"
+	BLOCKLIST_FEED_USER = "user"
+)
+
+const BLOCKLIST_DEFAULT_FEED = "nearhop"
+const BLOCKLIST_USER_FEED = "user"
+const MAX_NUM_OF_BLOCKLIST_FEEDS = 16
+const MAX_NUM_OF_BLOCKLIST_USER_ENTRIES = 1024
+
+var feedNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]{1,32}$")
+
+// A source of blocked IPs and CIDRs
+type BlocklistFeed struct {
+	Name    string
+	Kind    string
+	Source  string   `json:",omitempty"`
+	Entries []string `json:",omitempty"`
+	// Time of the last successful refresh and the error of the last attempt
+	Updated   int64
+	Attempted int64
+	Count     int
+	Error     string
+	entries   []string
+}
+
+// Merges all the feeds into one CIDR tree. The value of each node is the
+// name of the feed the range came from
+type Blocklist struct {
+	sync.RWMutex
+	feeds []*BlocklistFeed
+	tree  *cidr.Tree4
+}
+
+func defaultBlocklistFeeds() []*BlocklistFeed {
+	return []*BlocklistFeed{
+		{Name: BLOCKLIST_DEFAULT_FEED, Kind: BLOCKLIST_FEED_URL, Source: blocklisturl},
+		{Name: BLOCKLIST_USER_FEED, Kind: BLOCKLIST_FEED_USER},
+	}
+}
+
+func NewBlocklist() *Blocklist {
+	bl := &Blocklist{
+		feeds: defaultBlocklistFeeds(),
+		tree:  cidr.NewTree4(),
+	}
+	return bl
+}
+
+// Parses one IP or CIDR per line. Blank lines and comments are skipped
+func parseBlocklistEntries(content string) []string {
+	entries := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if _, err := parseBlocklistCIDR(line); err != nil {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries
+}
+
+func parseBlocklistCIDR(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		entry = entry + "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("Only IPv4 entries are supported %s", entry)
+	}
+	return ipnet, nil
+}
+
+func blocklistCacheFile(name string) string {
+	return DB_BLOCKLIST_LOCATION + name
+}
+
+func (feed *BlocklistFeed) fetch() ([]string, error) {
+	var content []byte
+	var err error
+	switch feed.Kind {
+	case BLOCKLIST_FEED_URL:
+		content, err = nh_util.NH_http_get_req(feed.Source)
+	case BLOCKLIST_FEED_FILE:
+		content, err = nh_util.NH_read_file(feed.Source)
+	case BLOCKLIST_FEED_USER:
+		return feed.Entries, nil
+	default:
+		return nil, fmt.Errorf("Unknown blocklist feed kind %s", feed.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := parseBlocklistEntries(string(content))
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("Blocklist feed %s is empty", feed.Name)
+	}
+	return entries, nil
+}
+
+// Loads the last good copy of every feed so that we block even if the feeds
+// can't be reached on boot
+func (bl *Blocklist) readCache() {
+	bl.Lock()
+	defer bl.Unlock()
+
+	feedsjson, err := nh_util.NH_read_file(DB_BLOCKLIST_FEEDS_FILE)
+	if err == nil {
+		var feeds []*BlocklistFeed
+		if json.Unmarshal(feedsjson, &feeds) == nil && len(feeds) > 0 {
+			bl.feeds = feeds
+		}
+	}
+	for _, feed := range bl.feeds {
+		if feed.Kind == BLOCKLIST_FEED_USER {
+			feed.entries = feed.Entries
+			continue
+		}
+		content, err := nh_util.NH_read_file(blocklistCacheFile(feed.Name))
+		if err != nil {
+			continue
+		}
+		feed.entries = parseBlocklistEntries(string(content))
+	}
+	bl.rebuild()
+}
+
+// Called with the blocklist lock held
+func (bl *Blocklist) dumpFeeds() error {
+	nh_util.NH_create_dir(DB_BLOCKLIST_LOCATION, 0755)
+	fbytes, err := json.Marshal(bl.feeds)
+	if err != nil {
+		return err
+	}
+	return nh_util.NH_dump_to_file(DB_BLOCKLIST_FEEDS_FILE, fbytes, 0644)
+}
+
+// Called with the blocklist lock held
+func (bl *Blocklist) rebuild() {
+	tree := cidr.NewTree4()
+	for _, feed := range bl.feeds {
+		for _, entry := range feed.entries {
+			ipnet, err := parseBlocklistCIDR(entry)
+			if err != nil {
+				continue
+			}
+			tree.AddCIDR(ipnet, feed.Name)
+		}
+		feed.Count = len(feed.entries)
+	}
+	bl.tree = tree
+}
+
+// Fetches all the feeds. Feeds that fail keep their last good copy
+func (bl *Blocklist) refresh() error {
+	bl.RLock()
+	feeds := make([]*BlocklistFeed, len(bl.feeds))
+	copy(feeds, bl.feeds)
+	bl.RUnlock()
+
+	// Don't hold the lock while downloading
+	fetched := make(map[*BlocklistFeed][]string)
+	errs := make(map[*BlocklistFeed]error)
+	for _, feed := range feeds {
+		entries, err := feed.fetch()
+		if err != nil {
+			errs[feed] = err
+			continue
+		}
+		fetched[feed] = entries
+	}
+
+	bl.Lock()
+	defer bl.Unlock()
+	curtime := time.Now().Unix()
+	failed := 0
+	nh_util.NH_create_dir(DB_BLOCKLIST_LOCATION, 0755)
+	for _, feed := range feeds {
+		feed.Attempted = curtime
+		if err := errs[feed]; err != nil {
+			feed.Error = err.Error()
+			failed++
+			continue
+		}
+		feed.entries = fetched[feed]
+		feed.Updated = curtime
+		feed.Error = ""
+		if feed.Kind != BLOCKLIST_FEED_USER {
+			nh_util.NH_dump_to_file(blocklistCacheFile(feed.Name), []byte(strings.Join(feed.entries, "\n")), 0644)
+		}
+	}
+	bl.rebuild()
+	bl.dumpFeeds()
+	if failed > 0 {
+		return fmt.Errorf("%d blocklist feeds failed to update", failed)
+	}
+	return nil
+}
+
+// Returns the feed blocking the IP, "" if it is not blocked
+func (bl *Blocklist) match(ipstr string) string {
+	ip := net.ParseIP(ipstr)
+	if ip == nil || ip.To4() == nil {
+		return ""
+	}
+	bl.RLock()
+	defer bl.RUnlock()
+	value := bl.tree.MostSpecificContains(iputil.Ip2VpnIp(ip.To4()))
+	if value == nil {
+		return ""
+	}
+	return value.(string)
+}
+
+func (bl *Blocklist) feedsJson() ([]byte, error) {
+	bl.RLock()
+	defer bl.RUnlock()
+
+	feeds := make([]messages.IPBlocklistFeedInfo, len(bl.feeds))
+	for i, feed := range bl.feeds {
+		feeds[i] = messages.IPBlocklistFeedInfo{
+			Name:      feed.Name,
+			Kind:      feed.Kind,
+			Source:    feed.Source,
+			Entries:   feed.Entries,
+			Updated:   feed.Updated,
+			Attempted: feed.Attempted,
+			Count:     feed.Count,
+			Error:     feed.Error,
+		}
+	}
+	return json.Marshal(feeds)
+}
+
+// Replaces the feeds. The user feed always exists and holds the entries added from the app
+func (bl *Blocklist) setFeeds(infos []messages.IPBlocklistFeedInfo) error {
+	if len(infos) > MAX_NUM_OF_BLOCKLIST_FEEDS {
+		return fmt.Errorf("Maximum number of blocklist feeds reached")
+	}
+	feeds := make([]*BlocklistFeed, 0, len(infos)+1)
+	names := make(map[string]bool)
+	hasUser := false
+	for _, info := range infos {
+		if !feedNameRegexp.MatchString(info.Name) || names[info.Name] {
+			return fmt.Errorf("Invalid or duplicate blocklist feed name %s", info.Name)
+		}
+		names[info.Name] = true
+		feed := &BlocklistFeed{
+			Name:   info.Name,
+			Kind:   info.Kind,
+			Source: info.Source,
+		}
+		switch info.Kind {
+		case BLOCKLIST_FEED_URL, BLOCKLIST_FEED_FILE:
+			if info.Source == "" {
+				return fmt.Errorf("Blocklist feed %s needs a source", info.Name)
+			}
+		case BLOCKLIST_FEED_USER:
+			if hasUser {
+				return fmt.Errorf("Only one user blocklist feed is allowed")
+			}
+			if len(info.Entries) > MAX_NUM_OF_BLOCKLIST_USER_ENTRIES {
+				return fmt.Errorf("Too many user blocklist entries")
+			}
+			for _, entry := range info.Entries {
+				if _, err := parseBlocklistCIDR(entry); err != nil {
+					return fmt.Errorf("Invalid blocklist entry %s", entry)
+				}
+			}
+			hasUser = true
+			feed.Source = ""
+			feed.Entries = info.Entries
+			feed.entries = info.Entries
+		default:
+			return fmt.Errorf("Unknown blocklist feed kind %s", info.Kind)
+		}
+		feeds = append(feeds, feed)
+	}
+	if !hasUser {
+		feeds = append(feeds, &BlocklistFeed{Name: BLOCKLIST_USER_FEED, Kind: BLOCKLIST_FEED_USER})
+	}
+
+	bl.Lock()
+	defer bl.Unlock()
+	// Keep the entries and freshness of feeds that did not change
+	for _, feed := range feeds {
+		for _, old := range bl.feeds {
+			if old.Name == feed.Name && old.Kind == feed.Kind && old.Source == feed.Source && feed.Kind != BLOCKLIST_FEED_USER {
+				feed.entries = old.entries
+				feed.Updated = old.Updated
+				feed.Attempted = old.Attempted
+				feed.Error = old.Error
+			}
+		}
+	}
+	bl.feeds = feeds
+	bl.rebuild()
+	return bl.dumpFeeds()
+}
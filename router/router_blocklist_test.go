@@ -0,0 +1,57 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"os"
+	"testing"
+
+	messages "messages"
+	nh_util "nh_util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlocklistEntries(t *testing.T) {
+	content := "# feed\n203.0.113.7\n198.51.100.0/24 ; scanners\n\nnot an ip\n2001:db8::1\n"
+	assert.Equal(t, []string{"203.0.113.7", "198.51.100.0/24"}, parseBlocklistEntries(content))
+}
+
+func TestBlocklistFeeds(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	feedFile := t.TempDir() + "/feed.txt"
+	assert.Nil(t, nh_util.NH_dump_to_file(feedFile, []byte("198.51.100.0/24\n"), 0644))
+	bl := rs.tel.Blocklist
+	err := bl.setFeeds([]messages.IPBlocklistFeedInfo{
+		{Name: "scanners", Kind: BLOCKLIST_FEED_FILE, Source: feedFile},
+		{Name: "mine", Kind: BLOCKLIST_FEED_USER, Entries: []string{"198.51.100.9"}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, bl.refresh())
+
+	// The most specific range tells the feed
+	assert.Equal(t, "scanners", bl.match("198.51.100.1"))
+	assert.Equal(t, "mine", bl.match("198.51.100.9"))
+	assert.Equal(t, "", bl.match("192.0.2.1"))
+
+	// A feed that fails keeps its last good copy, also after a restart
+	assert.Nil(t, os.Remove(feedFile))
+	assert.NotNil(t, bl.refresh())
+	assert.Equal(t, "scanners", bl.match("198.51.100.1"))
+	cached := NewBlocklist()
+	cached.readCache()
+	assert.Equal(t, "scanners", cached.match("198.51.100.1"))
+
+	assert.NotNil(t, bl.setFeeds([]messages.IPBlocklistFeedInfo{{Name: "mine", Kind: BLOCKLIST_FEED_USER, Entries: []string{"::1"}}}))
+	assert.NotNil(t, bl.setFeeds([]messages.IPBlocklistFeedInfo{{Name: "bad name", Kind: BLOCKLIST_FEED_URL, Source: "http://x"}}))
+
+	// Traffic to a blocked IP raises an event naming the feed
+	assert.Nil(t, sim.Tick())
+	assert.Nil(t, sim.Connect(testMac, SimDestination{Ip: "198.51.100.9", Port: 443, Proto: 6}, 100, 100))
+	assert.Nil(t, sim.Tick())
+	events := rs.tel.Journal.query(EventFilter{Etypes: []int{int(BLOCKEDIPEVENT)}})
+	assert.Len(t, events, 1)
+	assert.Equal(t, "198.51.100.9", events[0].Extra)
+	assert.Equal(t, "mine", events[0].Source)
+}
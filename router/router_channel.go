@@ -0,0 +1,550 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const (
+	CHANNEL_PLAN_OFF       = "off"
+	CHANNEL_PLAN_RECOMMEND = "recommend"
+	CHANNEL_PLAN_AUTO      = "auto"
+)
+
+const (
+	BAND_2G = "2g"
+	BAND_5G = "5g"
+	BAND_6G = "6g"
+)
+
+// Channels are planned this often from the telemetry gathered in between
+const CHANNEL_PLAN_INTERVAL = 60 * 60
+
+// How often the planner checks whether to plan or to apply the plan
+const CHANNEL_PLANNER_TICK = 5 * 60 * time.Second
+
+// A channel has to score this much better than the current one to be recommended
+const CHANNEL_SWITCH_MARGIN = 10
+
+// Penalty for sharing a channel with another radio of our own mesh
+const CHANNEL_SELF_PENALTY = 40
+
+// Neighbours not seen in the scans for this long are forgotten
+const NEIGHBOUR_EXPIRY = 2 * 60 * 60
+
+// Weight of the newest sample in the moving averages, in percent
+const CHANNEL_EWMA_WEIGHT = 20
+
+// Non DFS channels the planner picks from
+var candidateChannels = map[string][]int{
+	BAND_2G: {1, 6, 11},
+	BAND_5G: {36, 40, 44, 48, 149, 153, 157, 161, 165},
+	BAND_6G: {5, 21, 37, 53, 69, 85, 101, 117, 133, 149, 165, 181, 197, 213, 229},
+}
+
+type neighbourState struct {
+	Channel  int
+	Rssi     int
+	Lastseen int64
+}
+
+// What we know about one radio of the root router or a repeater
+type radioState struct {
+	Node    string
+	Name    string
+	Band    string
+	Channel int
+	Mesh    bool
+	// Moving averages of the associated stations
+	StationRssi  int
+	StationCount int
+	Updated      int64
+	neighbours   map[string]*neighbourState
+}
+
+type ChannelRecommendation struct {
+	Node             string
+	Radio            string
+	Band             string
+	Current          int
+	Recommended      int
+	CurrentScore     int
+	RecommendedScore int
+	Reason           string
+	Tstamp           int64
+	Applied          bool
+	Error            string
+}
+
+// Persisted settings and the last plan
+type ChannelPlan struct {
+	Mode            string
+	QuietStart      string
+	QuietEnd        string
+	Planned         int64
+	Recommendations []*ChannelRecommendation
+}
+
+func radioBand(radio *Radio) string {
+	switch radio.Band {
+	case BAND_2G, BAND_5G, BAND_6G:
+		return radio.Band
+	}
+	if radio.Channel > 0 && radio.Channel <= 14 {
+		return BAND_2G
+	}
+	return BAND_5G
+}
+
+func ewma(avg int, sample int) int {
+	return (avg*(100-CHANNEL_EWMA_WEIGHT) + sample*CHANNEL_EWMA_WEIGHT) / 100
+}
+
+// Channels a 5GHz radio can move to. Tri-band routers keep each 5GHz radio in its sub-band
+func (rs *radioState) candidates() []int {
+	channels := candidateChannels[rs.Band]
+	if rs.Band != BAND_5G || rs.Channel == 0 {
+		return channels
+	}
+	subband := make([]int, 0)
+	for _, c := range channels {
+		if (c < 100) == (rs.Channel < 100) {
+			subband = append(subband, c)
+		}
+	}
+	return subband
+}
+
+// Two channels interfere when their 20MHz channels overlap. Returns how much, in percent
+func channelOverlap(band string, a int, b int) int {
+	if band != BAND_2G {
+		if a == b {
+			return 100
+		}
+		return 0
+	}
+	d := a - b
+	if d < 0 {
+		d = -d
+	}
+	if d >= 5 {
+		return 0
+	}
+	return (5 - d) * 20
+}
+
+// Records the channel, the stations and the neighbours of the radio.
+// Called with the telemetry lock held
+func (tel *Telemetry) updateRadioState(node string, radio *Radio, now int64) {
+	key := node + "/" + radio.Name
+	rs := tel.radios[key]
+	if rs == nil {
+		rs = &radioState{
+			Node:        node,
+			Name:        radio.Name,
+			StationRssi: -65,
+			neighbours:  make(map[string]*neighbourState),
+		}
+		tel.radios[key] = rs
+	}
+	rs.Band = radioBand(radio)
+	rs.Channel = radio.Channel
+	rs.Updated = now
+	rs.Mesh = false
+	count := 0
+	rssi := 0
+	for _, vap := range radio.Vaps {
+		if vap.Bssid != "" {
+			tel.ownBssids[vap.Bssid] = true
+		}
+		if vap.Mode == "mesh" {
+			rs.Mesh = true
+		}
+		for _, sta := range vap.Stas {
+			if tel.repeaterOf(sta.Mac) != nil {
+				continue
+			}
+			count++
+			rssi += sta.Rssi
+		}
+	}
+	if count > 0 {
+		rs.StationRssi = ewma(rs.StationRssi, rssi/count)
+	}
+	rs.StationCount = ewma(rs.StationCount*100, count*100) / 100
+	for _, n := range radio.Scan {
+		state := rs.neighbours[n.Bssid]
+		if state == nil {
+			state = &neighbourState{Rssi: n.Rssi}
+			rs.neighbours[n.Bssid] = state
+		}
+		state.Channel = n.Channel
+		state.Rssi = ewma(state.Rssi, n.Rssi)
+		state.Lastseen = now
+	}
+	for bssid, state := range rs.neighbours {
+		if now-state.Lastseen > NEIGHBOUR_EXPIRY {
+			delete(rs.neighbours, bssid)
+		}
+	}
+}
+
+// Interference from the neighbours. Stronger neighbours weigh more and radios
+// with weak stations suffer more from the same interference
+func (tel *Telemetry) neighbourScore(rs *radioState, channel int) int {
+	score := 0
+	for bssid, n := range rs.neighbours {
+		if tel.ownBssids[bssid] {
+			// Our own radios show up in the scans of the other nodes
+			continue
+		}
+		strength := n.Rssi + 95
+		if strength <= 0 {
+			continue
+		}
+		score += strength * channelOverlap(rs.Band, channel, n.Channel) / 100
+	}
+	if rs.StationRssi < -70 {
+		score = score * 3 / 2
+	}
+	return score
+}
+
+// Scores the channel for the radios of the group. Lower is better
+func (tel *Telemetry) channelScore(group []*radioState, channel int, taken map[*radioState]int) int {
+	score := 0
+	for _, rs := range group {
+		score += tel.neighbourScore(rs, channel)
+		for other, c := range taken {
+			if other.Band != rs.Band || inGroup(group, other) {
+				continue
+			}
+			score += CHANNEL_SELF_PENALTY * channelOverlap(rs.Band, channel, c) / 100
+		}
+	}
+	return score
+}
+
+func inGroup(group []*radioState, rs *radioState) bool {
+	for _, g := range group {
+		if g == rs {
+			return true
+		}
+	}
+	return false
+}
+
+// Radios carrying the mesh backhaul of a band have to stay on the same channel.
+// They are planned together and the others one by one
+func (tel *Telemetry) radioGroups(now int64) [][]*radioState {
+	groups := make([][]*radioState, 0)
+	mesh := make(map[string][]*radioState)
+	keys := make([]string, 0, len(tel.radios))
+	for key := range tel.radios {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rs := tel.radios[key]
+		if now-rs.Updated > CHANNEL_PLAN_INTERVAL || rs.Channel == 0 {
+			// Radio is gone or on auto channel already
+			continue
+		}
+		if rs.Mesh {
+			mesh[rs.Band] = append(mesh[rs.Band], rs)
+			continue
+		}
+		groups = append(groups, []*radioState{rs})
+	}
+	for _, band := range []string{BAND_2G, BAND_5G, BAND_6G} {
+		if len(mesh[band]) > 0 {
+			groups = append(groups, mesh[band])
+		}
+	}
+	// Busiest radios pick first
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groupStations(groups[i]) > groupStations(groups[j])
+	})
+	return groups
+}
+
+func groupStations(group []*radioState) int {
+	n := 0
+	for _, rs := range group {
+		n += rs.StationCount
+	}
+	return n
+}
+
+// The root's radio leads a mesh group. Repeaters follow its channel
+func (tel *Telemetry) groupLeader(group []*radioState) *radioState {
+	for _, rs := range group {
+		if tel.repeaterOf(rs.Node) == nil {
+			return rs
+		}
+	}
+	return group[0]
+}
+
+// Picks a channel for every radio and returns the changes worth making
+func (tel *Telemetry) planChannels(now int64) []*ChannelRecommendation {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	recommendations := make([]*ChannelRecommendation, 0)
+	taken := make(map[*radioState]int)
+	for _, rs := range tel.radios {
+		taken[rs] = rs.Channel
+	}
+	for _, group := range tel.radioGroups(now) {
+		leader := tel.groupLeader(group)
+		current := leader.Channel
+		currentScore := tel.channelScore(group, current, taken)
+		best, bestScore := current, currentScore
+		for _, c := range leader.candidates() {
+			score := tel.channelScore(group, c, taken)
+			if score < bestScore {
+				best, bestScore = c, score
+			}
+		}
+		if best == current || currentScore-bestScore < CHANNEL_SWITCH_MARGIN {
+			continue
+		}
+		for _, rs := range group {
+			taken[rs] = best
+		}
+		reason := fmt.Sprintf("Interference score %d on channel %d against %d on channel %d", currentScore, current, bestScore, best)
+		if len(group) > 1 {
+			reason += ", mesh backhaul"
+		}
+		recommendations = append(recommendations, &ChannelRecommendation{
+			Node:             leader.Node,
+			Radio:            leader.Name,
+			Band:             leader.Band,
+			Current:          current,
+			Recommended:      best,
+			CurrentScore:     currentScore,
+			RecommendedScore: bestScore,
+			Reason:           reason,
+			Tstamp:           now,
+		})
+	}
+	return recommendations
+}
+
+func (tel *Telemetry) readChannelPlan() {
+	tel.channelPlan = &ChannelPlan{Mode: CHANNEL_PLAN_RECOMMEND, QuietStart: "03:00", QuietEnd: "05:00"}
+	content, err := nh_util.NH_read_file(DB_CHANNEL_PLAN_FILE)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, tel.channelPlan)
+	if err != nil {
+		tel.l.Error("Error while unmarshalling channel plan", err)
+	}
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) dumpChannelPlan() error {
+	pbytes, err := json.Marshal(tel.channelPlan)
+	if err != nil {
+		return err
+	}
+	return nh_util.NH_dump_to_file(DB_CHANNEL_PLAN_FILE, pbytes, 0644)
+}
+
+func (tel *Telemetry) inQuietWindow(now time.Time) bool {
+	window := Schedule{Days: []int{0, 1, 2, 3, 4, 5, 6}, Start: tel.channelPlan.QuietStart, End: tel.channelPlan.QuietEnd}
+	return window.isActive(now)
+}
+
+// Settings field holding the channel of the radio
+func channelSetting(settings *messages.InnerMessage, band string, channel int) *string {
+	switch band {
+	case BAND_2G:
+		return &settings.Chan2
+	case BAND_6G:
+		return &settings.Chan6
+	}
+	if channel >= 100 && settings.Chan52 != "" {
+		return &settings.Chan52
+	}
+	return &settings.Chan51
+}
+
+// Changes the channel of a radio of the root router or of a repeater
+func (tel *Telemetry) applyChannel(rec *ChannelRecommendation) error {
+	tel.RLock()
+	repeater := tel.repeaterOf(rec.Node)
+	var addr repeaterAddress
+	if repeater != nil {
+		addr = repeater.address()
+	}
+	tel.RUnlock()
+
+	var settings messages.InnerMessage
+	if repeater == nil {
+		err := messages.Get_wireless_message(&settings)
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err := tel.sendRepeaterCommand(addr, messages.Message{Type: "get_wireless"})
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &settings)
+		if err != nil {
+			return err
+		}
+	}
+	*channelSetting(&settings, rec.Band, rec.Current) = strconv.Itoa(rec.Recommended)
+	var status string
+	if repeater == nil {
+		status = messages.Set_wireless(settings)
+	} else {
+		data, err := tel.sendRepeaterCommand(addr, messages.Message{Type: "set_wireless", Mbody: settings})
+		if err != nil {
+			return err
+		}
+		status = string(data)
+	}
+	var result map[string]interface{}
+	if json.Unmarshal([]byte(status), &result) == nil && result["status"] == "fail" {
+		return fmt.Errorf("%v", result["error"])
+	}
+	return nil
+}
+
+func (tel *Telemetry) runChannelPlanner(ctx context.Context) {
+	clockSource := time.NewTicker(CHANNEL_PLANNER_TICK)
+	defer clockSource.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _ = <-clockSource.C:
+			tel.channelPlannerTick(time.Now())
+		}
+	}
+}
+
+// Plans the channels and applies the recommendations in the quiet window when the mode is auto
+func (tel *Telemetry) channelPlannerTick(now time.Time) {
+	tel.RLock()
+	mode := tel.channelPlan.Mode
+	planned := tel.channelPlan.Planned
+	radios := len(tel.radios)
+	tel.RUnlock()
+	if mode == CHANNEL_PLAN_OFF || radios == 0 {
+		return
+	}
+
+	if now.Unix()-planned >= CHANNEL_PLAN_INTERVAL {
+		recommendations := tel.planChannels(now.Unix())
+		tel.Lock()
+		tel.channelPlan.Planned = now.Unix()
+		tel.channelPlan.Recommendations = recommendations
+		for _, rec := range recommendations {
+			client := tel.RouterClients[rec.Node]
+			if client == nil {
+				client = NewRouterClient(rec.Node, "", rec.Node, tel.repeaterOf(rec.Node) != nil, "")
+			}
+			tel.newEvent(CHANNELRECOMMENDATIONEVENT, rec.Radio+": "+strconv.Itoa(rec.Current)+" -> "+strconv.Itoa(rec.Recommended), client, "channel")
+		}
+		tel.dumpChannelPlan()
+		tel.Unlock()
+	}
+	if mode != CHANNEL_PLAN_AUTO || !tel.inQuietWindow(now) {
+		return
+	}
+	tel.RLock()
+	pending := make([]*ChannelRecommendation, 0)
+	for _, rec := range tel.channelPlan.Recommendations {
+		if !rec.Applied && rec.Error == "" {
+			pending = append(pending, rec)
+		}
+	}
+	tel.RUnlock()
+	for _, rec := range pending {
+		err := tel.applyChannel(rec)
+		tel.Lock()
+		if err != nil {
+			tel.l.WithField("node", rec.Node).WithField("radio", rec.Radio).Error("Error while changing channel ", err)
+			rec.Error = err.Error()
+		} else {
+			rec.Applied = true
+		}
+		tel.dumpChannelPlan()
+		tel.Unlock()
+	}
+}
+
+func (tel *Telemetry) channelPlanJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	plan := messages.ChannelPlanInfo{
+		Mode:            tel.channelPlan.Mode,
+		QuietStart:      tel.channelPlan.QuietStart,
+		QuietEnd:        tel.channelPlan.QuietEnd,
+		Planned:         tel.channelPlan.Planned,
+		Recommendations: make([]messages.ChannelRecommendationInfo, 0, len(tel.channelPlan.Recommendations)),
+	}
+	for _, rec := range tel.channelPlan.Recommendations {
+		name := "router"
+		if repeater := tel.repeaterOf(rec.Node); repeater != nil {
+			name = repeater.Name
+		}
+		plan.Recommendations = append(plan.Recommendations, messages.ChannelRecommendationInfo{
+			Node:             rec.Node,
+			NodeName:         name,
+			Radio:            rec.Radio,
+			Band:             rec.Band,
+			Current:          rec.Current,
+			Recommended:      rec.Recommended,
+			CurrentScore:     rec.CurrentScore,
+			RecommendedScore: rec.RecommendedScore,
+			Reason:           rec.Reason,
+			Tstamp:           rec.Tstamp,
+			Applied:          rec.Applied,
+			Error:            rec.Error,
+		})
+	}
+	return json.Marshal(plan)
+}
+
+func (tel *Telemetry) setChannelPlan(info messages.ChannelPlanInfo) string {
+	switch info.Mode {
+	case CHANNEL_PLAN_OFF, CHANNEL_PLAN_RECOMMEND, CHANNEL_PLAN_AUTO:
+	default:
+		return nh_util.NH_getErrorStatusString("Invalid channel plan mode " + info.Mode)
+	}
+	window := Schedule{Days: []int{0}, Start: info.QuietStart, End: info.QuietEnd}
+	if err := window.validate(); err != nil {
+		return nh_util.NH_getErrorStatusString("Invalid quiet window: " + err.Error())
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	tel.channelPlan.Mode = info.Mode
+	tel.channelPlan.QuietStart = info.QuietStart
+	tel.channelPlan.QuietEnd = info.QuietEnd
+	err := tel.dumpChannelPlan()
+	if err != nil {
+		tel.l.Error("Error while saving channel plan", err)
+		return nh_util.NH_getErrorStatusString("Error while saving channel plan")
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelPlannerAuto(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	quiet := time.Date(2026, 10, 14, 3, 30, 0, 0, time.Local)
+
+	rs.tel.Lock()
+	var repeater string
+	for mac := range rs.tel.Repeaters {
+		repeater = mac
+	}
+	root := &ChannelRecommendation{Node: rs.tel.rootMac, Radio: "wl0", Band: BAND_2G, Current: 6, Recommended: 11}
+	// The repeater registered over the LAN and this router has no Nebula
+	// identity to reach it with
+	other := &ChannelRecommendation{Node: repeater, Radio: "wl0", Band: BAND_2G, Current: 6, Recommended: 1}
+	rs.tel.channelPlan.Mode = CHANNEL_PLAN_AUTO
+	rs.tel.channelPlan.Planned = quiet.Unix()
+	rs.tel.channelPlan.Recommendations = []*ChannelRecommendation{root, other}
+	rs.tel.Unlock()
+
+	// Nothing is changed outside the quiet window
+	rs.tel.channelPlannerTick(quiet.Add(-2 * time.Hour))
+	assert.False(t, root.Applied)
+
+	rs.tel.channelPlannerTick(quiet)
+	assert.True(t, root.Applied)
+	var settings messages.InnerMessage
+	assert.Nil(t, messages.Get_wireless_message(&settings))
+	assert.Equal(t, "11", settings.Chan2)
+	// The repeater is reported, not retried
+	assert.False(t, other.Applied)
+	assert.NotEqual(t, "", other.Error)
+}
@@ -0,0 +1,186 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"strings"
+)
+
+// Weights of each source of evidence. Confidence is the weight gathered by
+// the winning type, capped at 100
+const (
+	CLASSIFY_WEIGHT_HOSTNAME = 60
+	CLASSIFY_WEIGHT_DHCP     = 50
+	CLASSIFY_WEIGHT_OUI      = 40
+	CLASSIFY_WEIGHT_TRAFFIC  = 20
+)
+
+// Samples to look at before judging a client by its traffic
+const CLASSIFY_TRAFFIC_SAMPLES = 10
+
+// Clients talking to no more than these many destinations per sample look like
+// IoT. Only taken as evidence when the vendor or DHCP fingerprint already
+// points to IoT
+const CLASSIFY_IOT_MAX_DESTINATIONS = 3
+
+var hostnamePatterns = []struct {
+	pattern string
+	ctype   ClientType
+}{
+	{"iphone", WIRELESSPHONE},
+	{"ipad", WIRELESSPHONE},
+	{"android", WIRELESSPHONE},
+	{"galaxy", WIRELESSPHONE},
+	{"pixel", WIRELESSPHONE},
+	{"oneplus", WIRELESSPHONE},
+	{"redmi", WIRELESSPHONE},
+	{"macbook", WIRELESSLAPTOP},
+	{"imac", WIRELESSLAPTOP},
+	{"laptop", WIRELESSLAPTOP},
+	{"thinkpad", WIRELESSLAPTOP},
+	{"desktop", WIRELESSLAPTOP},
+	{"surface", WIRELESSLAPTOP},
+	{"_pc", WIRELESSLAPTOP},
+	{"echo", WIRELESSIOT},
+	{"alexa", WIRELESSIOT},
+	{"chromecast", WIRELESSIOT},
+	{"nest", WIRELESSIOT},
+	{"ring_", WIRELESSIOT},
+	{"esp_", WIRELESSIOT},
+	{"tasmota", WIRELESSIOT},
+	{"shelly", WIRELESSIOT},
+	{"hue", WIRELESSIOT},
+	{"roku", WIRELESSIOT},
+	{"sonos", WIRELESSIOT},
+	{"printer", WIRELESSIOT},
+	{"camera", WIRELESSIOT},
+	{"_tv", WIRELESSIOT},
+	{"tv_", WIRELESSIOT},
+}
+
+// DHCP option 55 parameter request lists of common operating systems
+var dhcpFingerprints = map[string]ClientType{
+	"1,3,6,15,26,28,51,58,59,43":                 WIRELESSPHONE,  // Android
+	"1,3,6,15,26,28,51,58,59":                    WIRELESSPHONE,  // Android
+	"1,121,3,6,15,119,252,95,44,46":              WIRELESS,       // iOS and macOS
+	"1,3,6,15,31,33,43,44,46,47,119,121,249,252": WIRELESSLAPTOP, // Windows
+	"1,28,2,3,15,6,119,12,44,47,26,121,42":       WIRELESSLAPTOP, // Linux dhclient
+	"1,3,28,6":                                   WIRELESSIOT,    // lwIP based devices
+	"1,3,28,6,15":                                WIRELESSIOT,
+	"1,3,6,12,15,28,42":                          WIRELESSIOT,
+	"1,3,6,15,28,33,42,44,46,47,121,249,252,12":  WIRELESSLAPTOP,
+}
+
+func ouiVendor(mac string) (ouiEntry, bool) {
+	if len(mac) < 8 {
+		return ouiEntry{}, false
+	}
+	entry, ok := ouiTable[strings.ToLower(mac[0:8])]
+	return entry, ok
+}
+
+func hostnameType(name string) (ClientType, bool) {
+	name = strings.ToLower(name)
+	if name == "" || name == "na" {
+		return WIRED, false
+	}
+	for _, hp := range hostnamePatterns {
+		if strings.Contains(name, hp.pattern) {
+			return hp.ctype, true
+		}
+	}
+	return WIRED, false
+}
+
+// Picks the type with the most evidence. WIRELESS votes only tell that the
+// device is not IoT, so they are split between laptops and phones
+func bestVote(votes map[ClientType]int) (ClientType, int) {
+	if w := votes[WIRELESS]; w > 0 {
+		votes[WIRELESSLAPTOP] += w / 2
+		votes[WIRELESSPHONE] += w / 2
+		delete(votes, WIRELESS)
+	}
+	best := WIRED
+	confidence := 0
+	for ctype, weight := range votes {
+		if weight > confidence || (weight == confidence && ctype < best) {
+			best = ctype
+			confidence = weight
+		}
+	}
+	if confidence > 100 {
+		confidence = 100
+	}
+	return best, confidence
+}
+
+func (client *RouterClient) classificationVotes() map[ClientType]int {
+	votes := make(map[ClientType]int)
+	if entry, ok := ouiVendor(client.MACAddress); ok {
+		votes[entry.Hint] += CLASSIFY_WEIGHT_OUI
+	}
+	if ctype, ok := dhcpFingerprints[getDHCPFingerprint(client.MACAddress)]; ok {
+		votes[ctype] += CLASSIFY_WEIGHT_DHCP
+	}
+	iot := votes[WIRELESSIOT] > 0
+	if ctype, ok := hostnameType(client.Name); ok {
+		votes[ctype] += CLASSIFY_WEIGHT_HOSTNAME
+	}
+	if iot && client.trafficSamples >= CLASSIFY_TRAFFIC_SAMPLES && client.peakDestinations <= CLASSIFY_IOT_MAX_DESTINATIONS {
+		votes[WIRELESSIOT] += CLASSIFY_WEIGHT_TRAFFIC
+	}
+	return votes
+}
+
+// Sets the kind of a wireless client from its vendor, hostname, DHCP
+// fingerprint and traffic. Wired clients stay WIRED, the kinds are all
+// wireless ones. Types set by the user through setClientDetails are left alone
+func (client *RouterClient) classify() {
+	if entry, ok := ouiVendor(client.MACAddress); ok {
+		client.Vendor = entry.Vendor
+	}
+	if client.TypeManual || client.Type == WIRED {
+		return
+	}
+	ctype, confidence := bestVote(client.classificationVotes())
+	if confidence == 0 || confidence < client.TypeConfidence {
+		return
+	}
+	if ctype != client.Type || confidence != client.TypeConfidence {
+		client.Type = ctype
+		client.TypeConfidence = confidence
+		client.Dirty = true
+	}
+}
+
+// Clients saved before the classifier have no confidence. A type other than
+// the defaults was picked by the user and is kept as manual
+func (client *RouterClient) migrateType() {
+	if client.TypeManual || client.TypeConfidence != 0 {
+		return
+	}
+	if client.Type != WIRED && client.Type != WIRELESS {
+		client.TypeManual = true
+	}
+}
+
+// Tracks how many destinations the client talks to and reclassifies it once
+// enough samples are seen. Called with the telemetry lock held
+func (tel *Telemetry) classifyByTraffic(device Device) {
+	client := tel.RouterClients[device.Mac]
+	if client == nil || client.TypeManual {
+		return
+	}
+	destinations := make(map[string]bool)
+	for _, conn := range device.Conn {
+		destinations[conn.R_ip] = true
+	}
+	if len(destinations) > client.peakDestinations {
+		client.peakDestinations = len(destinations)
+	}
+	client.trafficSamples++
+	if client.trafficSamples == CLASSIFY_TRAFFIC_SAMPLES || (client.trafficSamples == 1 && client.TypeConfidence == 0) {
+		client.classify()
+	}
+}
@@ -0,0 +1,41 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clientType(rs *RouterServer, mac string) ClientType {
+	rs.tel.RLock()
+	defer rs.tel.RUnlock()
+	return rs.tel.RouterClients[mac].Type
+}
+
+func TestClassify(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+
+	assert.Equal(t, WIRELESSPHONE, clientType(rs, "f0:25:b7:10:20:01"))
+	assert.Equal(t, WIRELESSIOT, clientType(rs, "24:0a:c4:10:20:05"))
+	// The Windows fingerprint does not make a wired desktop wireless
+	assert.Equal(t, WIRED, clientType(rs, "b8:ac:6f:10:20:03"))
+}
+
+func TestClassifyByTraffic(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	// Few destinations alone don't make an IoT device
+	sim.AddClient(SimClient{Mac: "02:00:00:10:20:07", Ip: "192.168.1.107", Name: "na",
+		Radio: "wl1", Rssi: -50, RateIn: 1000, RateOut: 1000, Destinations: simIoTCloud})
+	// With a vendor making IoT devices they do
+	sim.AddClient(SimClient{Mac: "18:fe:34:10:20:08", Ip: "192.168.1.108", Name: "na",
+		Radio: "wl1", Rssi: -50, RateIn: 1000, RateOut: 1000, Destinations: simIoTCloud})
+	for i := 0; i < CLASSIFY_TRAFFIC_SAMPLES+1; i++ {
+		assert.Nil(t, sim.Tick())
+	}
+	assert.Equal(t, WIRELESS, clientType(rs, "02:00:00:10:20:07"))
+	assert.Equal(t, WIRELESSIOT, clientType(rs, "18:fe:34:10:20:08"))
+}
@@ -15,12 +15,30 @@ const (
 )
 
 const (
-	NEWCLIENTEVENT EventType = 0
-	BLOCKEDIPEVENT EventType = 1
+	NEWCLIENTEVENT        EventType = 0
+	BLOCKEDIPEVENT        EventType = 1
+	SCHEDULEPAUSEDEVENT   EventType = 2
+	SCHEDULEUNPAUSEDEVENT EventType = 3
+	QUOTAEXCEEDEDEVENT    EventType = 4
+	REPEATEROFFLINEEVENT  EventType = 5
+	REPEATERONLINEEVENT   EventType = 6
+	UPGRADEEVENT          EventType = 7
+	// Extra is "<radio>: <current> -> <recommended>"
+	CHANNELRECOMMENDATIONEVENT EventType = 8
+	// Extra is "<from> -> <to>" with the names of the access points
+	ROAMEVENT         EventType = 9
+	STICKYCLIENTEVENT EventType = 10
+	// Extra is the person
+	ARRIVEDEVENT  EventType = 11
+	DEPARTEDEVENT EventType = 12
+	// Extra explains what was detected, Source is the detector
+	ANOMALYEVENT EventType = 13
 )
 
-const MAX_CLIENT_MINUTE_STATS_ENTRIES = 30
-const MAX_CLIENT_HOUR_STATS_ENTRIES = 4
+const MAX_CLIENT_MINUTE_STATS_ENTRIES = 60
+const MAX_CLIENT_HOUR_STATS_ENTRIES = 48
+const MAX_CLIENT_DAY_STATS_ENTRIES = 62
+const MAX_CLIENT_MONTH_STATS_ENTRIES = 24
 const TIMESTAMP_FORMAT = "2006-02-01 15:04"
 const TIMESTAMP_FORMAT_HOUR = "2006-02-01 15"
 const MAX_NUM_OF_REPEATERS = 5
@@ -95,15 +113,37 @@ type VAP struct {
 	Stas []Station `json:stas`
 }
 
+// Access point heard in the radio's channel scan
+type Neighbour struct {
+	Bssid   string `json:"bssid"`
+	Ssid    string `json:"ssid"`
+	Channel int    `json:"channel"`
+	Rssi    int    `json:"rssi"`
+}
+
 type Radio struct {
 	Name    string `jsong:name`
 	Channel int    `jsong:channel`
 	//	Extras  string `jsong:extras`
 	Vaps []VAP `jsong:vaps`
+	// 2g, 5g or 6g. Guessed from the channel when empty
+	Band string      `json:"band,omitempty"`
+	Scan []Neighbour `json:"scan,omitempty"`
 }
 
 type WirelessTelemetryData struct {
 	Radios []Radio `json:radios`
+	// Bridge MAC of the repeater sending the telemetry. Empty for the root
+	Mac string `json:"mac,omitempty"`
+}
+
+// Recurring pause window. Start and End are "HH:MM" in the router's local time.
+// An End earlier than Start means the window runs past midnight; Days (0 = Sunday)
+// are the days on which the window starts.
+type Schedule struct {
+	Days  []int
+	Start string
+	End   string
 }
 
 // Connected client info
@@ -120,6 +160,57 @@ type RouterClient struct {
 	Paused        bool
 	name_attempts int
 	Lastseen      int64
+	Schedules     []Schedule
+	// Set while one of the schedules is active
+	SchedulePaused bool
+	// The schedule holds the pause of the client and lifts it when the
+	// window ends. Not set when the client was already paused by hand
+	ScheduleHeld bool
+	// The exhausted quota of the client holds its pause and lifts it at the
+	// reset. Not set when the client was already paused by hand
+	QuotaPaused bool
+	Vendor      string
+	// 0-100. How sure the automatic classification is about Type
+	TypeConfidence int
+	// Type was set by the user and is not classified automatically
+	TypeManual bool
+	// Root or repeater the client is associated to
+	ApMac string
+	// Person owning the device. Only person devices are tracked for presence
+	Person    string
+	Home      bool
+	HomeSince int64
+	// Approval of a new client while quarantine is on: pending, approved or rejected
+	Approval     string
+	PendingSince int64
+	// Quarantine mode the client is held in, empty once released
+	Quarantine string
+	// Name of the client group, empty for none
+	Group string
+	// The pause of the group holds the client. Not set when the client was
+	// already paused by hand
+	GroupHeld bool
+	// Schedules are the ones of the group. The client gets OwnSchedules back
+	// when it leaves the group
+	GroupSchedules   bool
+	OwnSchedules     []Schedule
+	trafficSamples   int
+	peakDestinations int
+}
+
+// Daily bytes and active minutes allowed for a client or a group of
+// clients sharing it. A zero limit is unlimited.
+type Quota struct {
+	Name             string
+	Clients          []string
+	DailyBytes       uint64
+	DailyMinutes     int
+	ResetTime        string
+	UsedBytes        uint64
+	UsedMinutes      int
+	Exceeded         bool
+	PeriodStart      int64
+	LastActiveMinute int64
 }
 type addClient func(client *RouterClient)
 
@@ -129,6 +220,32 @@ type Repeater struct {
 	MMac  string `json:mmac`
 	Ip    string `json:ip`
 	Fwver string `json:fwver`
+	// MAC of the node the repeater's mesh interface is associated to
+	Upstream     string `json:"upstream,omitempty"`
+	BackhaulRssi int    `json:"backhaulrssi,omitempty"`
+	Lastseen     int64  `json:"lastseen,omitempty"`
+	Online       bool   `json:"online,omitempty"`
+	// Nebula address the repeater registered from. The root reaches the
+	// router api of the repeater over the tunnel
+	Vpnip string `json:"vpnip,omitempty"`
+	// Hash of the token the repeater got when it registered
+	TokenHash string `json:"tokenhash,omitempty"`
+}
+
+// Bytes seen for a client in one minute/hour/day/month bucket
+type UsageEntry struct {
+	Tstamp   int64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+type ClientUsage struct {
+	MACAddress string
+	Minutes    []UsageEntry
+	Hours      []UsageEntry
+	Days       []UsageEntry
+	Months     []UsageEntry
+	Dirty      bool
 }
 
 type RouterEvent struct {
@@ -137,4 +254,8 @@ type RouterEvent struct {
 	Extra  string
 	Client *RouterClient
 	Tstamp int64
+	// What raised the event, say the blocklist feed that matched
+	Source string
+	// Sequence number in the event journal
+	Seq uint64
 }
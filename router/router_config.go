@@ -0,0 +1,415 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Bumped whenever the payload changes in a way older firmware can't restore
+const CONFIG_ARCHIVE_VERSION = 1
+
+const CONFIG_MIN_PASSPHRASE_LENGTH = 8
+
+// A piece of router state saved in the archive. Directories are saved file by file
+type configFile struct {
+	name string
+	path string
+	dir  bool
+}
+
+// What a new unit needs to take over. Usage history, events and guest passes
+// are left out, and so is the api secret of the unit
+func configFiles() []configFile {
+	return []configFile{
+		{"clients", DB_CLIENTS_LOCATION, true},
+		{"repeaters", DB_REPEATERS_FILE, false},
+		{"quotas", DB_QUOTAS_FILE, false},
+		{"blocklist_feeds", DB_BLOCKLIST_FEEDS_FILE, false},
+		{"filter_profiles", DB_FILTER_PROFILES_FILE, false},
+		{"channel_plan", DB_CHANNEL_PLAN_FILE, false},
+		{"presence", DB_PRESENCE_FILE, false},
+		{"quarantine", DB_QUARANTINE_FILE, false},
+		{"anomaly", DB_ANOMALY_FILE, false},
+		{"groups", DB_GROUPS_FILE, false},
+	}
+}
+
+type configPayload struct {
+	Files    map[string][]byte
+	Wireless *messages.InnerMessage `json:",omitempty"`
+	// The Wi-Fi keys were left out of an archive that is not encrypted. The
+	// unit restoring it keeps its own
+	WithoutKeys bool `json:",omitempty"`
+	// Network wide blocklist categories. Left as they are when missing
+	Blocklist *messages.BlocklistInnerMessage `json:",omitempty"`
+}
+
+// The keys in the wireless settings
+func wirelessKeys(settings *messages.InnerMessage) []*string {
+	return []*string{
+		&settings.Key2, &settings.Key5, &settings.Key52,
+		&settings.Gkey2, &settings.Gkey5, &settings.Gkey52,
+		&settings.Meshkey,
+	}
+}
+
+func configKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func sealConfig(archive *messages.ConfigArchive, payload []byte, passphrase string) error {
+	archive.Salt = make([]byte, 16)
+	_, err := rand.Read(archive.Salt)
+	if err != nil {
+		return err
+	}
+	key, err := configKey(passphrase, archive.Salt)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	archive.Nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(archive.Nonce)
+	if err != nil {
+		return err
+	}
+	archive.Encrypted = true
+	archive.Payload = gcm.Seal(nil, archive.Nonce, payload, []byte(fmt.Sprintf("%d", archive.Version)))
+	return nil
+}
+
+func openConfig(archive *messages.ConfigArchive, passphrase string) ([]byte, error) {
+	if !archive.Encrypted {
+		return archive.Payload, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("The configuration is encrypted. Passphrase is needed")
+	}
+	key, err := configKey(passphrase, archive.Salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid configuration archive")
+	}
+	payload, err := gcm.Open(nil, archive.Nonce, archive.Payload, []byte(fmt.Sprintf("%d", archive.Version)))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong passphrase or corrupted configuration")
+	}
+	return payload, nil
+}
+
+// Archive of the router state, encrypted with the passphrase. Without one the
+// archive is left in the clear and the Wi-Fi keys are not in it
+func (tel *Telemetry) exportConfig(passphrase string) ([]byte, error) {
+	if passphrase != "" && len(passphrase) < CONFIG_MIN_PASSPHRASE_LENGTH {
+		return nil, fmt.Errorf("Passphrase must be at least %d characters", CONFIG_MIN_PASSPHRASE_LENGTH)
+	}
+	// Make sure the client DB is up to date
+	tel.dumpRouterClients()
+
+	payload := configPayload{Files: make(map[string][]byte)}
+	tel.RLock()
+	for _, cf := range configFiles() {
+		if !cf.dir {
+			content, err := nh_util.NH_read_file(cf.path)
+			if err == nil {
+				payload.Files[cf.name] = content
+			}
+			continue
+		}
+		files, _ := ioutil.ReadDir(cf.path)
+		for _, file := range files {
+			content, err := nh_util.NH_read_file(cf.path + file.Name())
+			if err == nil {
+				payload.Files[cf.name+"/"+file.Name()] = content
+			}
+		}
+	}
+	tel.RUnlock()
+	var settings messages.InnerMessage
+	if messages.Get_wireless_message(&settings) == nil {
+		payload.Wireless = &settings
+		if passphrase == "" {
+			for _, key := range wirelessKeys(&settings) {
+				*key = ""
+			}
+			payload.WithoutKeys = true
+		}
+	}
+	var blocklist messages.BlocklistInnerMessage
+	if messages.Get_blocklist_message(&blocklist) == nil {
+		payload.Blocklist = &blocklist
+	}
+	pbytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := messages.ConfigArchive{
+		Version: CONFIG_ARCHIVE_VERSION,
+		Created: time.Now().Unix(),
+		Fwver:   getFwVersion(),
+		Payload: pbytes,
+	}
+	if passphrase != "" {
+		err = sealConfig(&archive, pbytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(archive)
+}
+
+// Called with the telemetry lock held
+func writeConfigFiles(files map[string][]byte) error {
+	known := make(map[string]configFile)
+	for _, cf := range configFiles() {
+		known[cf.name] = cf
+	}
+	// Check everything before writing anything
+	for name := range files {
+		dir, file := name, ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			dir, file = name[:i], name[i+1:]
+		}
+		cf, ok := known[dir]
+		if !ok || cf.dir != (file != "") || (cf.dir && (filepath.Base(file) != file || strings.HasPrefix(file, "."))) {
+			return fmt.Errorf("Unexpected %s in the configuration", name)
+		}
+	}
+	// Everything is staged next to where it goes, so that a failed write
+	// leaves the current state as it was
+	for _, cf := range configFiles() {
+		if cf.dir {
+			os.RemoveAll(stagedPath(cf))
+			err := nh_util.NH_create_dir(stagedPath(cf), 0755)
+			if err != nil {
+				removeStaged()
+				return err
+			}
+		}
+	}
+	for name, content := range files {
+		cf := known[strings.SplitN(name, "/", 2)[0]]
+		path := stagedPath(cf)
+		if cf.dir {
+			path = path + "/" + strings.SplitN(name, "/", 2)[1]
+		}
+		perm := os.FileMode(0644)
+		if cf.name == "repeaters" {
+			perm = 0600
+		}
+		err := nh_util.NH_dump_to_file(path, content, perm)
+		if err != nil {
+			removeStaged()
+			return err
+		}
+	}
+	for _, cf := range configFiles() {
+		err := swapStaged(cf, files)
+		if err != nil {
+			removeStaged()
+			return err
+		}
+	}
+	return nil
+}
+
+// Where the new copy of the file or directory is written first
+func stagedPath(cf configFile) string {
+	return strings.TrimSuffix(cf.path, "/") + ".new"
+}
+
+func removeStaged() {
+	for _, cf := range configFiles() {
+		os.RemoveAll(stagedPath(cf))
+	}
+}
+
+// Puts the staged copy in place. Directories are replaced as a whole and
+// files not in the archive go back to the defaults
+func swapStaged(cf configFile, files map[string][]byte) error {
+	if !cf.dir {
+		if _, ok := files[cf.name]; !ok {
+			os.Remove(cf.path)
+			return nil
+		}
+		return os.Rename(stagedPath(cf), cf.path)
+	}
+	path := strings.TrimSuffix(cf.path, "/")
+	old := path + ".old"
+	os.RemoveAll(old)
+	err := os.Rename(path, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(stagedPath(cf), path)
+	if err != nil {
+		os.Rename(old, path)
+		return err
+	}
+	os.RemoveAll(old)
+	return nil
+}
+
+// Reads the state written by writeConfigFiles, as on boot
+// Called with the telemetry lock held
+func (tel *Telemetry) reloadConfig() {
+	// The restored clients bring their own isolation
+	for mac, client := range tel.RouterClients {
+		if mac == client.MACAddress && client.Quarantine == QUARANTINE_INTERNET {
+			isolateClient(client.MACAddress, client.IPAddress, false)
+		}
+	}
+	tel.RouterClients = make(map[string]*RouterClient)
+	readClientDetails(func(client *RouterClient) {
+		tel.RouterClients[client.MACAddress] = client
+		tel.RouterClients[client.MACAddress].Dirty = false
+		addDNSEntryPlatform(client)
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, client.Paused)
+		restoreQuarantine(client)
+	}, tel.l)
+	applyDNSEntries()
+	tel.Repeaters = make(map[string]*Repeater)
+	tel.readRepeaterInfo()
+	tel.Quotas = make(map[string]*Quota)
+	tel.readQuotas()
+	tel.readChannelPlan()
+	tel.readPresenceConfig()
+	tel.readQuarantineConfig()
+	tel.readAnomalyConfig()
+	tel.groups = make(map[string]*ClientGroup)
+	tel.readGroups()
+	tel.Blocklist.readCache()
+	err := tel.Filters.read()
+	if err != nil {
+		tel.l.Error("Error while reading filter profiles ", err)
+	}
+	// Profiles removed by the import must not stay applied
+	tel.Filters.Lock()
+	err = tel.Filters.apply()
+	tel.Filters.Unlock()
+	if err != nil {
+		tel.l.Error("Error while applying filter profiles ", err)
+	}
+	// Fetched again on the next tick. The filter profiles are applied with them
+	tel.blocklistupdated = 0
+	tel.blockedurllistupdated = 0
+	tel.pruneClientState()
+}
+
+// Drops what is kept about clients that are not in the restored client list
+// Called with the telemetry lock held
+func (tel *Telemetry) pruneClientState() {
+	curtime := time.Now().Unix()
+	for mac := range tel.Usage {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.Usage, mac)
+			os.Remove(getUsageFileName(mac))
+		}
+	}
+	for mac := range tel.DNSActivity {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.DNSActivity, mac)
+			os.Remove(dnsActivityFile(mac))
+		}
+	}
+	for mac := range tel.stations {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.stations, mac)
+		}
+	}
+	for mac := range tel.flows {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.flows, mac)
+		}
+	}
+	for mac := range tel.anomalies {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.anomalies, mac)
+		}
+	}
+}
+
+// Restores an archive made by exportConfig. The wireless settings are applied
+// last as the Wi-Fi restarts with them
+func (tel *Telemetry) importConfig(archive messages.ConfigArchive, passphrase string) error {
+	if archive.Version <= 0 || archive.Version > CONFIG_ARCHIVE_VERSION {
+		return fmt.Errorf("Unsupported configuration version %d", archive.Version)
+	}
+	pbytes, err := openConfig(&archive, passphrase)
+	if err != nil {
+		return err
+	}
+	var payload configPayload
+	err = json.Unmarshal(pbytes, &payload)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration archive")
+	}
+
+	tel.Lock()
+	err = writeConfigFiles(payload.Files)
+	if err == nil {
+		tel.reloadConfig()
+	}
+	tel.Unlock()
+	if err != nil {
+		return err
+	}
+	tel.l.WithField("version", archive.Version).WithField("fwver", archive.Fwver).Info("Imported router configuration")
+
+	if payload.Blocklist != nil {
+		messages.Set_blocklist(*payload.Blocklist)
+	}
+	if payload.Wireless != nil {
+		if payload.WithoutKeys {
+			var current messages.InnerMessage
+			err = messages.Get_wireless_message(&current)
+			if err != nil {
+				return fmt.Errorf("Wireless settings: the archive has no keys and the current ones can't be read")
+			}
+			keys := wirelessKeys(&current)
+			for i, key := range wirelessKeys(payload.Wireless) {
+				*key = *keys[i]
+			}
+		}
+		status := messages.Set_wireless(*payload.Wireless)
+		var result map[string]interface{}
+		if json.Unmarshal([]byte(status), &result) == nil && result["status"] == "fail" {
+			return fmt.Errorf("Wireless settings: %v", result["error"])
+		}
+	}
+	return nil
+}
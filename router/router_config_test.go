@@ -0,0 +1,98 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exportArchive(t *testing.T, rs *RouterServer, passphrase string) messages.ConfigArchive {
+	abytes, err := rs.tel.exportConfig(passphrase)
+	assert.Nil(t, err)
+	var archive messages.ConfigArchive
+	assert.Nil(t, json.Unmarshal(abytes, &archive))
+	return archive
+}
+
+func setWireless(t *testing.T, change func(*messages.InnerMessage)) {
+	var settings messages.InnerMessage
+	assert.Nil(t, messages.Get_wireless_message(&settings))
+	change(&settings)
+	assert.Contains(t, messages.Set_wireless(settings), "success")
+}
+
+func TestConfigEncrypted(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	_, err := rs.tel.exportConfig("short")
+	assert.NotNil(t, err)
+
+	setWireless(t, func(s *messages.InnerMessage) { s.Key2 = "Tr1cky-Passw0rd" })
+	archive := exportArchive(t, rs, "a good passphrase")
+	assert.True(t, archive.Encrypted)
+	assert.NotContains(t, string(archive.Payload), "Tr1cky-Passw0rd")
+	assert.NotNil(t, rs.tel.importConfig(archive, "a wrong passphrase"))
+
+	setWireless(t, func(s *messages.InnerMessage) { s.Key2 = "An0ther-Passw0rd" })
+	assert.Nil(t, rs.tel.importConfig(archive, "a good passphrase"))
+	var settings messages.InnerMessage
+	assert.Nil(t, messages.Get_wireless_message(&settings))
+	assert.Equal(t, "Tr1cky-Passw0rd", settings.Key2)
+}
+
+func TestConfigWithoutKeys(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	setWireless(t, func(s *messages.InnerMessage) {
+		s.Ssid2 = "Downstairs"
+		s.Key2 = "Tr1cky-Passw0rd"
+	})
+
+	archive := exportArchive(t, rs, "")
+	assert.False(t, archive.Encrypted)
+	assert.NotContains(t, string(archive.Payload), "Tr1cky-Passw0rd")
+	assert.Contains(t, string(archive.Payload), "Downstairs")
+
+	// The unit keeps its own keys
+	setWireless(t, func(s *messages.InnerMessage) {
+		s.Ssid2 = "Upstairs"
+		s.Key2 = "An0ther-Passw0rd"
+	})
+	assert.Nil(t, rs.tel.importConfig(archive, ""))
+	var settings messages.InnerMessage
+	assert.Nil(t, messages.Get_wireless_message(&settings))
+	assert.Equal(t, "Downstairs", settings.Ssid2)
+	assert.Equal(t, "An0ther-Passw0rd", settings.Key2)
+}
+
+func TestConfigImportDropsClientState(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	archive := exportArchive(t, rs, "")
+
+	// A client that shows up after the export is not in the archive
+	newMac := "3c:22:fb:10:20:07"
+	sim.AddClient(SimClient{Mac: newMac, Ip: "192.168.1.107", Name: "iPad", Radio: "wl1", Rssi: -55,
+		RateIn: 1000, RateOut: 1000, Destinations: simCloud})
+	assert.Nil(t, sim.Tick())
+	assert.Nil(t, sim.Tick())
+	rs.tel.dumpUsage()
+	assert.Contains(t, rs.tel.Usage, newMac)
+	assert.FileExists(t, getUsageFileName(newMac))
+
+	assert.Nil(t, rs.tel.importConfig(archive, ""))
+	rs.tel.RLock()
+	defer rs.tel.RUnlock()
+	assert.NotContains(t, rs.tel.RouterClients, newMac)
+	assert.NotContains(t, rs.tel.Usage, newMac)
+	assert.NotContains(t, rs.tel.stations, newMac)
+	assert.NotContains(t, rs.tel.flows, newMac)
+	assert.NoFileExists(t, getUsageFileName(newMac))
+	assert.Contains(t, rs.tel.Usage, testMac)
+}
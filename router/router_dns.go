@@ -0,0 +1,469 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// Bounded per client. The least queried domain makes room for a new one
+const MAX_DNS_DOMAINS_PER_CLIENT = 256
+
+// Counts are halved every day so that the top domains follow what the
+// client is reaching lately
+const DNS_ACTIVITY_DECAY_INTERVAL = 24 * 60 * 60
+
+// dnsmasq keeps appending to the query log. It is truncated once we are past this
+const DNS_QUERY_LOG_MAX_SIZE = 1024 * 1024
+
+const DNS_ACTIVITY_DEFAULT_COUNT = 20
+
+// Addresses mapped back to the domains they were resolved from, per generation
+const MAX_DNS_NAMES = 4096
+
+// Domains blocked by the domains of a filtering profile rather than a category
+const DNS_CUSTOM_CATEGORY = "custom"
+
+type DNSDomainStat struct {
+	Queries  uint64
+	Blocked  uint64
+	Category string `json:",omitempty"`
+	Lastseen int64
+}
+
+type DNSActivity struct {
+	MACAddress string
+	Since      int64
+	Decayed    int64
+	Queries    uint64
+	Blocked    uint64
+	Domains    map[string]*DNSDomainStat
+	Dirty      bool
+}
+
+// One line of the dnsmasq log with log-queries=extra:
+//
+//	Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 query[A] example.com from 192.168.50.23
+//	Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 /etc/nearhop/filter/adult.conf example.com is 0.0.0.0
+type dnsLogEntry struct {
+	id      string
+	ip      string
+	verb    string
+	domain  string
+	answer  string
+	blocked bool
+}
+
+// A query counted for a client, by the id dnsmasq logs it with
+type dnsQuery struct {
+	da     *DNSActivity
+	domain string
+}
+
+func NewDNSActivity(mac string, now int64) *DNSActivity {
+	da := DNSActivity{
+		MACAddress: mac,
+		Since:      now,
+		Decayed:    now,
+		Domains:    make(map[string]*DNSDomainStat),
+	}
+	return &da
+}
+
+func (tel *Telemetry) readDNSActivity() {
+	files, _ := ioutil.ReadDir(DB_DNS_ACTIVITY_LOCATION)
+	for _, file := range files {
+		content, err := nh_util.NH_read_file(DB_DNS_ACTIVITY_LOCATION + file.Name())
+		if err != nil {
+			tel.l.Error("Error", err)
+			continue
+		}
+		var da DNSActivity
+		err = json.Unmarshal(content, &da)
+		if err != nil || da.Domains == nil {
+			tel.l.WithField("file", file.Name()).Error("Error while unmarshalling dns activity", err)
+			continue
+		}
+		da.Dirty = false
+		tel.DNSActivity[da.MACAddress] = &da
+	}
+}
+
+func dumpDNSActivity(da *DNSActivity) error {
+	c, err := json.Marshal(*da)
+	if err != nil {
+		return err
+	}
+	nh_util.NH_create_dir(DB_DNS_ACTIVITY_LOCATION, 0755)
+	return nh_util.NH_dump_to_file(dnsActivityFile(da.MACAddress), c, 0644)
+}
+
+func isBlockedAnswer(answer string) bool {
+	switch answer {
+	case "0.0.0.0", "::", "NXDOMAIN", "NODATA", "NODATA-IPv4", "NODATA-IPv6":
+		return true
+	}
+	return false
+}
+
+// The fields after the dnsmasq[pid]: prefix
+func dnsLogFields(line string) ([]string, bool) {
+	i := strings.Index(line, "]: ")
+	if i < 0 {
+		return nil, false
+	}
+	fields := strings.Fields(line[i+3:])
+	return fields, len(fields) >= 6
+}
+
+// Returns false for the lines that are not about a client's query
+func parseDNSLogLine(line string) (dnsLogEntry, bool) {
+	var entry dnsLogEntry
+	fields, ok := dnsLogFields(line)
+	if !ok {
+		return entry, false
+	}
+	slash := strings.LastIndex(fields[1], "/")
+	if slash <= 0 {
+		return entry, false
+	}
+	entry.id = fields[0]
+	entry.ip = fields[1][:slash]
+	entry.verb = fields[2]
+	entry.domain = strings.ToLower(strings.TrimSuffix(fields[3], "."))
+	entry.answer = fields[5]
+	switch {
+	case strings.HasPrefix(entry.verb, "query["):
+		return entry, fields[4] == "from" && entry.verb != "query[PTR]"
+	case entry.verb == "config" || strings.HasPrefix(entry.verb, "/"):
+		// Answered from our own config or from a category file of the filter
+		entry.blocked = fields[4] == "is" && isBlockedAnswer(entry.answer)
+		return entry, entry.blocked
+	}
+	return entry, false
+}
+
+// The address a domain resolved to, from the reply and cached lines
+func parseDNSAnswer(line string) (string, string, bool) {
+	fields, ok := dnsLogFields(line)
+	if !ok || (fields[2] != "reply" && fields[2] != "cached") || fields[4] != "is" {
+		return "", "", false
+	}
+	ip := net.ParseIP(fields[5])
+	if ip == nil || ip.IsUnspecified() {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSuffix(fields[3], ".")), ip.String(), true
+}
+
+// Remembers the domain an address was resolved from, for the flows. The names
+// are kept in two generations so that the map stays bounded
+// Called with the telemetry lock held
+func (tel *Telemetry) rememberDNSName(domain string, ip string) {
+	if len(tel.dnsNames) >= MAX_DNS_NAMES {
+		tel.dnsNamesOld = tel.dnsNames
+		tel.dnsNames = make(map[string]string)
+	}
+	tel.dnsNames[ip] = domain
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) dnsName(ip string) string {
+	if domain, ok := tel.dnsNames[ip]; ok {
+		return domain
+	}
+	return tel.dnsNamesOld[ip]
+}
+
+func blockedCategory(verb string) string {
+	if verb == "config" {
+		return DNS_CUSTOM_CATEGORY
+	}
+	return strings.TrimSuffix(filepath.Base(verb), filepath.Ext(verb))
+}
+
+// Makes room for a new domain. Called with the telemetry lock held
+func (da *DNSActivity) evict() {
+	var victim string
+	var least *DNSDomainStat
+	for domain, stat := range da.Domains {
+		if least == nil || stat.Queries+stat.Blocked < least.Queries+least.Blocked ||
+			(stat.Queries+stat.Blocked == least.Queries+least.Blocked && stat.Lastseen < least.Lastseen) {
+			victim = domain
+			least = stat
+		}
+	}
+	delete(da.Domains, victim)
+}
+
+// Called with the telemetry lock held
+func (da *DNSActivity) add(entry dnsLogEntry, now int64) {
+	stat := da.Domains[entry.domain]
+	if stat == nil {
+		if len(da.Domains) >= MAX_DNS_DOMAINS_PER_CLIENT {
+			da.evict()
+		}
+		stat = &DNSDomainStat{}
+		da.Domains[entry.domain] = stat
+	}
+	if entry.blocked {
+		stat.Blocked++
+		stat.Category = blockedCategory(entry.verb)
+		da.Blocked++
+	} else {
+		stat.Queries++
+		da.Queries++
+	}
+	stat.Lastseen = now
+	da.Dirty = true
+}
+
+// Takes back a query that turned out to be blocked
+// Called with the telemetry lock held
+func (da *DNSActivity) unquery(domain string) {
+	if stat := da.Domains[domain]; stat != nil && stat.Queries > 0 {
+		stat.Queries--
+	}
+	if da.Queries > 0 {
+		da.Queries--
+	}
+}
+
+// Called with the telemetry lock held
+func (da *DNSActivity) decay(now int64) {
+	if now-da.Decayed < DNS_ACTIVITY_DECAY_INTERVAL {
+		return
+	}
+	for domain, stat := range da.Domains {
+		stat.Queries /= 2
+		stat.Blocked /= 2
+		if stat.Queries == 0 && stat.Blocked == 0 {
+			delete(da.Domains, domain)
+		}
+	}
+	da.Decayed = now
+	da.Dirty = true
+}
+
+// Reads what dnsmasq logged since the last call
+func (tel *Telemetry) readDNSQueryLog() ([]string, error) {
+	file, err := os.OpenFile(DNS_QUERY_LOG_FILE, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < tel.dnslogoffset {
+		// Truncated by someone else
+		tel.dnslogoffset = 0
+	}
+	_, err = file.Seek(tel.dnslogoffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	// Leave a partly written line for the next time
+	end := strings.LastIndex(string(content), "\n") + 1
+	tel.dnslogoffset += int64(end)
+	if tel.dnslogoffset >= DNS_QUERY_LOG_MAX_SIZE {
+		err = file.Truncate(0)
+		if err != nil {
+			return nil, err
+		}
+		tel.dnslogoffset = 0
+	}
+	return strings.Split(string(content[:end]), "\n"), nil
+}
+
+// DNS activity is opt in. dnsmasq only logs the queries of the clients
+// while it is enabled
+func (rs *RouterServer) SetDNSQueryLog(enable bool) {
+	rs.tel.Lock()
+	rs.tel.dnsquerylog = enable
+	rs.tel.Unlock()
+	setDNSQueryLog(enable)
+}
+
+// Maps the queries in the dnsmasq log to the clients by their IP address
+func (tel *Telemetry) updateDNSActivity(now int64) {
+	tel.RLock()
+	enabled := tel.dnsquerylog
+	tel.RUnlock()
+	if !enabled {
+		return
+	}
+	lines, err := tel.readDNSQueryLog()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			tel.l.Error("Error while reading the dns query log ", err)
+		}
+		return
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	clients := make(map[string]string)
+	for mac, client := range tel.RouterClients {
+		if mac == client.MACAddress && client.IPAddress != "" {
+			clients[client.IPAddress] = mac
+		}
+	}
+	// The query of a blocked lookup is logged before the line that blocks it,
+	// possibly in the previous read. It is taken back so that the lookup is
+	// only counted as blocked
+	queries := make(map[string]dnsQuery)
+	for _, line := range lines {
+		if domain, ip, ok := parseDNSAnswer(line); ok {
+			tel.rememberDNSName(domain, ip)
+			continue
+		}
+		entry, ok := parseDNSLogLine(line)
+		if !ok {
+			continue
+		}
+		mac := clients[entry.ip]
+		if mac == "" {
+			continue
+		}
+		da := tel.DNSActivity[mac]
+		if da == nil {
+			da = NewDNSActivity(mac, now)
+			tel.DNSActivity[mac] = da
+		}
+		if entry.blocked {
+			q, ok := queries[entry.id]
+			if !ok {
+				q, ok = tel.dnsQueries[entry.id]
+			}
+			if ok && q.da == da && q.domain == entry.domain {
+				da.unquery(entry.domain)
+				delete(queries, entry.id)
+				delete(tel.dnsQueries, entry.id)
+			}
+		} else {
+			queries[entry.id] = dnsQuery{da: da, domain: entry.domain}
+		}
+		da.add(entry, now)
+	}
+	tel.dnsQueries = queries
+	for _, da := range tel.DNSActivity {
+		da.decay(now)
+	}
+}
+
+func dnsActivityFile(mac string) string {
+	return DB_DNS_ACTIVITY_LOCATION + strings.Replace(mac, ":", "_", -1)
+}
+
+func (tel *Telemetry) dumpDNSActivity() {
+	tel.Lock()
+	defer tel.Unlock()
+	curtime := time.Now().Unix()
+	for mac, da := range tel.DNSActivity {
+		// Dropped along with the client
+		if tel.clientGone(mac, curtime) {
+			delete(tel.DNSActivity, mac)
+			os.Remove(dnsActivityFile(mac))
+			continue
+		}
+		if !da.Dirty {
+			continue
+		}
+		err := dumpDNSActivity(da)
+		if err != nil {
+			tel.l.WithField("mac=", da.MACAddress).Error("Error while dumping dns activity", err)
+			continue
+		}
+		da.Dirty = false
+	}
+}
+
+// The count most queried and most blocked domains
+func (da *DNSActivity) info(name string, count int) messages.DNSActivityInfo {
+	info := messages.DNSActivityInfo{
+		MACAddress:     da.MACAddress,
+		Name:           name,
+		Since:          da.Since,
+		Queries:        da.Queries,
+		Blocked:        da.Blocked,
+		TopDomains:     make([]messages.DNSDomainInfo, 0),
+		BlockedDomains: make([]messages.DNSDomainInfo, 0),
+	}
+	for domain, stat := range da.Domains {
+		d := messages.DNSDomainInfo{
+			Domain:   domain,
+			Queries:  stat.Queries,
+			Blocked:  stat.Blocked,
+			Category: stat.Category,
+			Lastseen: stat.Lastseen,
+		}
+		if stat.Queries > 0 {
+			info.TopDomains = append(info.TopDomains, d)
+		}
+		if stat.Blocked > 0 {
+			info.BlockedDomains = append(info.BlockedDomains, d)
+		}
+	}
+	sort.Slice(info.TopDomains, func(i, j int) bool {
+		return info.TopDomains[i].Queries > info.TopDomains[j].Queries
+	})
+	sort.Slice(info.BlockedDomains, func(i, j int) bool {
+		return info.BlockedDomains[i].Blocked > info.BlockedDomains[j].Blocked
+	})
+	if len(info.TopDomains) > count {
+		info.TopDomains = info.TopDomains[:count]
+	}
+	if len(info.BlockedDomains) > count {
+		info.BlockedDomains = info.BlockedDomains[:count]
+	}
+	return info
+}
+
+func (tel *Telemetry) dnsActivityJson(mac string, count int) ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	if count <= 0 {
+		count = DNS_ACTIVITY_DEFAULT_COUNT
+	}
+	if count > MAX_DNS_DOMAINS_PER_CLIENT {
+		count = MAX_DNS_DOMAINS_PER_CLIENT
+	}
+	activity := make([]messages.DNSActivityInfo, 0)
+	for _, da := range tel.DNSActivity {
+		if mac != "all" && mac != da.MACAddress {
+			continue
+		}
+		name := ""
+		if client := tel.RouterClients[da.MACAddress]; client != nil {
+			name = client.Name
+		}
+		activity = append(activity, da.info(name, count))
+	}
+	if mac != "all" && len(activity) == 0 && tel.RouterClients[mac] == nil {
+		return nil, fmt.Errorf("Received a dns activity request for a client that does n't exist")
+	}
+	sort.Slice(activity, func(i, j int) bool {
+		return activity[i].Queries+activity[i].Blocked > activity[j].Queries+activity[j].Blocked
+	})
+	return json.Marshal(activity)
+}
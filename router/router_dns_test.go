@@ -0,0 +1,59 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDNSLogLine(t *testing.T) {
+	e, ok := parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 query[A] Example.COM. from 192.168.50.23")
+	assert.True(t, ok)
+	assert.Equal(t, dnsLogEntry{id: "41", ip: "192.168.50.23", verb: "query[A]", domain: "example.com", answer: "192.168.50.23"}, e)
+
+	// Blocked by a category file of the filter and by our own config
+	e, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 /etc/nearhop/filter/adult.conf example.com is 0.0.0.0")
+	assert.True(t, ok)
+	assert.True(t, e.blocked)
+	assert.Equal(t, "41", e.id)
+	assert.Equal(t, "example.com", e.domain)
+	e, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 42 fd00::23/53211 config ads.example.com is NXDOMAIN")
+	assert.True(t, ok)
+	assert.True(t, e.blocked)
+	assert.Equal(t, "fd00::23", e.ip)
+
+	// Answered, not blocked
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 43 192.168.50.23/53211 config router.lan is 192.168.50.1")
+	assert.False(t, ok)
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 reply example.com is 93.184.216.34")
+	assert.False(t, ok)
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 forwarded example.com to 1.1.1.1")
+	assert.False(t, ok)
+
+	// Reverse lookups are not activity of the client
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: 44 192.168.50.23/53211 query[PTR] 1.50.168.192.in-addr.arpa from 192.168.50.23")
+	assert.False(t, ok)
+
+	// Without log-queries=extra and garbage
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: query[A] example.com from 192.168.50.23")
+	assert.False(t, ok)
+	_, ok = parseDNSLogLine("Oct 18 10:00:00 dnsmasq[812]: started, version 2.86 cachesize 150")
+	assert.False(t, ok)
+	_, ok = parseDNSLogLine("")
+	assert.False(t, ok)
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	domain, ip, ok := parseDNSAnswer("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 reply Example.com. is 93.184.216.34")
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", domain)
+	assert.Equal(t, "93.184.216.34", ip)
+
+	_, _, ok = parseDNSAnswer("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 reply example.com is <CNAME>")
+	assert.False(t, ok)
+	_, _, ok = parseDNSAnswer("Oct 18 10:00:00 dnsmasq[812]: 41 192.168.50.23/53211 config example.com is 0.0.0.0")
+	assert.False(t, ok)
+}
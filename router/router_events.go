@@ -0,0 +1,239 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	messages "messages"
+)
+
+// Events kept in memory for quick queries. Older ones are read from the journal files
+const MAX_JOURNAL_EVENTS_IN_MEMORY = 1024
+
+// The journal is rotated into DB_EVENTS_FILE.1 beyond this size
+const MAX_JOURNAL_FILE_SIZE = 1024 * 1024
+
+const MAX_EVENTS_PER_QUERY = 512
+
+// Buffered events per streaming subscriber. A subscriber that falls behind is
+// dropped and resumes with the sequence number it last saw
+const JOURNAL_SUBSCRIBER_QUEUE = 64
+
+type EventFilter struct {
+	Since      uint64
+	Etypes     []int
+	MACAddress string
+	Limit      int
+}
+
+// Append-only log of router events with increasing sequence numbers
+type EventJournal struct {
+	sync.RWMutex
+	seq         uint64
+	events      []messages.EventInfo
+	subscribers map[chan messages.EventInfo]bool
+	file        *os.File
+	size        int64
+}
+
+func NewEventJournal() *EventJournal {
+	j := &EventJournal{
+		events:      make([]messages.EventInfo, 0, MAX_JOURNAL_EVENTS_IN_MEMORY),
+		subscribers: make(map[chan messages.EventInfo]bool),
+	}
+	return j
+}
+
+func (f *EventFilter) match(ev *messages.EventInfo) bool {
+	if ev.Seq <= f.Since {
+		return false
+	}
+	if f.MACAddress != "" && f.MACAddress != ev.MACAddress {
+		return false
+	}
+	if len(f.Etypes) == 0 {
+		return true
+	}
+	for _, etype := range f.Etypes {
+		if etype == ev.Etype {
+			return true
+		}
+	}
+	return false
+}
+
+func readJournalFile(filename string, callback func(ev *messages.EventInfo)) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ev messages.EventInfo
+		if json.Unmarshal(scanner.Bytes(), &ev) == nil {
+			callback(&ev)
+		}
+	}
+}
+
+func (j *EventJournal) remember(ev messages.EventInfo) {
+	if len(j.events) >= MAX_JOURNAL_EVENTS_IN_MEMORY {
+		copy(j.events, j.events[1:])
+		j.events = j.events[:len(j.events)-1]
+	}
+	j.events = append(j.events, ev)
+}
+
+// Picks up the sequence number and the recent events from the journal files
+func (j *EventJournal) open() error {
+	j.Lock()
+	defer j.Unlock()
+
+	for _, filename := range []string{DB_EVENTS_FILE + ".1", DB_EVENTS_FILE} {
+		readJournalFile(filename, func(ev *messages.EventInfo) {
+			if ev.Seq > j.seq {
+				j.seq = ev.Seq
+				j.remember(*ev)
+			}
+		})
+	}
+	file, err := os.OpenFile(DB_EVENTS_FILE, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		j.size = info.Size()
+	}
+	j.file = file
+	return nil
+}
+
+// Called with the journal lock held
+func (j *EventJournal) rotate() {
+	if j.file != nil {
+		j.file.Close()
+	}
+	os.Rename(DB_EVENTS_FILE, DB_EVENTS_FILE+".1")
+	j.size = 0
+	file, err := os.OpenFile(DB_EVENTS_FILE, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		j.file = nil
+		return
+	}
+	j.file = file
+}
+
+// Records the event, gives it the next sequence number and passes it on to the subscribers
+func (j *EventJournal) append(event *RouterEvent) error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.seq++
+	event.Seq = j.seq
+	ev := messages.EventInfo{
+		Seq:    j.seq,
+		Etype:  int(event.Etype),
+		Extra:  event.Extra,
+		Source: event.Source,
+		Tstamp: event.Tstamp,
+	}
+	if event.Client != nil {
+		ev.MACAddress = event.Client.MACAddress
+		ev.IPAddress = event.Client.IPAddress
+		ev.Name = event.Client.Name
+	}
+	j.remember(ev)
+	for ch := range j.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if j.size >= MAX_JOURNAL_FILE_SIZE {
+		j.rotate()
+	}
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	line = append(line, '\n')
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+// Without Since, the latest events in memory. Events older than those in
+// memory are read from the files without holding the journal lock, so that
+// appending events never waits on a query
+func (j *EventJournal) query(filter EventFilter) []messages.EventInfo {
+	j.RLock()
+	recent := make([]messages.EventInfo, len(j.events))
+	copy(recent, j.events)
+	j.RUnlock()
+
+	limit := filter.Limit
+	if limit <= 0 || limit > MAX_EVENTS_PER_QUERY {
+		limit = MAX_EVENTS_PER_QUERY
+	}
+	events := make([]messages.EventInfo, 0)
+	if filter.Since == 0 {
+		for i := len(recent) - 1; i >= 0 && len(events) < limit; i-- {
+			if filter.match(&recent[i]) {
+				events = append(events, recent[i])
+			}
+		}
+		for i, k := 0, len(events)-1; i < k; i, k = i+1, k-1 {
+			events[i], events[k] = events[k], events[i]
+		}
+		return events
+	}
+	add := func(ev *messages.EventInfo) {
+		if len(events) < limit && filter.match(ev) {
+			events = append(events, *ev)
+		}
+	}
+	if len(recent) > 0 && filter.Since+1 < recent[0].Seq {
+		// Older than what we have in memory. Go through the files up to it
+		for _, filename := range []string{DB_EVENTS_FILE + ".1", DB_EVENTS_FILE} {
+			readJournalFile(filename, func(ev *messages.EventInfo) {
+				if ev.Seq < recent[0].Seq {
+					add(ev)
+				}
+			})
+		}
+	}
+	for i := range recent {
+		add(&recent[i])
+	}
+	return events
+}
+
+func (j *EventJournal) subscribe() chan messages.EventInfo {
+	j.Lock()
+	defer j.Unlock()
+	ch := make(chan messages.EventInfo, JOURNAL_SUBSCRIBER_QUEUE)
+	j.subscribers[ch] = true
+	return ch
+}
+
+func (j *EventJournal) unsubscribe(ch chan messages.EventInfo) {
+	j.Lock()
+	defer j.Unlock()
+	if j.subscribers[ch] {
+		delete(j.subscribers, ch)
+		close(ch)
+	}
+}
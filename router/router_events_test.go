@@ -0,0 +1,62 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJournal(t *testing.T, count int) *EventJournal {
+	SetSimBase(t.TempDir())
+	j := NewEventJournal()
+	assert.Nil(t, j.open())
+	for i := 0; i < count; i++ {
+		etype := NEWCLIENTEVENT
+		if i%2 == 1 {
+			etype = ANOMALYEVENT
+		}
+		assert.Nil(t, j.append(&RouterEvent{Etype: etype, Tstamp: int64(i)}))
+	}
+	return j
+}
+
+func seqs(t *testing.T, j *EventJournal, filter EventFilter) []uint64 {
+	s := make([]uint64, 0)
+	for _, ev := range j.query(filter) {
+		s = append(s, ev.Seq)
+	}
+	return s
+}
+
+func TestJournalQuery(t *testing.T) {
+	total := MAX_JOURNAL_EVENTS_IN_MEMORY + 100
+	j := newTestJournal(t, total)
+	last := uint64(total)
+
+	// The latest events without since
+	assert.Equal(t, []uint64{last - 2, last - 1, last}, seqs(t, j, EventFilter{Limit: 3}))
+	assert.Equal(t, []uint64{last - 4, last - 2, last}, seqs(t, j, EventFilter{Limit: 3, Etypes: []int{int(ANOMALYEVENT)}}))
+
+	// Older events come from the files, and go on into memory
+	assert.Equal(t, []uint64{6, 7, 8}, seqs(t, j, EventFilter{Since: 5, Limit: 3}))
+	s := seqs(t, j, EventFilter{Since: 90, Limit: 20})
+	assert.Equal(t, uint64(91), s[0])
+	assert.Equal(t, uint64(110), s[len(s)-1])
+	assert.Len(t, s, 20)
+	assert.Equal(t, []uint64{last}, seqs(t, j, EventFilter{Since: last - 1}))
+	assert.Empty(t, seqs(t, j, EventFilter{Since: last}))
+}
+
+func TestJournalReopen(t *testing.T) {
+	j := newTestJournal(t, 10)
+	j.file.Close()
+
+	// The sequence goes on after a restart
+	j = NewEventJournal()
+	assert.Nil(t, j.open())
+	assert.Nil(t, j.append(&RouterEvent{Etype: NEWCLIENTEVENT}))
+	assert.Equal(t, []uint64{10, 11}, seqs(t, j, EventFilter{Since: 9}))
+}
@@ -0,0 +1,441 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// Registry of the blocklist categories. Lets us add categories without a firmware update
+const blockcategoriesurl = "https://nearhop.sfo3.digitaloceanspaces.com/blockedurls/categories.json"
+
+const MAX_NUM_OF_FILTER_PROFILES = 16
+const MAX_NUM_OF_PROFILE_DOMAINS = 256
+
+var categoryNameRegexp = regexp.MustCompile("^[a-z0-9_-]{1,32}$")
+var domainRegexp = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}$`)
+
+type FilterProfile struct {
+	Name       string
+	Categories []string
+	Domains    []string
+	Clients    []string
+}
+
+// Blocklist categories and the filtering profiles of the clients
+type Filters struct {
+	sync.RWMutex
+	categories []messages.BlockCategoryInfo
+	profiles   []*FilterProfile
+}
+
+func defaultBlockCategories() []messages.BlockCategoryInfo {
+	categories := make([]messages.BlockCategoryInfo, len(messages.DefaultBlockCategories))
+	for i, name := range messages.DefaultBlockCategories {
+		categories[i] = messages.BlockCategoryInfo{Name: name}
+	}
+	return categories
+}
+
+func NewFilters() *Filters {
+	f := &Filters{
+		categories: defaultBlockCategories(),
+		profiles:   make([]*FilterProfile, 0),
+	}
+	return f
+}
+
+func validateCategories(categories []messages.BlockCategoryInfo) error {
+	if len(categories) == 0 || len(categories) > messages.MAX_NUM_OF_BLOCK_CATEGORIES {
+		return fmt.Errorf("Invalid number of blocklist categories %d", len(categories))
+	}
+	names := make(map[string]bool)
+	for _, category := range categories {
+		if !categoryNameRegexp.MatchString(category.Name) || names[category.Name] {
+			return fmt.Errorf("Invalid or duplicate blocklist category %s", category.Name)
+		}
+		names[category.Name] = true
+	}
+	return nil
+}
+
+// Loads the cached registry and the profiles
+func (f *Filters) read() error {
+	f.Lock()
+	defer f.Unlock()
+
+	content, err := nh_util.NH_read_file(DB_BLOCK_CATEGORIES_FILE)
+	if err == nil {
+		var categories []messages.BlockCategoryInfo
+		if json.Unmarshal(content, &categories) == nil && validateCategories(categories) == nil {
+			f.categories = categories
+		}
+	}
+	// No profiles unless the file has some
+	f.profiles = make([]*FilterProfile, 0)
+	content, err = nh_util.NH_read_file(DB_FILTER_PROFILES_FILE)
+	if err == nil {
+		var profiles []*FilterProfile
+		err = json.Unmarshal(content, &profiles)
+		if err != nil {
+			return err
+		}
+		f.profiles = profiles
+	}
+	return nil
+}
+
+// Fetches the category registry. The last good copy is kept when it fails
+func (f *Filters) refreshCategories() error {
+	content, err := nh_util.NH_http_get_req(blockcategoriesurl)
+	if err != nil {
+		return err
+	}
+	var categories []messages.BlockCategoryInfo
+	err = json.Unmarshal(content, &categories)
+	if err != nil {
+		return err
+	}
+	err = validateCategories(categories)
+	if err != nil {
+		return err
+	}
+	cbytes, err := json.Marshal(categories)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	f.categories = categories
+	err = nh_util.NH_dump_to_file(DB_BLOCK_CATEGORIES_FILE, cbytes, 0644)
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	return refreshCategoryDomains(categories)
+}
+
+func categoryDomainsFile(name string) string {
+	return DB_CATEGORY_DOMAINS_LOCATION + name
+}
+
+// Parses a domain list, one domain per line. Hosts file lines such as
+// "0.0.0.0 example.com" are accepted too. Blank lines and comments are skipped
+func parseDomainList(content string) []string {
+	domains := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		domain := strings.ToLower(fields[len(fields)-1])
+		if !domainRegexp.MatchString(domain) {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// Fetches the domain list of every category with a source into the cache
+// the platform script reads. Lists that fail keep their last good copy
+func refreshCategoryDomains(categories []messages.BlockCategoryInfo) error {
+	nh_util.NH_create_dir(DB_CATEGORY_DOMAINS_LOCATION, 0755)
+	known := make(map[string]bool)
+	failed := 0
+	for _, category := range categories {
+		if category.Source == "" {
+			continue
+		}
+		known[category.Name] = true
+		content, err := nh_util.NH_http_get_req(category.Source)
+		if err != nil {
+			failed++
+			continue
+		}
+		domains := parseDomainList(string(content))
+		if len(domains) == 0 {
+			failed++
+			continue
+		}
+		err = nh_util.NH_dump_to_file(categoryDomainsFile(category.Name), []byte(strings.Join(domains, "\n")+"\n"), 0644)
+		if err != nil {
+			failed++
+		}
+	}
+	// Lists of the categories dropped from the registry
+	files, _ := ioutil.ReadDir(DB_CATEGORY_DOMAINS_LOCATION)
+	for _, file := range files {
+		if !known[file.Name()] {
+			os.Remove(categoryDomainsFile(file.Name()))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d blocklist category lists failed to update", failed)
+	}
+	return nil
+}
+
+// Refreshes the registry and the domain lists of the categories and applies
+// the profiles again, so that the changes are picked up
+func (f *Filters) update() error {
+	err := f.refreshCategories()
+	f.Lock()
+	defer f.Unlock()
+	if len(f.profiles) > 0 {
+		if aerr := f.apply(); aerr != nil {
+			return aerr
+		}
+	}
+	return err
+}
+
+func (f *Filters) categoriesJson() ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return json.Marshal(f.categories)
+}
+
+// Called with the filters lock held
+func (f *Filters) hasCategory(name string) bool {
+	for _, category := range f.categories {
+		if category.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Called with the telemetry lock held, which is taken before the filters lock
+func (f *Filters) profileOfClient(mac string) string {
+	f.RLock()
+	defer f.RUnlock()
+	for _, profile := range f.profiles {
+		for _, c := range profile.Clients {
+			if c == mac {
+				return profile.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (f *Filters) profilesJson() ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	profiles := make([]messages.FilterProfileInfo, len(f.profiles))
+	for i, profile := range f.profiles {
+		profiles[i] = messages.FilterProfileInfo{
+			Name:       profile.Name,
+			Categories: profile.Categories,
+			Domains:    profile.Domains,
+			Clients:    profile.Clients,
+		}
+	}
+	return json.Marshal(profiles)
+}
+
+// Called with the filters lock held
+func (f *Filters) validateProfile(info messages.FilterProfileInfo, names map[string]bool, seen map[string]string) error {
+	if !feedNameRegexp.MatchString(info.Name) || names[info.Name] {
+		return fmt.Errorf("Invalid or duplicate filter profile name %s", info.Name)
+	}
+	names[info.Name] = true
+	for _, category := range info.Categories {
+		if !f.hasCategory(category) {
+			return fmt.Errorf("Unknown blocklist category %s", category)
+		}
+	}
+	if len(info.Domains) > MAX_NUM_OF_PROFILE_DOMAINS {
+		return fmt.Errorf("Too many domains in filter profile %s", info.Name)
+	}
+	for _, domain := range info.Domains {
+		if !domainRegexp.MatchString(domain) {
+			return fmt.Errorf("Invalid domain %s", domain)
+		}
+	}
+	for _, mac := range info.Clients {
+		if seen[mac] != "" {
+			return fmt.Errorf("Client %s is in filter profiles %s and %s", mac, seen[mac], info.Name)
+		}
+		seen[mac] = info.Name
+	}
+	return nil
+}
+
+// The config for the platform script. One line per setting:
+//
+//	category <name> <file with the domains of the category>
+//	profile <name> <category,...>
+//	domain <profile> <domain>
+//	client <mac> <profile>
+//
+// Called with the filters lock held
+func (f *Filters) config() string {
+	var b strings.Builder
+	used := make(map[string]bool)
+	for _, profile := range f.profiles {
+		for _, category := range profile.Categories {
+			used[category] = true
+		}
+	}
+	for _, category := range f.categories {
+		if !used[category.Name] {
+			continue
+		}
+		if _, err := os.Stat(categoryDomainsFile(category.Name)); err == nil {
+			fmt.Fprintf(&b, "category %s %s\n", category.Name, categoryDomainsFile(category.Name))
+		}
+	}
+	for _, profile := range f.profiles {
+		categories := strings.Join(profile.Categories, ",")
+		if categories == "" {
+			categories = "-"
+		}
+		fmt.Fprintf(&b, "profile %s %s\n", profile.Name, categories)
+		for _, domain := range profile.Domains {
+			fmt.Fprintf(&b, "domain %s %s\n", profile.Name, strings.ToLower(domain))
+		}
+		for _, mac := range profile.Clients {
+			fmt.Fprintf(&b, "client %s %s\n", strings.ToLower(mac), profile.Name)
+		}
+	}
+	return b.String()
+}
+
+// Hands the profiles over to the platform's DNS filtering
+// Called with the filters lock held
+func (f *Filters) apply() error {
+	err := nh_util.NH_dump_to_file(DB_FILTER_CONFIG_FILE, []byte(f.config()), 0644)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(applyFilterProfilesScript, DB_FILTER_CONFIG_FILE).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error while applying the filter profiles: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Called with the filters lock held
+func (f *Filters) dump() error {
+	pbytes, err := json.Marshal(f.profiles)
+	if err != nil {
+		return err
+	}
+	return nh_util.NH_dump_to_file(DB_FILTER_PROFILES_FILE, pbytes, 0644)
+}
+
+// Moves the clients into the profile and out of any other. An empty profile
+// leaves them unfiltered
+func (f *Filters) setClientsProfile(macs []string, profile string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	var target *FilterProfile
+	for _, p := range f.profiles {
+		if p.Name == profile {
+			target = p
+		}
+	}
+	if profile != "" && target == nil {
+		return fmt.Errorf("No such filter profile %s", profile)
+	}
+	move := make(map[string]bool)
+	for _, mac := range macs {
+		move[mac] = true
+	}
+	for _, p := range f.profiles {
+		clients := make([]string, 0, len(p.Clients))
+		for _, mac := range p.Clients {
+			if !move[mac] {
+				clients = append(clients, mac)
+			}
+		}
+		p.Clients = clients
+	}
+	if target != nil {
+		target.Clients = append(target.Clients, macs...)
+	}
+	err := f.dump()
+	if err != nil {
+		return err
+	}
+	return f.apply()
+}
+
+// Replaces all the profiles. clients are the MACs of the known clients and
+// used the profiles groups refer to, with the name of the group
+func (f *Filters) setProfiles(infos []messages.FilterProfileInfo, clients map[string]bool, used map[string]string) string {
+	if len(infos) > MAX_NUM_OF_FILTER_PROFILES {
+		return nh_util.NH_getErrorStatusString("Maximum number of filter profiles reached")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	names := make(map[string]bool)
+	seen := make(map[string]string)
+	profiles := make([]*FilterProfile, 0, len(infos))
+	for _, info := range infos {
+		err := f.validateProfile(info, names, seen)
+		if err != nil {
+			return nh_util.NH_getErrorStatusString(err.Error())
+		}
+		for _, mac := range info.Clients {
+			if !clients[mac] {
+				return nh_util.NH_getErrorStatusString("No such client " + mac)
+			}
+		}
+		profiles = append(profiles, &FilterProfile{
+			Name:       info.Name,
+			Categories: info.Categories,
+			Domains:    info.Domains,
+			Clients:    info.Clients,
+		})
+	}
+	for profile, group := range used {
+		if !names[profile] {
+			return nh_util.NH_getErrorStatusString("Filter profile " + profile + " is used by group " + group)
+		}
+	}
+	old := f.profiles
+	f.profiles = profiles
+	err := f.dump()
+	if err != nil {
+		f.profiles = old
+		return nh_util.NH_getErrorStatusString("Error while saving filter profiles")
+	}
+	err = f.apply()
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	return ""
+}
+
+// Replaces the profiles. A profile a group uses can't be removed
+func (tel *Telemetry) setFilterProfiles(infos []messages.FilterProfileInfo) string {
+	tel.Lock()
+	defer tel.Unlock()
+	used := make(map[string]string)
+	for _, group := range tel.groups {
+		if group.Profile != "" {
+			used[group.Profile] = group.Name
+		}
+	}
+	return tel.Filters.setProfiles(infos, tel.clientMacs(), used)
+}
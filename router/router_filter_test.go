@@ -0,0 +1,76 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	messages "messages"
+	nh_util "nh_util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDomainList(t *testing.T) {
+	content := "# tiktok\n0.0.0.0 TikTok.com\nbyteoversea.com ! mirror\n\nnot a domain\n*.tiktokv.com\n"
+	assert.Equal(t, []string{"tiktok.com", "byteoversea.com", "*.tiktokv.com"}, parseDomainList(content))
+}
+
+func TestRefreshCategoryDomains(t *testing.T) {
+	newSimRouter(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tiktok" {
+			w.Write([]byte("tiktok.com\n"))
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	assert.Nil(t, nh_util.NH_create_dir(DB_CATEGORY_DOMAINS_LOCATION, 0755))
+	assert.Nil(t, nh_util.NH_dump_to_file(categoryDomainsFile("dropped"), []byte("example.com\n"), 0644))
+	assert.Nil(t, nh_util.NH_dump_to_file(categoryDomainsFile("youtube"), []byte("youtube.com\n"), 0644))
+
+	// The list that fails keeps its last good copy, the dropped category goes
+	err := refreshCategoryDomains([]messages.BlockCategoryInfo{
+		{Name: "tiktok", Source: server.URL + "/tiktok"},
+		{Name: "youtube", Source: server.URL + "/youtube"},
+	})
+	assert.NotNil(t, err)
+	content, err := nh_util.NH_read_file(categoryDomainsFile("tiktok"))
+	assert.Nil(t, err)
+	assert.Equal(t, "tiktok.com\n", string(content))
+	assert.FileExists(t, categoryDomainsFile("youtube"))
+	assert.NoFileExists(t, categoryDomainsFile("dropped"))
+}
+
+func TestFilterProfiles(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	assert.Nil(t, nh_util.NH_create_dir(DB_CATEGORY_DOMAINS_LOCATION, 0755))
+	assert.Nil(t, nh_util.NH_dump_to_file(categoryDomainsFile("tiktok"), []byte("tiktok.com\n"), 0644))
+
+	kids := messages.FilterProfileInfo{Name: "kids", Categories: []string{"tiktok"}, Domains: []string{"Example.com"}, Clients: []string{testMac}}
+	assert.Equal(t, "", rs.tel.setFilterProfiles([]messages.FilterProfileInfo{kids}))
+	content, err := nh_util.NH_read_file(DB_FILTER_CONFIG_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, "category tiktok "+categoryDomainsFile("tiktok")+"\n"+
+		"profile kids tiktok\n"+
+		"domain kids example.com\n"+
+		"client "+testMac+" kids\n", string(content))
+	assert.Equal(t, "kids", rs.tel.Filters.profileOfClient(testMac))
+
+	// A client is in one profile at most, categories and clients must exist
+	other := messages.FilterProfileInfo{Name: "other", Clients: []string{testMac}}
+	assert.NotEqual(t, "", rs.tel.setFilterProfiles([]messages.FilterProfileInfo{kids, other}))
+	other = messages.FilterProfileInfo{Name: "other", Categories: []string{"nosuch"}}
+	assert.NotEqual(t, "", rs.tel.setFilterProfiles([]messages.FilterProfileInfo{other}))
+	other = messages.FilterProfileInfo{Name: "other", Clients: []string{"02:00:00:00:00:99"}}
+	assert.NotEqual(t, "", rs.tel.setFilterProfiles([]messages.FilterProfileInfo{other}))
+	assert.Equal(t, "kids", rs.tel.Filters.profileOfClient(testMac))
+
+	assert.Nil(t, rs.tel.Filters.setClientsProfile([]string{testMac}, ""))
+	assert.Equal(t, "", rs.tel.Filters.profileOfClient(testMac))
+}
@@ -0,0 +1,222 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	messages "messages"
+)
+
+const FLOW_PERIOD_HOUR = "hour"
+const FLOW_PERIOD_DAY = "day"
+
+// The last hour is kept in 5 minute buckets and the last day in hourly ones
+const FLOW_MINUTE_BUCKET = 5 * 60
+const MAX_FLOW_MINUTE_BUCKETS = 12
+const MAX_FLOW_HOUR_BUCKETS = 24
+
+// Destinations per bucket. Traffic to the rest is added up as other
+const MAX_FLOWS_PER_BUCKET = 64
+
+const FLOWS_DEFAULT_COUNT = 20
+
+type FlowStat struct {
+	Ip       string
+	Port     int
+	Proto    int
+	Host     string
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+type flowBucket struct {
+	Tstamp int64
+	Flows  map[string]*FlowStat
+	Other  FlowStat
+}
+
+// Where the traffic of a client went. Kept in memory only
+type ClientFlows struct {
+	MACAddress string
+	Minutes    []*flowBucket
+	Hours      []*flowBucket
+}
+
+func flowKey(con Con) string {
+	return fmt.Sprintf("%s/%d/%d", con.R_ip, con.R_port, con.Proto)
+}
+
+func conBytes(con Con) (uint64, uint64) {
+	var bytesin uint64
+	var bytesout uint64
+	for _, b := range con.B_in {
+		if b > 0 {
+			bytesin += uint64(b)
+		}
+	}
+	for _, b := range con.B_out {
+		if b > 0 {
+			bytesout += uint64(b)
+		}
+	}
+	return bytesin, bytesout
+}
+
+// Returns the bucket starting at tstamp. A new bucket is appended when tstamp
+// moves on and the oldest ones are dropped beyond max buckets
+func flowBucketAt(buckets []*flowBucket, tstamp int64, max int) ([]*flowBucket, *flowBucket) {
+	last := len(buckets) - 1
+	if last >= 0 && buckets[last].Tstamp == tstamp {
+		return buckets, buckets[last]
+	}
+	b := &flowBucket{Tstamp: tstamp, Flows: make(map[string]*FlowStat)}
+	buckets = append(buckets, b)
+	if len(buckets) > max {
+		buckets = buckets[len(buckets)-max:]
+	}
+	return buckets, b
+}
+
+func (b *flowBucket) add(key string, con Con, host string, bytesin uint64, bytesout uint64) {
+	stat := b.Flows[key]
+	if stat == nil {
+		if len(b.Flows) >= MAX_FLOWS_PER_BUCKET {
+			b.Other.BytesIn += bytesin
+			b.Other.BytesOut += bytesout
+			return
+		}
+		stat = &FlowStat{Ip: con.R_ip, Port: con.R_port, Proto: con.Proto}
+		b.Flows[key] = stat
+	}
+	if host != "" {
+		stat.Host = host
+	}
+	stat.BytesIn += bytesin
+	stat.BytesOut += bytesout
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) updateFlows(device Device, now time.Time) {
+	if tel.RouterClients[device.Mac] == nil {
+		return
+	}
+	cf := tel.flows[device.Mac]
+	for _, con := range device.Conn {
+		bytesin, bytesout := conBytes(con)
+		if bytesin == 0 && bytesout == 0 {
+			continue
+		}
+		if cf == nil {
+			cf = &ClientFlows{MACAddress: device.Mac}
+			tel.flows[device.Mac] = cf
+		}
+		var minute, hour *flowBucket
+		cf.Minutes, minute = flowBucketAt(cf.Minutes, now.Unix()-now.Unix()%FLOW_MINUTE_BUCKET, MAX_FLOW_MINUTE_BUCKETS)
+		cf.Hours, hour = flowBucketAt(cf.Hours, now.Truncate(time.Hour).Unix(), MAX_FLOW_HOUR_BUCKETS)
+		key := flowKey(con)
+		host := tel.dnsName(con.R_ip)
+		minute.add(key, con, host, bytesin, bytesout)
+		hour.add(key, con, host, bytesin, bytesout)
+	}
+}
+
+// The count top destinations over the period, the rest is added up as other
+func (cf *ClientFlows) info(period string, count int, now int64) (messages.ClientFlowsInfo, error) {
+	var buckets []*flowBucket
+	var since int64
+	switch period {
+	case FLOW_PERIOD_HOUR:
+		buckets = cf.Minutes
+		since = now - 60*60
+	case FLOW_PERIOD_DAY:
+		buckets = cf.Hours
+		since = now - 24*60*60
+	default:
+		return messages.ClientFlowsInfo{}, fmt.Errorf("Unknown flows period %s", period)
+	}
+
+	info := messages.ClientFlowsInfo{
+		MACAddress:   cf.MACAddress,
+		Period:       period,
+		Destinations: make([]messages.FlowDestinationInfo, 0),
+	}
+	flows := make(map[string]*messages.FlowDestinationInfo)
+	for _, b := range buckets {
+		if b.Tstamp < since {
+			continue
+		}
+		for key, stat := range b.Flows {
+			dest := flows[key]
+			if dest == nil {
+				dest = &messages.FlowDestinationInfo{Ip: stat.Ip, Port: stat.Port, Proto: stat.Proto}
+				flows[key] = dest
+			}
+			if stat.Host != "" {
+				dest.Host = stat.Host
+			}
+			dest.BytesIn += stat.BytesIn
+			dest.BytesOut += stat.BytesOut
+		}
+		info.Other.BytesIn += b.Other.BytesIn
+		info.Other.BytesOut += b.Other.BytesOut
+	}
+	for _, dest := range flows {
+		info.Destinations = append(info.Destinations, *dest)
+	}
+	sort.Slice(info.Destinations, func(i, j int) bool {
+		return info.Destinations[i].BytesIn+info.Destinations[i].BytesOut > info.Destinations[j].BytesIn+info.Destinations[j].BytesOut
+	})
+	info.BytesIn = info.Other.BytesIn
+	info.BytesOut = info.Other.BytesOut
+	for i, dest := range info.Destinations {
+		if i >= count {
+			info.Other.BytesIn += dest.BytesIn
+			info.Other.BytesOut += dest.BytesOut
+		}
+		info.BytesIn += dest.BytesIn
+		info.BytesOut += dest.BytesOut
+	}
+	if len(info.Destinations) > count {
+		info.Destinations = info.Destinations[:count]
+	}
+	return info, nil
+}
+
+func (tel *Telemetry) clientFlowsJson(mac string, period string, count int) ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	if period == "" {
+		period = FLOW_PERIOD_HOUR
+	}
+	if count <= 0 {
+		count = FLOWS_DEFAULT_COUNT
+	}
+	now := time.Now().Unix()
+	flows := make([]messages.ClientFlowsInfo, 0)
+	for _, cf := range tel.flows {
+		if mac != "all" && mac != cf.MACAddress {
+			continue
+		}
+		info, err := cf.info(period, count, now)
+		if err != nil {
+			return nil, err
+		}
+		if client := tel.RouterClients[cf.MACAddress]; client != nil {
+			info.Name = client.Name
+		}
+		flows = append(flows, info)
+	}
+	if mac != "all" && len(flows) == 0 && tel.RouterClients[mac] == nil {
+		return nil, fmt.Errorf("Received a flows request for a client that does n't exist")
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].BytesIn+flows[i].BytesOut > flows[j].BytesIn+flows[j].BytesOut
+	})
+	return json.Marshal(flows)
+}
@@ -0,0 +1,76 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const quietMac = "02:00:00:10:20:09"
+
+func newFlowsRouter(t *testing.T) *RouterServer {
+	rs, sim := newSimRouter(t)
+	// Only the connections of the test go into its flows
+	sim.AddClient(SimClient{Mac: quietMac, Ip: "192.168.1.109", Name: "Quiet", Radio: "wl1", Rssi: -50})
+	assert.Nil(t, sim.Tick())
+	return rs
+}
+
+func addFlow(rs *RouterServer, ip string, port int, bytes int, now time.Time) {
+	rs.tel.Lock()
+	defer rs.tel.Unlock()
+	con := Con{R_ip: ip, R_port: port, Proto: 6, B_in: []int{bytes}, B_out: []int{bytes / 10}}
+	rs.tel.updateFlows(Device{Mac: quietMac, Conn: []Con{con}}, now)
+}
+
+func getFlows(t *testing.T, rs *RouterServer, period string, count int) messages.ClientFlowsInfo {
+	fbytes, err := rs.tel.clientFlowsJson(quietMac, period, count)
+	assert.Nil(t, err)
+	var flows []messages.ClientFlowsInfo
+	assert.Nil(t, json.Unmarshal(fbytes, &flows))
+	assert.Len(t, flows, 1)
+	return flows[0]
+}
+
+func TestFlowsTopDestinations(t *testing.T) {
+	rs := newFlowsRouter(t)
+	rs.tel.Lock()
+	rs.tel.dnsNames["142.250.185.78"] = "www.youtube.com"
+	rs.tel.Unlock()
+	now := time.Now()
+	addFlow(rs, "142.250.185.78", 443, 9000, now)
+	addFlow(rs, "142.250.185.78", 443, 1000, now)
+	addFlow(rs, "157.240.20.35", 443, 5000, now)
+	addFlow(rs, "203.0.113.10", 123, 100, now)
+
+	flows := getFlows(t, rs, FLOW_PERIOD_HOUR, 2)
+	assert.Equal(t, "Quiet", flows.Name)
+	assert.Len(t, flows.Destinations, 2)
+	assert.Equal(t, "www.youtube.com", flows.Destinations[0].Host)
+	assert.Equal(t, uint64(10000), flows.Destinations[0].BytesIn)
+	assert.Equal(t, "157.240.20.35", flows.Destinations[1].Ip)
+	// The rest is added up as other
+	assert.Equal(t, uint64(100), flows.Other.BytesIn)
+	assert.Equal(t, uint64(15100), flows.BytesIn)
+
+	_, err := rs.tel.clientFlowsJson(quietMac, "week", 0)
+	assert.NotNil(t, err)
+}
+
+func TestFlowsPeriods(t *testing.T) {
+	rs := newFlowsRouter(t)
+	now := time.Now()
+	addFlow(rs, "157.240.20.35", 443, 5000, now.Add(-2*time.Hour))
+	addFlow(rs, "142.250.185.78", 443, 1000, now)
+
+	// Traffic of two hours ago is in the day, not in the last hour
+	assert.Equal(t, uint64(1000), getFlows(t, rs, FLOW_PERIOD_HOUR, 0).BytesIn)
+	assert.Equal(t, uint64(6000), getFlows(t, rs, FLOW_PERIOD_DAY, 0).BytesIn)
+}
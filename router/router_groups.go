@@ -0,0 +1,323 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"sort"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const MAX_NUM_OF_GROUPS = 16
+const GROUP_NAME_MAX_LENGTH = 32
+
+// Named set of clients, e.g. Kids or IoT. Members are the clients whose Group
+// is the name. The policy of the group is applied to every member and to
+// clients assigned to the group later
+type ClientGroup struct {
+	Name      string
+	Paused    bool
+	Schedules []Schedule
+	// Filtering profile of the members, empty for none
+	Profile string
+}
+
+func (tel *Telemetry) readGroups() {
+	content, err := nh_util.NH_read_file(DB_GROUPS_FILE)
+	if err != nil {
+		return
+	}
+	var groups []*ClientGroup
+	err = json.Unmarshal(content, &groups)
+	if err != nil {
+		tel.l.Error("Error while unmarshalling client groups", err)
+		return
+	}
+	for _, group := range groups {
+		tel.groups[group.Name] = group
+	}
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) dumpGroups() error {
+	groups := make([]*ClientGroup, 0, len(tel.groups))
+	for _, group := range tel.groups {
+		groups = append(groups, group)
+	}
+	gbytes, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+	return nh_util.NH_dump_to_file(DB_GROUPS_FILE, gbytes, 0644)
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) groupMembers(name string) []*RouterClient {
+	members := make([]*RouterClient, 0)
+	for mac, client := range tel.RouterClients {
+		if mac == client.MACAddress && client.Group == name {
+			members = append(members, client)
+		}
+	}
+	return members
+}
+
+// Only a pause the group holds is lifted. Clients paused by hand or still
+// held by a schedule, a quota or the quarantine stay paused
+// Called with the telemetry lock held
+func (tel *Telemetry) pauseMember(client *RouterClient, pause bool) {
+	if pause {
+		if client.Paused {
+			// Joins a pause held by a schedule, a quota or the quarantine.
+			// A pause made by hand is left alone
+			client.GroupHeld = client.GroupHeld || client.pausedAutomatically()
+			return
+		}
+		client.GroupHeld = true
+	} else {
+		held := client.GroupHeld
+		client.GroupHeld = false
+		if !held || !client.Paused || client.pausedAutomatically() {
+			return
+		}
+	}
+	client.Paused = pause
+	pauseClient(client.MACAddress, client.IPAddress, client.Name, pause)
+}
+
+// Gives the client the schedules of the group, keeping its own to give them
+// back when it leaves. Called with the telemetry lock held
+func (client *RouterClient) adoptGroupSchedules(schedules []Schedule) {
+	if !client.GroupSchedules {
+		client.OwnSchedules = client.Schedules
+		client.GroupSchedules = true
+	}
+	client.Schedules = append([]Schedule{}, schedules...)
+}
+
+// Called with the telemetry lock held
+func (client *RouterClient) dropGroupSchedules() {
+	if !client.GroupSchedules {
+		return
+	}
+	client.Schedules = client.OwnSchedules
+	client.OwnSchedules = nil
+	client.GroupSchedules = false
+}
+
+// Brings the client in line with the policy of its group
+// Called with the telemetry lock held
+func (tel *Telemetry) applyGroupPolicy(client *RouterClient, group *ClientGroup) error {
+	if group.Paused {
+		tel.pauseMember(client, true)
+	}
+	if len(group.Schedules) > 0 {
+		client.adoptGroupSchedules(group.Schedules)
+	}
+	err := dumpClientStats(client)
+	if err != nil {
+		return err
+	}
+	if group.Profile != "" {
+		return tel.Filters.setClientsProfile([]string{client.MACAddress}, group.Profile)
+	}
+	return nil
+}
+
+// Undoes the pause, the schedules and the filtering profile the group put on
+// the client. Called with the telemetry lock held
+func (tel *Telemetry) leaveGroup(client *RouterClient, group *ClientGroup) error {
+	tel.pauseMember(client, false)
+	client.dropGroupSchedules()
+	if group.Profile != "" && tel.Filters.profileOfClient(client.MACAddress) == group.Profile {
+		return tel.Filters.setClientsProfile([]string{client.MACAddress}, "")
+	}
+	return nil
+}
+
+func (tel *Telemetry) groupsJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	groups := make([]messages.ClientGroupInfo, 0, len(tel.groups))
+	for _, group := range tel.groups {
+		info := messages.ClientGroupInfo{
+			Name:      group.Name,
+			Paused:    group.Paused,
+			Schedules: scheduleInfos(group.Schedules),
+			Profile:   group.Profile,
+			Clients:   make([]string, 0),
+		}
+		for _, client := range tel.groupMembers(group.Name) {
+			info.Clients = append(info.Clients, client.MACAddress)
+		}
+		sort.Strings(info.Clients)
+		groups = append(groups, info)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return json.Marshal(groups)
+}
+
+func (tel *Telemetry) createGroup(name string) string {
+	if name == "" || len(name) > GROUP_NAME_MAX_LENGTH {
+		return nh_util.NH_getErrorStatusString("Invalid group name")
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	if tel.groups[name] != nil {
+		return nh_util.NH_getErrorStatusString("Group " + name + " already exists")
+	}
+	if len(tel.groups) >= MAX_NUM_OF_GROUPS {
+		return nh_util.NH_getErrorStatusString("Maximum number of groups reached")
+	}
+	tel.groups[name] = &ClientGroup{Name: name, Schedules: make([]Schedule, 0)}
+	err := tel.dumpGroups()
+	if err != nil {
+		tel.l.Error("Error while saving client groups", err)
+		return nh_util.NH_getErrorStatusString("Error while saving client groups")
+	}
+	return ""
+}
+
+// The members are left in no group. Their pause and schedules stay as they
+// are and become their own
+func (tel *Telemetry) deleteGroup(name string) string {
+	tel.Lock()
+	defer tel.Unlock()
+	if tel.groups[name] == nil {
+		return nh_util.NH_getErrorStatusString("No such group " + name)
+	}
+	for _, client := range tel.groupMembers(name) {
+		client.Group = ""
+		client.GroupHeld = false
+		client.GroupSchedules = false
+		client.OwnSchedules = nil
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (group) the client details", client.MACAddress)
+		}
+	}
+	delete(tel.groups, name)
+	err := tel.dumpGroups()
+	if err != nil {
+		tel.l.Error("Error while saving client groups", err)
+		return nh_util.NH_getErrorStatusString("Error while saving client groups")
+	}
+	return ""
+}
+
+// Moves the clients into the group, or out of any group for an empty name.
+// Clients leaving a group are taken out of its pause, schedules and filtering
+// profile
+func (tel *Telemetry) assignGroup(name string, macs []string) string {
+	tel.Lock()
+	defer tel.Unlock()
+
+	group := tel.groups[name]
+	if name != "" && group == nil {
+		return nh_util.NH_getErrorStatusString("No such group " + name)
+	}
+	for _, mac := range macs {
+		if tel.RouterClients[mac] == nil {
+			return nh_util.NH_getErrorStatusString("No such client " + mac)
+		}
+	}
+	for _, mac := range macs {
+		client := tel.RouterClients[mac]
+		var err error
+		if old := tel.groups[client.Group]; old != nil && old != group {
+			err = tel.leaveGroup(client, old)
+			if err != nil {
+				tel.l.WithField("mac", mac).Error("Error while taking the client out of its group ", err)
+				return nh_util.NH_getErrorStatusString(err.Error())
+			}
+		}
+		client.Group = name
+		if group != nil {
+			err = tel.applyGroupPolicy(client, group)
+		} else {
+			err = dumpClientStats(client)
+		}
+		if err != nil {
+			tel.l.WithField("mac", mac).Error("Error while assigning the client group ", err)
+			return nh_util.NH_getErrorStatusString(err.Error())
+		}
+	}
+	return ""
+}
+
+// Pauses or unpauses every member of the group. Clients joining a paused group are paused
+func (tel *Telemetry) pauseGroup(name string, pause bool) string {
+	tel.Lock()
+	defer tel.Unlock()
+
+	group := tel.groups[name]
+	if group == nil {
+		return nh_util.NH_getErrorStatusString("No such group " + name)
+	}
+	group.Paused = pause
+	for _, client := range tel.groupMembers(name) {
+		tel.pauseMember(client, pause)
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (group pause) the client details", client.MACAddress)
+		}
+	}
+	err := tel.dumpGroups()
+	if err != nil {
+		tel.l.Error("Error while saving client groups", err)
+		return nh_util.NH_getErrorStatusString("Error while saving client groups")
+	}
+	return ""
+}
+
+// Sets the schedules and the filtering profile of the group and of its members
+func (tel *Telemetry) setGroupPolicy(info messages.GroupPolicyInnerMessage) string {
+	schedules, err := parseSchedules(info.Schedules)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	group := tel.groups[info.Name]
+	if group == nil {
+		return nh_util.NH_getErrorStatusString("No such group " + info.Name)
+	}
+	members := tel.groupMembers(info.Name)
+	macs := make([]string, len(members))
+	for i, client := range members {
+		macs[i] = client.MACAddress
+	}
+	if info.Profile != "" || group.Profile != "" {
+		err = tel.Filters.setClientsProfile(macs, info.Profile)
+		if err != nil {
+			return nh_util.NH_getErrorStatusString(err.Error())
+		}
+	}
+	group.Schedules = schedules
+	group.Profile = info.Profile
+	for _, client := range members {
+		if len(schedules) > 0 {
+			client.adoptGroupSchedules(schedules)
+		} else {
+			client.dropGroupSchedules()
+		}
+		err = dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (group policy) the client details", client.MACAddress)
+		}
+	}
+	err = tel.dumpGroups()
+	if err != nil {
+		tel.l.Error("Error while saving client groups", err)
+		return nh_util.NH_getErrorStatusString("Error while saving client groups")
+	}
+	return ""
+}
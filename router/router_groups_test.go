@@ -0,0 +1,97 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGroupRouter(t *testing.T) (*RouterServer, *Simulator) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	assert.Equal(t, "", rs.tel.createGroup("kids"))
+	return rs, sim
+}
+
+func clientSchedules(rs *RouterServer, mac string) []Schedule {
+	rs.tel.RLock()
+	defer rs.tel.RUnlock()
+	return rs.tel.RouterClients[mac].Schedules
+}
+
+func TestGroupPause(t *testing.T) {
+	rs, sim := newGroupRouter(t)
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", true))
+	assert.True(t, sim.Paused(testMac))
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", false))
+	assert.False(t, sim.Paused(testMac))
+
+	// Leaving a paused group unpauses the client, joining one pauses it
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", true))
+	assert.Equal(t, "", rs.tel.assignGroup("", []string{testMac}))
+	assert.False(t, sim.Paused(testMac))
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestGroupKeepsManualPause(t *testing.T) {
+	rs, sim := newGroupRouter(t)
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, true))
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", true))
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", false))
+	assert.True(t, sim.Paused(testMac))
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", true))
+	assert.Equal(t, "", rs.tel.assignGroup("", []string{testMac}))
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestGroupSchedules(t *testing.T) {
+	rs, _ := newGroupRouter(t)
+	own := []messages.ScheduleInfo{{Days: everyDay, Start: "12:00", End: "13:00"}}
+	assert.Equal(t, "", rs.tel.setSchedules(testMac, own))
+	bedtime := []messages.ScheduleInfo{{Days: everyDay, Start: "21:00", End: "07:00"}}
+	assert.Equal(t, "", rs.tel.setGroupPolicy(messages.GroupPolicyInnerMessage{Name: "kids", Schedules: bedtime}))
+
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+	assert.Equal(t, "21:00", clientSchedules(rs, testMac)[0].Start)
+	// The client gets its own schedules back when it leaves
+	assert.Equal(t, "", rs.tel.assignGroup("", []string{testMac}))
+	assert.Equal(t, "12:00", clientSchedules(rs, testMac)[0].Start)
+
+	// And when the group drops its schedules
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+	assert.Equal(t, "", rs.tel.setGroupPolicy(messages.GroupPolicyInnerMessage{Name: "kids"}))
+	assert.Equal(t, "12:00", clientSchedules(rs, testMac)[0].Start)
+
+	// Schedules set by hand in the group are kept when it leaves
+	assert.Equal(t, "", rs.tel.setGroupPolicy(messages.GroupPolicyInnerMessage{Name: "kids", Schedules: bedtime}))
+	assert.Equal(t, "", rs.tel.setSchedules(testMac, []messages.ScheduleInfo{{Days: everyDay, Start: "18:00", End: "19:00"}}))
+	assert.Equal(t, "", rs.tel.assignGroup("", []string{testMac}))
+	assert.Equal(t, "18:00", clientSchedules(rs, testMac)[0].Start)
+}
+
+func TestGroupScheduleWindow(t *testing.T) {
+	rs, sim := newGroupRouter(t)
+	bedtime := []messages.ScheduleInfo{{Days: everyDay, Start: "21:00", End: "07:00"}}
+	assert.Equal(t, "", rs.tel.setGroupPolicy(messages.GroupPolicyInnerMessage{Name: "kids", Schedules: bedtime}))
+	assert.Equal(t, "", rs.tel.assignGroup("kids", []string{testMac}))
+
+	// The group pause and the window hold the client together
+	rs.tel.applySchedules(inBedtime)
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", true))
+	rs.tel.applySchedules(afterBedtime)
+	assert.True(t, sim.Paused(testMac))
+	assert.Equal(t, "", rs.tel.pauseGroup("kids", false))
+	assert.False(t, sim.Paused(testMac))
+}
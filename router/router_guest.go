@@ -0,0 +1,283 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const (
+	GUEST_EXPIRY_DISABLE = "disable"
+	GUEST_EXPIRY_ROTATE  = "rotate"
+)
+
+const MAX_NUM_OF_GUEST_PASSES = 32
+const GUEST_PASS_MIN_DURATION = 5 * 60
+const GUEST_PASS_MAX_DURATION = 30 * 24 * 60 * 60
+const GUEST_KEY_LENGTH = 12
+
+// No 0/O or 1/l/I. The key is often typed in from a screen
+const guestKeyAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+type GuestPass struct {
+	Id      string
+	Name    string
+	Created int64
+	Expires int64
+}
+
+// All the passes share the key of the guest network. Revoking a pass
+// rotates the key for the remaining ones
+type GuestPasses struct {
+	sync.Mutex
+	OnExpiry string
+	Passes   []*GuestPass
+}
+
+func randomGuestKey() (string, error) {
+	key := make([]byte, GUEST_KEY_LENGTH)
+	max := big.NewInt(int64(len(guestKeyAlphabet)))
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		key[i] = guestKeyAlphabet[n.Int64()]
+	}
+	return string(key), nil
+}
+
+func randomPassId() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Escapes the special characters of the WIFI: QR code format
+func qrEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`)
+	return r.Replace(s)
+}
+
+func guestSsid(settings *messages.InnerMessage) string {
+	for _, ssid := range []string{settings.Gssid2, settings.Gssid5, settings.Gssid52} {
+		if ssid != "" {
+			return ssid
+		}
+	}
+	return ""
+}
+
+func guestQr(settings *messages.InnerMessage) string {
+	if settings.Gencryption == "none" || settings.Gencryption == "open" {
+		return "WIFI:T:nopass;S:" + qrEscape(guestSsid(settings)) + ";;"
+	}
+	return "WIFI:T:WPA;S:" + qrEscape(guestSsid(settings)) + ";P:" + qrEscape(settings.Gkey2) + ";;"
+}
+
+func readGuestPasses() *GuestPasses {
+	gp := &GuestPasses{OnExpiry: GUEST_EXPIRY_DISABLE, Passes: make([]*GuestPass, 0)}
+	content, err := nh_util.NH_read_file(DB_GUEST_PASSES_FILE)
+	if err != nil {
+		return gp
+	}
+	json.Unmarshal(content, gp)
+	return gp
+}
+
+// Called with the guest passes lock held
+func (gp *GuestPasses) dump() error {
+	gbytes, err := json.Marshal(gp)
+	if err != nil {
+		return err
+	}
+	return nh_util.NH_dump_to_file(DB_GUEST_PASSES_FILE, gbytes, 0600)
+}
+
+// Sets a new key on all the guest VAPs and enables or disables them
+func setGuestNetwork(enable bool, rotate bool) (*messages.InnerMessage, error) {
+	var settings messages.InnerMessage
+	err := messages.Get_wireless_message(&settings)
+	if err != nil {
+		return nil, err
+	}
+	if rotate {
+		key, err := randomGuestKey()
+		if err != nil {
+			return nil, err
+		}
+		settings.Gkey2 = key
+		settings.Gkey5 = key
+		settings.Gkey52 = key
+	}
+	disabled := "1"
+	if enable {
+		disabled = "0"
+	}
+	settings.Gdisabled2 = disabled
+	settings.Gdisabled5 = disabled
+	if settings.Gssid52 != "" {
+		settings.Gdisabled52 = disabled
+	}
+	status := messages.Set_wireless(settings)
+	var result map[string]interface{}
+	if json.Unmarshal([]byte(status), &result) == nil && result["status"] == "fail" {
+		return nil, fmt.Errorf("%v", result["error"])
+	}
+	return &settings, nil
+}
+
+func passInfo(pass *GuestPass, settings *messages.InnerMessage) messages.GuestPassInfo {
+	return messages.GuestPassInfo{
+		Id:      pass.Id,
+		Name:    pass.Name,
+		Created: pass.Created,
+		Expires: pass.Expires,
+		Ssid:    guestSsid(settings),
+		Key:     settings.Gkey2,
+		Qr:      guestQr(settings),
+	}
+}
+
+// Called with the guest passes lock held
+func (gp *GuestPasses) active(now int64) []*GuestPass {
+	active := make([]*GuestPass, 0)
+	for _, pass := range gp.Passes {
+		if pass.Expires > now {
+			active = append(active, pass)
+		}
+	}
+	return active
+}
+
+// The first pass gets a fresh key and turns the guest network on. Later ones share that key
+func (gp *GuestPasses) create(req messages.GuestPassInnerMessage) (string, error) {
+	if req.Duration < GUEST_PASS_MIN_DURATION || req.Duration > GUEST_PASS_MAX_DURATION {
+		return "", fmt.Errorf("Guest pass duration must be %d to %d seconds", GUEST_PASS_MIN_DURATION, GUEST_PASS_MAX_DURATION)
+	}
+	if len(req.Name) > CLIENT_NAME_MAX_LENGTH {
+		return "", fmt.Errorf("Guest pass name is too long")
+	}
+	switch req.OnExpiry {
+	case "", GUEST_EXPIRY_DISABLE, GUEST_EXPIRY_ROTATE:
+	default:
+		return "", fmt.Errorf("Invalid guest pass expiry action %s", req.OnExpiry)
+	}
+
+	gp.Lock()
+	defer gp.Unlock()
+	now := time.Now().Unix()
+	active := gp.active(now)
+	if len(active) >= MAX_NUM_OF_GUEST_PASSES {
+		return "", fmt.Errorf("Maximum number of guest passes reached")
+	}
+	id, err := randomPassId()
+	if err != nil {
+		return "", err
+	}
+	settings := &messages.InnerMessage{}
+	err = messages.Get_wireless_message(settings)
+	if err != nil {
+		return "", err
+	}
+	if guestSsid(settings) == "" {
+		return "", fmt.Errorf("No guest network is configured")
+	}
+	if len(active) == 0 {
+		settings, err = setGuestNetwork(true, true)
+		if err != nil {
+			return "", err
+		}
+	}
+	pass := &GuestPass{
+		Id:      id,
+		Name:    req.Name,
+		Created: now,
+		Expires: now + req.Duration,
+	}
+	gp.Passes = append(active, pass)
+	if req.OnExpiry != "" {
+		gp.OnExpiry = req.OnExpiry
+	}
+	err = gp.dump()
+	if err != nil {
+		return "", err
+	}
+	pbytes, err := json.Marshal(passInfo(pass, settings))
+	return string(pbytes), err
+}
+
+func (gp *GuestPasses) listJson() ([]byte, error) {
+	gp.Lock()
+	defer gp.Unlock()
+
+	passes := make([]messages.GuestPassInfo, 0)
+	active := gp.active(time.Now().Unix())
+	if len(active) > 0 {
+		var settings messages.InnerMessage
+		err := messages.Get_wireless_message(&settings)
+		if err != nil {
+			return nil, err
+		}
+		for _, pass := range active {
+			passes = append(passes, passInfo(pass, &settings))
+		}
+	}
+	return json.Marshal(passes)
+}
+
+// Revoking a pass changes the shared key. The guest network is turned off
+// when no pass is left
+func (gp *GuestPasses) revoke(id string) error {
+	gp.Lock()
+	defer gp.Unlock()
+
+	now := time.Now().Unix()
+	found := false
+	for _, pass := range gp.Passes {
+		if pass.Id == id && pass.Expires > now {
+			pass.Expires = now
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("No such guest pass")
+	}
+	remaining := len(gp.active(now))
+	_, err := setGuestNetwork(remaining > 0, true)
+	if err != nil {
+		return err
+	}
+	gp.Passes = gp.active(now)
+	return gp.dump()
+}
+
+// Rotates the key or disables the guest network once the last pass has expired
+func (gp *GuestPasses) expire(now int64) error {
+	gp.Lock()
+	defer gp.Unlock()
+
+	if len(gp.Passes) == 0 || len(gp.active(now)) > 0 {
+		return nil
+	}
+	_, err := setGuestNetwork(gp.OnExpiry == GUEST_EXPIRY_ROTATE, true)
+	if err != nil {
+		return err
+	}
+	gp.Passes = gp.Passes[:0]
+	return gp.dump()
+}
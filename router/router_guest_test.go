@@ -0,0 +1,72 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createPass(t *testing.T, gp *GuestPasses, req messages.GuestPassInnerMessage) messages.GuestPassInfo {
+	pbytes, err := gp.create(req)
+	assert.Nil(t, err)
+	var info messages.GuestPassInfo
+	assert.Nil(t, json.Unmarshal([]byte(pbytes), &info))
+	return info
+}
+
+func guestSettings(t *testing.T) messages.InnerMessage {
+	var settings messages.InnerMessage
+	assert.Nil(t, messages.Get_wireless_message(&settings))
+	return settings
+}
+
+func TestGuestPasses(t *testing.T) {
+	rs, _ := newSimRouter(t)
+	gp := rs.tel.Guest
+	_, err := gp.create(messages.GuestPassInnerMessage{Duration: 60})
+	assert.NotNil(t, err)
+
+	// The first pass turns the guest network on with a new key
+	first := createPass(t, gp, messages.GuestPassInnerMessage{Name: "Sam", Duration: 3600})
+	settings := guestSettings(t)
+	assert.Equal(t, "0", settings.Gdisabled2)
+	assert.NotEqual(t, "simulated-guest", first.Key)
+	assert.Equal(t, first.Key, settings.Gkey2)
+	assert.Equal(t, "WIFI:T:WPA;S:NearhopSim-Guest;P:"+first.Key+";;", first.Qr)
+	// Later ones share it
+	second := createPass(t, gp, messages.GuestPassInnerMessage{Name: "Kim", Duration: 3600})
+	assert.Equal(t, first.Key, second.Key)
+
+	// Revoking one changes the key of the others
+	assert.Nil(t, gp.revoke(first.Id))
+	settings = guestSettings(t)
+	assert.NotEqual(t, first.Key, settings.Gkey2)
+	assert.Equal(t, "0", settings.Gdisabled2)
+	assert.NotNil(t, gp.revoke(first.Id))
+
+	// The network goes off once the last pass has expired
+	assert.Nil(t, gp.expire(time.Now().Unix()))
+	assert.Equal(t, "0", guestSettings(t).Gdisabled2)
+	assert.Nil(t, gp.expire(time.Now().Unix()+3601))
+	assert.Equal(t, "1", guestSettings(t).Gdisabled2)
+	passes, err := gp.listJson()
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", string(passes))
+}
+
+func TestGuestPassRotateOnExpiry(t *testing.T) {
+	rs, _ := newSimRouter(t)
+	gp := rs.tel.Guest
+	pass := createPass(t, gp, messages.GuestPassInnerMessage{Duration: 600, OnExpiry: GUEST_EXPIRY_ROTATE})
+	assert.Nil(t, gp.expire(time.Now().Unix()+601))
+	settings := guestSettings(t)
+	assert.Equal(t, "0", settings.Gdisabled2)
+	assert.NotEqual(t, pass.Key, settings.Gkey2)
+}
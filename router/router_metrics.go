@@ -0,0 +1,121 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// The router metrics go into the go-metrics registry shared with nebula, so
+// they are exported by the stats section of the config (prometheus or graphite).
+// go-metrics has no labels. The MAC of the client, radio or repeater is part
+// of the name instead, for example router.client.a0b1c2d3e4f5.bytes_in
+var eventMetricNames = map[EventType]string{
+	NEWCLIENTEVENT:             "new_client",
+	BLOCKEDIPEVENT:             "blocked_ip",
+	SCHEDULEPAUSEDEVENT:        "schedule_paused",
+	SCHEDULEUNPAUSEDEVENT:      "schedule_unpaused",
+	QUOTAEXCEEDEDEVENT:         "quota_exceeded",
+	REPEATEROFFLINEEVENT:       "repeater_offline",
+	REPEATERONLINEEVENT:        "repeater_online",
+	UPGRADEEVENT:               "upgrade",
+	CHANNELRECOMMENDATIONEVENT: "channel_recommendation",
+	ROAMEVENT:                  "roam",
+	STICKYCLIENTEVENT:          "sticky_client",
+	ARRIVEDEVENT:               "arrived",
+	DEPARTEDEVENT:              "departed",
+	ANOMALYEVENT:               "anomaly",
+}
+
+func metricKey(id string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", ".", "_", "-", "_", " ", "_").Replace(id))
+}
+
+func boolGauge(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var clientMetricNames = []string{"bytes_in", "bytes_out", "paused", "lastseen", "rssi"}
+
+func clientMetric(mac string, name string) string {
+	return "router.client." + metricKey(mac) + "." + name
+}
+
+func unregisterClientMetrics(mac string) {
+	for _, name := range clientMetricNames {
+		metrics.Unregister(clientMetric(mac, name))
+	}
+}
+
+func countClientBytes(mac string, bytesin uint64, bytesout uint64) {
+	metrics.GetOrRegisterCounter(clientMetric(mac, "bytes_in"), nil).Inc(int64(bytesin))
+	metrics.GetOrRegisterCounter(clientMetric(mac, "bytes_out"), nil).Inc(int64(bytesout))
+}
+
+func countBlocklistHit(feed string) {
+	metrics.GetOrRegisterCounter("router.blocklist.hits", nil).Inc(1)
+	metrics.GetOrRegisterCounter("router.blocklist.feed."+metricKey(feed)+".hits", nil).Inc(1)
+}
+
+func countEvent(etype EventType) {
+	name := eventMetricNames[etype]
+	if name == "" {
+		name = fmt.Sprintf("type_%d", etype)
+	}
+	metrics.GetOrRegisterCounter("router.events."+name, nil).Inc(1)
+}
+
+// Refreshes the gauges. Counters are bumped as the telemetry comes in.
+// The metrics of the clients that were dropped are unregistered
+func (tel *Telemetry) updateMetrics(now int64) {
+	tel.Lock()
+	defer tel.Unlock()
+
+	clients := 0
+	live := make(map[string]bool)
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || clientExpired(client, now) {
+			continue
+		}
+		clients++
+		live[mac] = true
+		// Schedules, quotas and groups pause the client through Paused too
+		metrics.GetOrRegisterGauge(clientMetric(mac, "paused"), nil).Update(boolGauge(client.Paused))
+		metrics.GetOrRegisterGauge(clientMetric(mac, "lastseen"), nil).Update(client.Lastseen)
+		if client.Type != WIRED {
+			metrics.GetOrRegisterGauge(clientMetric(mac, "rssi"), nil).Update(int64(client.Rssi))
+		}
+	}
+	metrics.GetOrRegisterGauge("router.clients", nil).Update(int64(clients))
+	for mac := range tel.metricClients {
+		if !live[mac] {
+			unregisterClientMetrics(mac)
+		}
+	}
+	tel.metricClients = live
+
+	for _, rs := range tel.radios {
+		prefix := "router.radio." + metricKey(rs.Node) + "_" + metricKey(rs.Name)
+		metrics.GetOrRegisterGauge(prefix+".stations", nil).Update(int64(rs.StationCount))
+		metrics.GetOrRegisterGauge(prefix+".channel", nil).Update(int64(rs.Channel))
+	}
+
+	online := 0
+	for _, repeater := range tel.Repeaters {
+		prefix := "router.repeater." + metricKey(repeater.Mac)
+		metrics.GetOrRegisterGauge(prefix+".online", nil).Update(boolGauge(repeater.Online))
+		metrics.GetOrRegisterGauge(prefix+".backhaul_rssi", nil).Update(int64(repeater.BackhaulRssi))
+		if repeater.Online {
+			online++
+		}
+	}
+	metrics.GetOrRegisterGauge("router.repeaters.online", nil).Update(int64(online))
+	metrics.GetOrRegisterGauge("router.telemetry.age", nil).Update(now - tel.telemetryreceived)
+}
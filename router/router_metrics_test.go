@@ -0,0 +1,48 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func gauge(name string) (int64, bool) {
+	g, ok := metrics.Get(name).(metrics.Gauge)
+	if !ok {
+		return 0, false
+	}
+	return g.Value(), true
+}
+
+func TestMetrics(t *testing.T) {
+	rs, sim := newScheduledRouter(t)
+	assert.Equal(t, "router.client.a45e60102002.bytes_in", clientMetric(testMac, "bytes_in"))
+	bytes := metrics.GetOrRegisterCounter(clientMetric(testMac, "bytes_in"), nil).Count()
+	assert.Nil(t, sim.Tick())
+	assert.Greater(t, metrics.GetOrRegisterCounter(clientMetric(testMac, "bytes_in"), nil).Count(), bytes)
+
+	// The gauge follows the pause, not the window of the schedule
+	rs.tel.applySchedules(inBedtime)
+	rs.tel.updateMetrics(time.Now().Unix())
+	paused, ok := gauge(clientMetric(testMac, "paused"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), paused)
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, false))
+	rs.tel.updateMetrics(time.Now().Unix())
+	paused, _ = gauge(clientMetric(testMac, "paused"))
+	assert.Equal(t, int64(0), paused)
+	online, _ := gauge("router.repeater.025e11000001.online")
+	assert.Equal(t, int64(1), online)
+
+	// Dropped clients take their metrics with them
+	expireClient(rs, testMac)
+	rs.tel.updateMetrics(time.Now().Unix())
+	_, ok = gauge(clientMetric(testMac, "paused"))
+	assert.False(t, ok)
+	assert.Nil(t, metrics.Get(clientMetric(testMac, "bytes_in")))
+}
@@ -10,10 +10,36 @@ import (
 	nh_util "nh_util"
 )
 
+const LAN_IFNAME = "br-lan"
 const DB_CLIENTS_LOCATION = "/etc/nearhop/clients/"
+const DB_USAGE_LOCATION = "/etc/nearhop/usage/"
+const DB_QUOTAS_FILE = "/etc/nearhop/quotas.json"
+const DB_BLOCKLIST_LOCATION = "/etc/nearhop/blocklist/"
+const DB_BLOCKLIST_FEEDS_FILE = "/etc/nearhop/blocklist_feeds.json"
+const DB_EVENTS_FILE = "/etc/nearhop/events.log"
+const DB_API_SECRET_FILE = "/etc/nearhop/api_secret"
+const DB_UPGRADE_FILE = "/etc/nearhop/upgrade.json"
+const DB_FW_PUBKEY_FILE = "/etc/nearhop/fw_signing.pub"
+const FW_IMAGE_FILE = "/tmp/nearhop_fw.img"
+const DB_CHANNEL_PLAN_FILE = "/etc/nearhop/channel_plan.json"
+const DB_PRESENCE_FILE = "/etc/nearhop/presence.json"
+const DB_GUEST_PASSES_FILE = "/etc/nearhop/guest_passes.json"
+const DB_BLOCK_CATEGORIES_FILE = "/etc/nearhop/block_categories.json"
+const DB_FILTER_PROFILES_FILE = "/etc/nearhop/filter_profiles.json"
+const DB_FILTER_CONFIG_FILE = "/tmp/nearhop_filter_profiles.conf"
+const DB_DNS_ACTIVITY_LOCATION = "/etc/nearhop/dns_activity/"
+const DNS_QUERY_LOG_FILE = "/tmp/nearhop_dns_queries.log"
+const DB_QUARANTINE_FILE = "/etc/nearhop/quarantine.json"
+const DB_ANOMALY_FILE = "/etc/nearhop/anomaly.json"
+const DB_GROUPS_FILE = "/etc/nearhop/groups.json"
+const DHCP_LEASES_FILE = "/tmp/dhcp.leases"
+const DB_CATEGORY_DOMAINS_LOCATION = "/etc/nearhop/categories/"
 const DB_REPEATERS_FILE = "/etc/nearhop/repeaters.json"
+const fw_upgrade_script = "/sbin/fw_update.sh"
+const fw_rollback_script = "/sbin/fw_rollback.sh"
 const get_hostname_cmd = "/sbin/get_hostname.sh"
 const nearhop_hostnames = "/tmp/dummy_hostnames.txt"
+const applyFilterProfilesScript = "/sbin/apply_filter_profiles.sh"
 const updateBlockedURLsScript = "/sbin/update_blocked_urls.sh"
 
 func Router_onboarded(opmode string) {
@@ -31,6 +57,11 @@ func getFileName(mac string) string {
 	return filename
 }
 
+func getUsageFileName(mac string) string {
+	filename := DB_USAGE_LOCATION + strings.Replace(mac, ":", "_", -1)
+	return filename
+}
+
 func pauseClient(mac string, ip string, name string, pause bool) string {
 	var pauseString string
 	if pause {
@@ -43,6 +74,19 @@ func pauseClient(mac string, ip string, name string, pause bool) string {
 	return nh_util.NH_read_cmd_output(cmd, args)
 }
 
+// Limits the client to the internet, no access to the LAN
+func isolateClient(mac string, ip string, isolate bool) string {
+	var isolateString string
+	if isolate {
+		isolateString = "1"
+	} else {
+		isolateString = "0"
+	}
+	args := []string{mac, ip, isolateString}
+	cmd := "/sbin/isolate_client.sh"
+	return nh_util.NH_read_cmd_output(cmd, args)
+}
+
 func pauseAll(pause bool) string {
 	var pauseString string
 	if pause {
@@ -65,12 +109,46 @@ func getSignalQuality(rssi int) int {
 	}
 }
 
+// DHCP option 55 (parameter request list) of the client, "na" when not known
+func getDHCPFingerprint(mac string) string {
+	args := []string{mac}
+	cmd := "/sbin/get_dhcp_fingerprint.sh"
+	return nh_util.NH_read_cmd_output(cmd, args)
+}
+
+func getFwVersion() string {
+	args := []string{}
+	cmd := "/sbin/get_fw_version.sh"
+	return nh_util.NH_read_cmd_output(cmd, args)
+}
+
+func get_host_name(mac string) string {
+	args := []string{mac}
+	return nh_util.NH_read_cmd_output(get_hostname_cmd, args)
+}
+
 func addDNSEntryPlatform(client *RouterClient) {
 	args := []string{client.Name, client.IPAddress}
 	cmd := "/sbin/create_name_entry.sh"
 	nh_util.NH_read_cmd_output(cmd, args)
 }
 
+// Has dnsmasq log the queries with the client address (log-queries=extra).
+// An empty log file turns the logging off
+func setDNSQueryLog(enable bool) {
+	args := []string{""}
+	if enable {
+		args = []string{DNS_QUERY_LOG_FILE}
+	}
+	cmd := "/sbin/enable_dns_query_log.sh"
+	nh_util.NH_read_cmd_output(cmd, args)
+}
+
+// The generic sources of router_source.go are all there is
+func platformTelemetrySource(name string, interval time.Duration) TelemetrySource {
+	return nil
+}
+
 func applyDNSEntries() {
 	args := []string{"reload"}
 	cmd := "/etc/init.d/dnsmasq"
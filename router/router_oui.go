@@ -0,0 +1,113 @@
+//go:build router
+// +build router
+
+package router
+
+type ouiEntry struct {
+	Vendor string
+	// Type most devices of this vendor are. WIRELESS when the vendor makes all kinds
+	Hint ClientType
+}
+
+// MAC OUI prefixes of vendors commonly seen on home networks
+var ouiTable = map[string]ouiEntry{
+	// Apple makes phones and laptops. Hostname and DHCP decide
+	"00:03:93": {"Apple", WIRELESS},
+	"00:0a:95": {"Apple", WIRELESS},
+	"00:1b:63": {"Apple", WIRELESS},
+	"00:1e:c2": {"Apple", WIRELESS},
+	"00:25:00": {"Apple", WIRELESS},
+	"28:cf:e9": {"Apple", WIRELESS},
+	"3c:07:54": {"Apple", WIRELESS},
+	"a4:5e:60": {"Apple", WIRELESS},
+	"ac:bc:32": {"Apple", WIRELESS},
+	"f0:18:98": {"Apple", WIRELESS},
+
+	"00:12:fb": {"Samsung", WIRELESSPHONE},
+	"00:15:99": {"Samsung", WIRELESSPHONE},
+	"00:16:32": {"Samsung", WIRELESSPHONE},
+	"5c:0a:5b": {"Samsung", WIRELESSPHONE},
+	"8c:77:12": {"Samsung", WIRELESSPHONE},
+	"f0:25:b7": {"Samsung", WIRELESSPHONE},
+
+	"94:65:2d": {"OnePlus", WIRELESSPHONE},
+	"c0:ee:fb": {"OnePlus", WIRELESSPHONE},
+
+	"00:e0:fc": {"Huawei", WIRELESSPHONE},
+	"00:18:82": {"Huawei", WIRELESSPHONE},
+	"28:6e:d4": {"Huawei", WIRELESSPHONE},
+
+	"64:09:80": {"Xiaomi", WIRELESSPHONE},
+	"28:6c:07": {"Xiaomi", WIRELESSPHONE},
+	"34:ce:00": {"Xiaomi", WIRELESSPHONE},
+	"78:11:dc": {"Xiaomi", WIRELESSIOT},
+
+	"00:1b:21": {"Intel", WIRELESSLAPTOP},
+	"00:1e:67": {"Intel", WIRELESSLAPTOP},
+	"3c:a9:f4": {"Intel", WIRELESSLAPTOP},
+	"a4:4e:31": {"Intel", WIRELESSLAPTOP},
+
+	"00:14:22": {"Dell", WIRELESSLAPTOP},
+	"18:03:73": {"Dell", WIRELESSLAPTOP},
+	"b8:ac:6f": {"Dell", WIRELESSLAPTOP},
+	"d4:be:d9": {"Dell", WIRELESSLAPTOP},
+	"f8:bc:12": {"Dell", WIRELESSLAPTOP},
+
+	"b8:27:eb": {"Raspberry Pi", WIRELESSIOT},
+	"dc:a6:32": {"Raspberry Pi", WIRELESSIOT},
+	"e4:5f:01": {"Raspberry Pi", WIRELESSIOT},
+	"28:cd:c1": {"Raspberry Pi", WIRELESSIOT},
+	"d8:3a:dd": {"Raspberry Pi", WIRELESSIOT},
+
+	"18:fe:34": {"Espressif", WIRELESSIOT},
+	"24:0a:c4": {"Espressif", WIRELESSIOT},
+	"24:6f:28": {"Espressif", WIRELESSIOT},
+	"30:ae:a4": {"Espressif", WIRELESSIOT},
+	"5c:cf:7f": {"Espressif", WIRELESSIOT},
+	"60:01:94": {"Espressif", WIRELESSIOT},
+	"84:f3:eb": {"Espressif", WIRELESSIOT},
+	"a4:cf:12": {"Espressif", WIRELESSIOT},
+	"cc:50:e3": {"Espressif", WIRELESSIOT},
+	"ec:fa:bc": {"Espressif", WIRELESSIOT},
+
+	"0c:47:c9": {"Amazon", WIRELESSIOT},
+	"44:65:0d": {"Amazon", WIRELESSIOT},
+	"68:37:e9": {"Amazon", WIRELESSIOT},
+	"74:c2:46": {"Amazon", WIRELESSIOT},
+	"84:d6:d0": {"Amazon", WIRELESSIOT},
+	"f0:27:2d": {"Amazon", WIRELESSIOT},
+	"fc:65:de": {"Amazon", WIRELESSIOT},
+
+	"1c:f2:9a": {"Google", WIRELESSIOT},
+	"20:df:b9": {"Google", WIRELESSIOT},
+	"3c:5a:b4": {"Google", WIRELESSIOT},
+	"54:60:09": {"Google", WIRELESSIOT},
+	"f4:f5:d8": {"Google", WIRELESSIOT},
+	"f4:f5:e8": {"Google", WIRELESSIOT},
+
+	"18:b4:30": {"Nest", WIRELESSIOT},
+	"64:16:66": {"Nest", WIRELESSIOT},
+
+	"00:0e:58": {"Sonos", WIRELESSIOT},
+	"48:a6:b8": {"Sonos", WIRELESSIOT},
+	"5c:aa:fd": {"Sonos", WIRELESSIOT},
+	"94:9f:3e": {"Sonos", WIRELESSIOT},
+	"b8:e9:37": {"Sonos", WIRELESSIOT},
+
+	"00:17:88": {"Philips Hue", WIRELESSIOT},
+	"ec:b5:fa": {"Philips Hue", WIRELESSIOT},
+
+	"b0:a7:37": {"Roku", WIRELESSIOT},
+	"cc:6d:a0": {"Roku", WIRELESSIOT},
+	"d8:31:34": {"Roku", WIRELESSIOT},
+	"dc:3a:5e": {"Roku", WIRELESSIOT},
+
+	"00:09:bf": {"Nintendo", WIRELESS},
+	"00:17:ab": {"Nintendo", WIRELESS},
+	"7c:bb:8a": {"Nintendo", WIRELESS},
+	"98:b6:e9": {"Nintendo", WIRELESS},
+
+	"00:50:f2": {"Microsoft", WIRELESS},
+	"28:18:78": {"Microsoft", WIRELESS},
+	"7c:ed:8d": {"Microsoft", WIRELESS},
+}
@@ -0,0 +1,183 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// Phones sleep their Wi-Fi. A person device is still home this long after it was last seen
+const PRESENCE_DEFAULT_GRACE_PERIOD = 10 * 60
+const PRESENCE_MIN_GRACE_PERIOD = 60
+const PRESENCE_MAX_GRACE_PERIOD = 2 * 60 * 60
+
+const MAX_PERSON_NAME_LENGTH = 32
+
+type PresenceConfig struct {
+	GracePeriod int64
+}
+
+func (tel *Telemetry) readPresenceConfig() {
+	tel.presence = PresenceConfig{GracePeriod: PRESENCE_DEFAULT_GRACE_PERIOD}
+	content, err := nh_util.NH_read_file(DB_PRESENCE_FILE)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &tel.presence)
+	if err != nil {
+		tel.l.Error("Error while unmarshalling presence config", err)
+	}
+}
+
+// Tells whether any other device of the person is home. Called with the telemetry lock held
+func (tel *Telemetry) personHome(person string, except *RouterClient) bool {
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || client == except {
+			continue
+		}
+		if client.Person == person && client.Home {
+			return true
+		}
+	}
+	return false
+}
+
+// Raises ARRIVEDEVENT when the first device of a person shows up and
+// DEPARTEDEVENT when the last one has not been seen for the grace period
+func (tel *Telemetry) checkPresence(now int64) {
+	tel.Lock()
+	defer tel.Unlock()
+
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || client.Person == "" {
+			continue
+		}
+		home := now-client.Lastseen <= tel.presence.GracePeriod
+		if home == client.Home {
+			continue
+		}
+		someoneHome := tel.personHome(client.Person, client)
+		client.Home = home
+		if home {
+			client.HomeSince = now
+		}
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (presence) the client details", client.MACAddress)
+		}
+		if someoneHome {
+			// The person is home with another device
+			continue
+		}
+		if home {
+			tel.newEvent(ARRIVEDEVENT, client.Person, client, "presence")
+		} else {
+			tel.newEvent(DEPARTEDEVENT, client.Person, client, "presence")
+		}
+	}
+}
+
+func (tel *Telemetry) presenceJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	people := make(map[string]*messages.PersonPresenceInfo)
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || client.Person == "" {
+			continue
+		}
+		person := people[client.Person]
+		if person == nil {
+			person = &messages.PersonPresenceInfo{
+				Person:  client.Person,
+				Devices: make([]messages.PresenceDeviceInfo, 0),
+			}
+			people[client.Person] = person
+		}
+		person.Devices = append(person.Devices, messages.PresenceDeviceInfo{
+			MACAddress: client.MACAddress,
+			Person:     client.Person,
+			Name:       client.Name,
+			Home:       client.Home,
+			Lastseen:   client.Lastseen,
+		})
+		if client.Home {
+			if !person.Home || client.HomeSince < person.Since {
+				person.Since = client.HomeSince
+			}
+			person.Home = true
+		} else if !person.Home && client.Lastseen > person.Since {
+			// Left when the last device was seen
+			person.Since = client.Lastseen
+		}
+	}
+	presence := messages.PresenceInfo{
+		GracePeriod: tel.presence.GracePeriod,
+		People:      make([]messages.PersonPresenceInfo, 0, len(people)),
+	}
+	for _, person := range people {
+		presence.People = append(presence.People, *person)
+	}
+	sort.Slice(presence.People, func(i, j int) bool {
+		return presence.People[i].Person < presence.People[j].Person
+	})
+	return json.Marshal(presence)
+}
+
+// Sets the grace period and which clients are person devices. Clients left out
+// are no longer tracked
+func (tel *Telemetry) setPresence(info messages.PresenceInnerMessage) string {
+	if info.GracePeriod == 0 {
+		info.GracePeriod = PRESENCE_DEFAULT_GRACE_PERIOD
+	}
+	if info.GracePeriod < PRESENCE_MIN_GRACE_PERIOD || info.GracePeriod > PRESENCE_MAX_GRACE_PERIOD {
+		return nh_util.NH_getErrorStatusString(fmt.Sprintf("Grace period must be %d to %d seconds", PRESENCE_MIN_GRACE_PERIOD, PRESENCE_MAX_GRACE_PERIOD))
+	}
+	persons := make(map[string]string)
+	for _, device := range info.Devices {
+		if device.Person == "" || len(device.Person) > MAX_PERSON_NAME_LENGTH {
+			return nh_util.NH_getErrorStatusString("Invalid person name for " + device.MACAddress)
+		}
+		persons[device.MACAddress] = device.Person
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	for mac := range persons {
+		if tel.RouterClients[mac] == nil {
+			return nh_util.NH_getErrorStatusString("No such client " + mac)
+		}
+	}
+	now := time.Now().Unix()
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || client.Person == persons[mac] {
+			continue
+		}
+		client.Person = persons[mac]
+		client.Home = client.Person != "" && now-client.Lastseen <= info.GracePeriod
+		if client.Home {
+			client.HomeSince = now
+		}
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (presence) the client details", client.MACAddress)
+		}
+	}
+	tel.presence.GracePeriod = info.GracePeriod
+	pbytes, err := json.Marshal(tel.presence)
+	if err == nil {
+		err = nh_util.NH_dump_to_file(DB_PRESENCE_FILE, pbytes, 0644)
+	}
+	if err != nil {
+		tel.l.Error("Error while saving presence config", err)
+		return nh_util.NH_getErrorStatusString("Error while saving presence config")
+	}
+	return ""
+}
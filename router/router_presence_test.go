@@ -0,0 +1,64 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPhone = "f0:25:b7:10:20:01"
+
+func presenceEvents(rs *RouterServer) []EventType {
+	etypes := make([]EventType, 0)
+	for _, ev := range rs.tel.Journal.query(EventFilter{Etypes: []int{int(ARRIVEDEVENT), int(DEPARTEDEVENT)}}) {
+		etypes = append(etypes, EventType(ev.Etype))
+	}
+	return etypes
+}
+
+func setLastseen(rs *RouterServer, mac string, lastseen int64) {
+	rs.tel.Lock()
+	defer rs.tel.Unlock()
+	rs.tel.RouterClients[mac].Lastseen = lastseen
+}
+
+func TestPresence(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	status := rs.tel.setPresence(messages.PresenceInnerMessage{GracePeriod: 600, Devices: []messages.PresenceDeviceInfo{
+		{MACAddress: testMac, Person: "alex"},
+		{MACAddress: testPhone, Person: "alex"},
+	}})
+	assert.Equal(t, "", status)
+	now := time.Now().Unix()
+	// Home from the start, without an arrival
+	rs.tel.checkPresence(now)
+	assert.Empty(t, presenceEvents(rs))
+
+	// Still home while one device is around
+	setLastseen(rs, testMac, now-601)
+	rs.tel.checkPresence(now)
+	assert.Empty(t, presenceEvents(rs))
+
+	// A phone sleeping its Wi-Fi within the grace period is home
+	setLastseen(rs, testPhone, now-300)
+	rs.tel.checkPresence(now)
+	assert.Empty(t, presenceEvents(rs))
+
+	setLastseen(rs, testPhone, now-601)
+	rs.tel.checkPresence(now)
+	assert.Equal(t, []EventType{DEPARTEDEVENT}, presenceEvents(rs))
+
+	// One arrival for the person, not one per device
+	assert.Nil(t, sim.Tick())
+	rs.tel.checkPresence(time.Now().Unix())
+	assert.Equal(t, []EventType{DEPARTEDEVENT, ARRIVEDEVENT}, presenceEvents(rs))
+
+	assert.NotEqual(t, "", rs.tel.setPresence(messages.PresenceInnerMessage{GracePeriod: 10}))
+}
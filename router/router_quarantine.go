@@ -0,0 +1,181 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// What happens to a client the router has not seen before
+const (
+	QUARANTINE_OFF = "off"
+	// Paused till approved
+	QUARANTINE_PAUSE = "pause"
+	// Internet only, no LAN, till approved
+	QUARANTINE_INTERNET = "internet"
+)
+
+const (
+	APPROVAL_PENDING  = "pending"
+	APPROVAL_APPROVED = "approved"
+	APPROVAL_REJECTED = "rejected"
+)
+
+type QuarantineConfig struct {
+	Mode string
+}
+
+func validQuarantineMode(mode string) bool {
+	switch mode {
+	case QUARANTINE_OFF, QUARANTINE_PAUSE, QUARANTINE_INTERNET:
+		return true
+	}
+	return false
+}
+
+func (tel *Telemetry) readQuarantineConfig() {
+	tel.quarantine = QuarantineConfig{Mode: QUARANTINE_OFF}
+	content, err := nh_util.NH_read_file(DB_QUARANTINE_FILE)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &tel.quarantine)
+	if err != nil || !validQuarantineMode(tel.quarantine.Mode) {
+		tel.l.Error("Error while unmarshalling quarantine config", err)
+		tel.quarantine.Mode = QUARANTINE_OFF
+	}
+}
+
+// Holds a new client till it is approved. Called with the telemetry lock held
+func (tel *Telemetry) quarantineClient(client *RouterClient) {
+	if tel.quarantine.Mode == QUARANTINE_OFF || client.IsRepeater {
+		return
+	}
+	client.Approval = APPROVAL_PENDING
+	client.PendingSince = time.Now().Unix()
+	client.Quarantine = tel.quarantine.Mode
+	if client.Quarantine == QUARANTINE_PAUSE {
+		client.Paused = true
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, true)
+	} else {
+		isolateClient(client.MACAddress, client.IPAddress, true)
+	}
+	tel.l.WithField("mac", client.MACAddress).WithField("mode", client.Quarantine).Info("New client quarantined")
+}
+
+// The platform does not keep the isolation across reboots. It is applied again
+// to the clients held internet-only as they are loaded
+func restoreQuarantine(client *RouterClient) {
+	if client.Quarantine == QUARANTINE_INTERNET {
+		isolateClient(client.MACAddress, client.IPAddress, true)
+	}
+}
+
+// Lifts the quarantine. A client paused by a schedule, a quota or its group
+// stays paused
+// Called with the telemetry lock held
+func (tel *Telemetry) releaseClient(client *RouterClient) {
+	quarantine := client.Quarantine
+	client.Quarantine = ""
+	switch quarantine {
+	case QUARANTINE_PAUSE:
+		if client.Paused && !client.pausedAutomatically() {
+			client.Paused = false
+			pauseClient(client.MACAddress, client.IPAddress, client.Name, false)
+		}
+	case QUARANTINE_INTERNET:
+		isolateClient(client.MACAddress, client.IPAddress, false)
+	}
+}
+
+// Rejected clients are kept paused for good. Called with the telemetry lock held
+func (tel *Telemetry) rejectClient(client *RouterClient) {
+	if client.Quarantine == QUARANTINE_INTERNET {
+		isolateClient(client.MACAddress, client.IPAddress, false)
+	}
+	client.Quarantine = QUARANTINE_PAUSE
+	if !client.Paused {
+		client.Paused = true
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, true)
+	}
+}
+
+func (tel *Telemetry) approveClient(mac string, approve bool) string {
+	tel.Lock()
+	defer tel.Unlock()
+
+	client := tel.RouterClients[mac]
+	if client == nil {
+		return nh_util.NH_getErrorStatusString("Received an approve request for a client that does n't exist")
+	}
+	if approve {
+		client.Approval = APPROVAL_APPROVED
+		tel.releaseClient(client)
+	} else {
+		client.Approval = APPROVAL_REJECTED
+		tel.rejectClient(client)
+	}
+	client.PendingSince = 0
+	err := dumpClientStats(client)
+	if err != nil {
+		tel.l.Error("Error while saving (approve) the client details", client.MACAddress)
+		return nh_util.NH_getErrorStatusString("Error while saving the client details")
+	}
+	return ""
+}
+
+// Pending clients, oldest first
+func (tel *Telemetry) quarantineJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	quarantine := messages.QuarantineInfo{
+		Mode:    tel.quarantine.Mode,
+		Pending: make([]messages.PendingClientInfo, 0),
+	}
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || client.Approval != APPROVAL_PENDING {
+			continue
+		}
+		quarantine.Pending = append(quarantine.Pending, messages.PendingClientInfo{
+			MACAddress:   client.MACAddress,
+			IPAddress:    client.IPAddress,
+			Name:         client.Name,
+			Vendor:       client.Vendor,
+			Type:         int(client.Type),
+			Quarantine:   client.Quarantine,
+			PendingSince: client.PendingSince,
+			Lastseen:     client.Lastseen,
+		})
+	}
+	sort.Slice(quarantine.Pending, func(i, j int) bool {
+		return quarantine.Pending[i].PendingSince < quarantine.Pending[j].PendingSince
+	})
+	return json.Marshal(quarantine)
+}
+
+// Only new clients are quarantined. Turning it off leaves the pending ones as they are
+func (tel *Telemetry) setQuarantine(mode string) string {
+	if !validQuarantineMode(mode) {
+		return nh_util.NH_getErrorStatusString("Invalid quarantine mode " + mode)
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	tel.quarantine.Mode = mode
+	qbytes, err := json.Marshal(tel.quarantine)
+	if err == nil {
+		err = nh_util.NH_dump_to_file(DB_QUARANTINE_FILE, qbytes, 0644)
+	}
+	if err != nil {
+		tel.l.Error("Error while saving quarantine config", err)
+		return nh_util.NH_getErrorStatusString("Error while saving quarantine config")
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+
+	messages "messages"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const pendingMac = "3c:22:fb:10:20:07"
+
+func newQuarantineRouter(t *testing.T, mode string) (*RouterServer, *Simulator) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	assert.Equal(t, "", rs.tel.setQuarantine(mode))
+	sim.AddClient(SimClient{Mac: pendingMac, Ip: "192.168.1.107", Name: "iPad", Radio: "wl1", Rssi: -55})
+	assert.Nil(t, sim.Tick())
+	return rs, sim
+}
+
+func TestQuarantinePause(t *testing.T) {
+	rs, sim := newQuarantineRouter(t, QUARANTINE_PAUSE)
+	assert.True(t, sim.Paused(pendingMac))
+	assert.NotEqual(t, "", rs.tel.pauseClient(pendingMac, false))
+	assert.True(t, sim.Paused(pendingMac))
+
+	assert.Equal(t, "", rs.tel.approveClient(pendingMac, true))
+	assert.False(t, sim.Paused(pendingMac))
+	// Known clients are not quarantined
+	assert.False(t, sim.Paused(testMac))
+}
+
+func TestQuarantineKeepsSchedulePause(t *testing.T) {
+	rs, sim := newQuarantineRouter(t, QUARANTINE_PAUSE)
+	status := rs.tel.setSchedules(pendingMac, []messages.ScheduleInfo{{Days: everyDay, Start: "21:00", End: "07:00"}})
+	assert.Equal(t, "", status)
+
+	// The window starts while the client is held. Approving it leaves it to
+	// the schedule
+	rs.tel.applySchedules(inBedtime)
+	assert.Equal(t, "", rs.tel.approveClient(pendingMac, true))
+	assert.True(t, sim.Paused(pendingMac))
+	rs.tel.applySchedules(afterBedtime)
+	assert.False(t, sim.Paused(pendingMac))
+}
+
+func TestQuarantineInternetAfterReboot(t *testing.T) {
+	rs, sim := newQuarantineRouter(t, QUARANTINE_INTERNET)
+	assert.True(t, sim.Isolated(pendingMac))
+	assert.False(t, sim.Paused(pendingMac))
+	rs.tel.dumpRouterClients()
+
+	// The isolation is gone after a reboot, loading the clients applies it again
+	sim.setIsolated(pendingMac, false)
+	NewTelemetry(test.NewLogger())
+	assert.True(t, sim.Isolated(pendingMac))
+
+	assert.Equal(t, "", rs.tel.approveClient(pendingMac, true))
+	assert.False(t, sim.Isolated(pendingMac))
+	rs.tel.dumpRouterClients()
+	NewTelemetry(test.NewLogger())
+	assert.False(t, sim.Isolated(pendingMac))
+}
+
+func TestQuarantineInternetAfterImport(t *testing.T) {
+	rs, sim := newQuarantineRouter(t, QUARANTINE_INTERNET)
+	archive := exportArchive(t, rs, "")
+	sim.setIsolated(pendingMac, false)
+	assert.Nil(t, rs.tel.importConfig(archive, ""))
+	assert.True(t, sim.Isolated(pendingMac))
+
+	// A client held now and not in the archive is let go
+	other := "3c:22:fb:10:20:08"
+	sim.AddClient(SimClient{Mac: other, Ip: "192.168.1.108", Name: "iPad2", Radio: "wl1", Rssi: -55})
+	assert.Nil(t, sim.Tick())
+	assert.True(t, sim.Isolated(other))
+	assert.Nil(t, rs.tel.importConfig(archive, ""))
+	assert.False(t, sim.Isolated(other))
+	assert.True(t, sim.Isolated(pendingMac))
+}
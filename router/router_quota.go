@@ -0,0 +1,312 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const MAX_NUM_OF_QUOTAS = 32
+
+// A client is counted as active in a minute once it moves this many bytes
+const QUOTA_ACTIVE_BYTES_THRESHOLD = 16 * 1024
+
+// Start of the quota day containing now, given the "HH:MM" reset time
+func quotaPeriodStart(now time.Time, resetTime string) int64 {
+	reset, err := scheduleMinutes(resetTime)
+	if err != nil {
+		reset = 0
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), reset/60, reset%60, 0, 0, now.Location())
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start.Unix()
+}
+
+func (q *Quota) hasClient(mac string) bool {
+	for _, c := range q.Clients {
+		if c == mac {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Quota) isExhausted() bool {
+	if q.DailyBytes > 0 && q.UsedBytes >= q.DailyBytes {
+		return true
+	}
+	if q.DailyMinutes > 0 && q.UsedMinutes >= q.DailyMinutes {
+		return true
+	}
+	return false
+}
+
+func (q *Quota) info() messages.QuotaInfo {
+	return messages.QuotaInfo{
+		Name:         q.Name,
+		Clients:      q.Clients,
+		DailyBytes:   q.DailyBytes,
+		DailyMinutes: q.DailyMinutes,
+		ResetTime:    q.ResetTime,
+		UsedBytes:    q.UsedBytes,
+		UsedMinutes:  q.UsedMinutes,
+		Exceeded:     q.Exceeded,
+	}
+}
+
+func (tel *Telemetry) readQuotas() {
+	content, err := nh_util.NH_read_file(DB_QUOTAS_FILE)
+	if err != nil {
+		return
+	}
+	var quotas []Quota
+	err = json.Unmarshal(content, &quotas)
+	if err != nil {
+		tel.l.Error("Error while unmarshalling quotas", err)
+		return
+	}
+	for i := range quotas {
+		tel.Quotas[quotas[i].Name] = &quotas[i]
+	}
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) dumpQuotas() error {
+	quotas := make([]Quota, 0, len(tel.Quotas))
+	for _, q := range tel.Quotas {
+		quotas = append(quotas, *q)
+	}
+	qbytes, err := json.Marshal(quotas)
+	if err != nil {
+		return err
+	}
+	err = nh_util.NH_dump_to_file(DB_QUOTAS_FILE, qbytes, 0644)
+	if err != nil {
+		return err
+	}
+	tel.quotasdirty = false
+	return nil
+}
+
+func (tel *Telemetry) quotaOfClient(mac string) *Quota {
+	for _, q := range tel.Quotas {
+		if q.hasClient(mac) {
+			return q
+		}
+	}
+	return nil
+}
+
+// Pauses or unpauses every client of the quota. Only a pause the quota holds
+// is lifted. Called with the telemetry lock held
+func (tel *Telemetry) pauseQuotaClients(q *Quota, pause bool) {
+	for _, mac := range q.Clients {
+		client := tel.RouterClients[mac]
+		if client == nil {
+			continue
+		}
+		if pause {
+			if client.Paused {
+				// Joins a pause held by a schedule or the quarantine, so that
+				// it lasts till the reset. A pause made by hand is left alone
+				client.QuotaPaused = client.pausedAutomatically()
+				continue
+			}
+			client.QuotaPaused = true
+		} else {
+			if !client.QuotaPaused {
+				continue
+			}
+			client.QuotaPaused = false
+			if !client.Paused || client.pausedAutomatically() {
+				// Unpaused by hand or still held by a schedule or the quarantine
+				continue
+			}
+		}
+		client.Paused = pause
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (quota) the client details", client.MACAddress)
+		}
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, pause)
+		if pause {
+			tel.newEvent(QUOTAEXCEEDEDEVENT, q.Name, client, "quota")
+		}
+	}
+}
+
+// Accounts the device's bytes and active minutes to its quota. Called with the telemetry lock held
+func (tel *Telemetry) updateQuotas(device Device, now time.Time) {
+	q := tel.quotaOfClient(device.Mac)
+	if q == nil {
+		return
+	}
+	bytesin, bytesout := deviceBytes(device)
+	if bytesin == 0 && bytesout == 0 {
+		return
+	}
+	q.UsedBytes += bytesin + bytesout
+	minute := now.Truncate(time.Minute).Unix()
+	if bytesin+bytesout >= QUOTA_ACTIVE_BYTES_THRESHOLD && minute != q.LastActiveMinute {
+		// Clients of a group sharing the quota are counted once per minute
+		q.UsedMinutes++
+		q.LastActiveMinute = minute
+	}
+	tel.quotasdirty = true
+	if !q.Exceeded && q.isExhausted() {
+		q.Exceeded = true
+		tel.l.WithField("quota", q.Name).Info("Quota exceeded")
+		tel.pauseQuotaClients(q, true)
+	}
+}
+
+// Starts a new quota day for the quotas whose reset time has passed
+func (tel *Telemetry) resetQuotas(now time.Time) {
+	tel.Lock()
+	defer tel.Unlock()
+
+	for _, q := range tel.Quotas {
+		start := quotaPeriodStart(now, q.ResetTime)
+		if start == q.PeriodStart {
+			continue
+		}
+		q.PeriodStart = start
+		q.UsedBytes = 0
+		q.UsedMinutes = 0
+		tel.quotasdirty = true
+		if q.Exceeded {
+			q.Exceeded = false
+			tel.pauseQuotaClients(q, false)
+		}
+	}
+	if tel.quotasdirty {
+		err := tel.dumpQuotas()
+		if err != nil {
+			tel.l.Error("Error while saving quotas", err)
+		}
+	}
+}
+
+func (tel *Telemetry) quotasJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	quotas := make([]messages.QuotaInfo, 0, len(tel.Quotas))
+	for _, q := range tel.Quotas {
+		quotas = append(quotas, q.info())
+	}
+	return json.Marshal(quotas)
+}
+
+func validateQuota(q messages.QuotaInfo, seen map[string]string) error {
+	if q.Name == "" {
+		return fmt.Errorf("Quota needs a name")
+	}
+	if q.DailyBytes == 0 && q.DailyMinutes == 0 {
+		return fmt.Errorf("Quota %s has no limits", q.Name)
+	}
+	if q.DailyMinutes < 0 || q.DailyMinutes > 24*60 {
+		return fmt.Errorf("Invalid daily minutes for quota %s", q.Name)
+	}
+	if q.ResetTime != "" {
+		_, err := scheduleMinutes(q.ResetTime)
+		if err != nil {
+			return err
+		}
+	}
+	if len(q.Clients) == 0 {
+		return fmt.Errorf("Quota %s has no clients", q.Name)
+	}
+	for _, mac := range q.Clients {
+		if seen[mac] != "" {
+			return fmt.Errorf("Client %s is in quotas %s and %s", mac, seen[mac], q.Name)
+		}
+		seen[mac] = q.Name
+	}
+	return nil
+}
+
+// Replaces all the quotas. Usage of quotas that keep their name is carried over
+func (tel *Telemetry) setQuotas(quotas []messages.QuotaInfo) string {
+	if len(quotas) > MAX_NUM_OF_QUOTAS {
+		return nh_util.NH_getErrorStatusString("Maximum number of quotas reached")
+	}
+	seen := make(map[string]string)
+	for _, q := range quotas {
+		err := validateQuota(q, seen)
+		if err != nil {
+			return nh_util.NH_getErrorStatusString(err.Error())
+		}
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+
+	now := time.Now()
+	newQuotas := make(map[string]*Quota)
+	for _, qi := range quotas {
+		resetTime := qi.ResetTime
+		if resetTime == "" {
+			resetTime = "00:00"
+		}
+		q := &Quota{
+			Name:         qi.Name,
+			Clients:      qi.Clients,
+			DailyBytes:   qi.DailyBytes,
+			DailyMinutes: qi.DailyMinutes,
+			ResetTime:    resetTime,
+			PeriodStart:  quotaPeriodStart(now, resetTime),
+		}
+		old := tel.Quotas[qi.Name]
+		if old != nil && old.PeriodStart == q.PeriodStart {
+			q.UsedBytes = old.UsedBytes
+			q.UsedMinutes = old.UsedMinutes
+			q.LastActiveMinute = old.LastActiveMinute
+		}
+		newQuotas[q.Name] = q
+	}
+	exhausted := make(map[string]bool)
+	for _, q := range newQuotas {
+		if q.isExhausted() {
+			q.Exceeded = true
+			for _, mac := range q.Clients {
+				exhausted[mac] = true
+			}
+		}
+	}
+	// Release clients paused by quotas that are gone or no longer exhausted.
+	// Clients of a quota that is still exhausted stay paused as they are
+	for _, old := range tel.Quotas {
+		if !old.Exceeded {
+			continue
+		}
+		released := &Quota{Name: old.Name, Clients: make([]string, 0)}
+		for _, mac := range old.Clients {
+			if !exhausted[mac] {
+				released.Clients = append(released.Clients, mac)
+			}
+		}
+		tel.pauseQuotaClients(released, false)
+	}
+	tel.Quotas = newQuotas
+	for _, q := range tel.Quotas {
+		if q.Exceeded {
+			// Only clients not paused by a quota yet are paused and reported
+			tel.pauseQuotaClients(q, true)
+		}
+	}
+	err := tel.dumpQuotas()
+	if err != nil {
+		tel.l.Error("Error while saving quotas", err)
+		return nh_util.NH_getErrorStatusString("Error while saving quotas")
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQuotaRouter(t *testing.T) (*RouterServer, *Simulator) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	status := rs.tel.setQuotas([]messages.QuotaInfo{{Name: "kids", Clients: []string{testMac}, DailyBytes: 1000}})
+	assert.Equal(t, "", status)
+	return rs, sim
+}
+
+func useQuota(rs *RouterServer, mac string, bytes int) {
+	rs.tel.Lock()
+	defer rs.tel.Unlock()
+	rs.tel.updateQuotas(Device{Mac: mac, Conn: []Con{{B_in: []int{bytes}}}}, time.Now())
+}
+
+func TestQuotaPause(t *testing.T) {
+	rs, sim := newQuotaRouter(t)
+
+	useQuota(rs, testMac, 600)
+	assert.False(t, sim.Paused(testMac))
+	useQuota(rs, testMac, 600)
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+
+	rs.tel.resetQuotas(time.Now().AddDate(0, 0, 1))
+	assert.False(t, sim.Paused(testMac))
+	assert.False(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestQuotaKeepsManualPause(t *testing.T) {
+	rs, sim := newQuotaRouter(t)
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, true))
+
+	useQuota(rs, testMac, 2000)
+	rs.tel.resetQuotas(time.Now().AddDate(0, 0, 1))
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestQuotaAndSchedule(t *testing.T) {
+	rs, sim := newQuotaRouter(t)
+	status := rs.tel.setSchedules(testMac, []messages.ScheduleInfo{{Days: everyDay, Start: "21:00", End: "07:00"}})
+	assert.Equal(t, "", status)
+
+	// The quota pauses the client before the window. The reset inside the
+	// window leaves it to the schedule
+	useQuota(rs, testMac, 2000)
+	rs.tel.applySchedules(inBedtime)
+	rs.tel.resetQuotas(time.Now().AddDate(0, 0, 1))
+	assert.True(t, sim.Paused(testMac))
+	rs.tel.applySchedules(afterBedtime)
+	assert.False(t, sim.Paused(testMac))
+
+	// The window ends while the quota is exhausted
+	rs.tel.applySchedules(inBedtime.AddDate(0, 0, 1))
+	useQuota(rs, testMac, 2000)
+	rs.tel.applySchedules(afterBedtime.AddDate(0, 0, 1))
+	assert.True(t, sim.Paused(testMac))
+	rs.tel.resetQuotas(time.Now().AddDate(0, 0, 2))
+	assert.False(t, sim.Paused(testMac))
+}
@@ -0,0 +1,212 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const MAX_SCHEDULES_PER_CLIENT = 8
+
+// Converts "HH:MM" into minutes since midnight
+func scheduleMinutes(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schedule time %s", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *Schedule) validate() error {
+	if len(s.Days) == 0 {
+		return fmt.Errorf("Schedule has no days")
+	}
+	for _, day := range s.Days {
+		if day < int(time.Sunday) || day > int(time.Saturday) {
+			return fmt.Errorf("Invalid schedule day %d", day)
+		}
+	}
+	start, err := scheduleMinutes(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := scheduleMinutes(s.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("Schedule start and end are the same")
+	}
+	return nil
+}
+
+func (s *Schedule) hasDay(day time.Weekday) bool {
+	for _, d := range s.Days {
+		if d == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) isActive(now time.Time) bool {
+	start, err := scheduleMinutes(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := scheduleMinutes(s.End)
+	if err != nil {
+		return false
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	if start < end {
+		return s.hasDay(now.Weekday()) && minutes >= start && minutes < end
+	}
+	// Window runs past midnight. Either it started today or yesterday
+	if s.hasDay(now.Weekday()) && minutes >= start {
+		return true
+	}
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	return s.hasDay(yesterday) && minutes < end
+}
+
+func (client *RouterClient) scheduleActive(now time.Time) bool {
+	for i := range client.Schedules {
+		if client.Schedules[i].isActive(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pauses clients entering a schedule window and unpauses them when it ends.
+// A client that is manually unpaused inside a window stays unpaused until the next one.
+// Only a pause the schedule holds is lifted, a pause made by hand stays
+func (tel *Telemetry) applySchedules(now time.Time) {
+	tel.Lock()
+	defer tel.Unlock()
+
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress {
+			// same client with two different MAC Addresses, say repeater
+			continue
+		}
+		active := client.scheduleActive(now)
+		if active == client.SchedulePaused {
+			continue
+		}
+		client.SchedulePaused = active
+		client.Dirty = true
+		if active {
+			if client.Paused {
+				// Joins a pause held by a quota or the quarantine, so that it
+				// lasts till the window ends. A pause made by hand is left alone
+				client.ScheduleHeld = client.pausedAutomatically()
+				continue
+			}
+			client.ScheduleHeld = true
+		} else {
+			held := client.ScheduleHeld
+			client.ScheduleHeld = false
+			if !held || !client.Paused || client.pausedAutomatically() {
+				// Not paused by the schedule, unpaused by hand or still held
+				continue
+			}
+		}
+		client.Paused = active
+		err := dumpClientStats(client)
+		if err != nil {
+			tel.l.Error("Error while saving (schedule) the client details", client.MACAddress)
+		}
+		pauseClient(client.MACAddress, client.IPAddress, client.Name, active)
+		if active {
+			tel.newEvent(SCHEDULEPAUSEDEVENT, client.IPAddress, client, "schedule")
+		} else {
+			tel.newEvent(SCHEDULEUNPAUSEDEVENT, client.IPAddress, client, "schedule")
+		}
+	}
+}
+
+func (tel *Telemetry) schedulesJson(mac string) ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	schedules := make([]messages.ClientSchedulesInfo, 0)
+	for m, client := range tel.RouterClients {
+		if m != client.MACAddress {
+			continue
+		}
+		if mac != "" && mac != "all" && mac != client.MACAddress {
+			continue
+		}
+		if len(client.Schedules) == 0 && mac != client.MACAddress {
+			continue
+		}
+		info := messages.ClientSchedulesInfo{
+			MACAddress: client.MACAddress,
+			Schedules:  scheduleInfos(client.Schedules),
+		}
+		schedules = append(schedules, info)
+	}
+	return json.Marshal(schedules)
+}
+
+func parseSchedules(schedules []messages.ScheduleInfo) ([]Schedule, error) {
+	if len(schedules) > MAX_SCHEDULES_PER_CLIENT {
+		return nil, fmt.Errorf("Too many schedules for a client")
+	}
+	newSchedules := make([]Schedule, len(schedules))
+	for i, s := range schedules {
+		newSchedules[i] = Schedule{
+			Days:  s.Days,
+			Start: s.Start,
+			End:   s.End,
+		}
+		err := newSchedules[i].validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newSchedules, nil
+}
+
+func scheduleInfos(schedules []Schedule) []messages.ScheduleInfo {
+	infos := make([]messages.ScheduleInfo, len(schedules))
+	for i, s := range schedules {
+		infos[i].Days = s.Days
+		infos[i].Start = s.Start
+		infos[i].End = s.End
+	}
+	return infos
+}
+
+// Replaces the schedules of a client. The new schedules are applied on the next telemetry tick
+func (tel *Telemetry) setSchedules(mac string, schedules []messages.ScheduleInfo) string {
+	newSchedules, err := parseSchedules(schedules)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+
+	tel.Lock()
+	defer tel.Unlock()
+	if tel.RouterClients[mac] == nil {
+		tel.l.Error("Received a setSchedules request for a client that does n't exist")
+		return nh_util.NH_getErrorStatusString("Received a setSchedules request for a client that does n't exist")
+	}
+	// Schedules set by hand are the client's own, also in a group
+	tel.RouterClients[mac].Schedules = newSchedules
+	tel.RouterClients[mac].GroupSchedules = false
+	tel.RouterClients[mac].OwnSchedules = nil
+	err = dumpClientStats(tel.RouterClients[mac])
+	if err != nil {
+		tel.l.Error("Error while saving the client schedules", tel.RouterClients[mac].MACAddress)
+		return nh_util.NH_getErrorStatusString("Error while saving the client schedules")
+	}
+	return ""
+}
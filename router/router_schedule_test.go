@@ -0,0 +1,85 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var everyDay = []int{0, 1, 2, 3, 4, 5, 6}
+
+// Times of a day relative to the 21:00-07:00 bedtime window
+var (
+	beforeBedtime = time.Date(2026, 10, 14, 20, 30, 0, 0, time.Local)
+	inBedtime     = time.Date(2026, 10, 14, 23, 0, 0, 0, time.Local)
+	afterBedtime  = time.Date(2026, 10, 15, 7, 30, 0, 0, time.Local)
+)
+
+func newScheduledRouter(t *testing.T) (*RouterServer, *Simulator) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	status := rs.tel.setSchedules(testMac, []messages.ScheduleInfo{{Days: everyDay, Start: "21:00", End: "07:00"}})
+	assert.Equal(t, "", status)
+	return rs, sim
+}
+
+func TestScheduleActive(t *testing.T) {
+	s := Schedule{Days: []int{int(time.Wednesday)}, Start: "21:00", End: "07:00"}
+	assert.False(t, s.isActive(beforeBedtime))
+	assert.True(t, s.isActive(inBedtime))
+	// Past midnight the window belongs to the day it started
+	assert.True(t, s.isActive(afterBedtime.Add(-time.Hour)))
+	assert.False(t, s.isActive(afterBedtime))
+	assert.False(t, s.isActive(inBedtime.AddDate(0, 0, 1)))
+
+	assert.NotNil(t, (&Schedule{Days: everyDay, Start: "21:00", End: "21:00"}).validate())
+	assert.NotNil(t, (&Schedule{Days: []int{7}, Start: "21:00", End: "07:00"}).validate())
+	assert.NotNil(t, (&Schedule{Start: "21:00", End: "07:00"}).validate())
+}
+
+func TestSchedulePause(t *testing.T) {
+	rs, sim := newScheduledRouter(t)
+
+	rs.tel.applySchedules(beforeBedtime)
+	assert.False(t, sim.Paused(testMac))
+	rs.tel.applySchedules(inBedtime)
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+	rs.tel.applySchedules(afterBedtime)
+	assert.False(t, sim.Paused(testMac))
+	assert.False(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestScheduleKeepsManualPause(t *testing.T) {
+	rs, sim := newScheduledRouter(t)
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, true))
+
+	rs.tel.applySchedules(inBedtime)
+	rs.tel.applySchedules(afterBedtime)
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
+
+func TestScheduleManualOverride(t *testing.T) {
+	rs, sim := newScheduledRouter(t)
+
+	// Unpaused by hand inside the window, it stays unpaused till the next one
+	rs.tel.applySchedules(inBedtime)
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, false))
+	rs.tel.applySchedules(inBedtime.Add(time.Hour))
+	assert.False(t, sim.Paused(testMac))
+	rs.tel.applySchedules(afterBedtime)
+	rs.tel.applySchedules(inBedtime.AddDate(0, 0, 1))
+	assert.True(t, sim.Paused(testMac))
+
+	// Paused by hand inside the window, it stays paused after it
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, true))
+	rs.tel.applySchedules(afterBedtime.AddDate(0, 0, 1))
+	assert.True(t, sim.Paused(testMac))
+}
@@ -8,7 +8,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	messages "messages"
@@ -24,11 +27,24 @@ type RouterServer struct {
 	l          *logrus.Logger
 	ctx        context.Context
 	uploadlogs bool
+	secret     string
+	verifier   PeerVerifier
+	vpnnet     *net.IPNet
+	identity   *NebulaIdentity
+	// /telemetry of the capture daemon is used. /radios always is, the
+	// repeaters post there
+	push bool
 }
 
 func NewRouterServer(l1 *logrus.Logger) (*RouterServer, error) {
-	rs := &RouterServer{l: l1}
+	rs := &RouterServer{l: l1, push: true}
 	rs.ctx, _ = context.WithCancel(context.Background())
+	secret, err := loadAPISecret()
+	if err != nil {
+		// Only Nebula peers can use the api
+		l1.Error("Error while loading the router api secret ", err)
+	}
+	rs.secret = secret
 	rs.tel = NewTelemetry(l1)
 	go rs.tel.Run(rs.ctx)
 	return rs, nil
@@ -37,6 +53,10 @@ func NewRouterServer(l1 *logrus.Logger) (*RouterServer, error) {
 func (rs *RouterServer) telemetry(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
+		if !rs.push {
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString("Telemetry push is not enabled"))
+			return
+		}
 		var telemetryData TelemetryData
 		body, _ := ioutil.ReadAll(r.Body) // check for errors
 		err := json.Unmarshal(body, &telemetryData)
@@ -88,6 +108,659 @@ func (rs *RouterServer) dumpClients(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (rs *RouterServer) getUsage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var usageMessage messages.UsageMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &usageMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling usage Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		usage, err := rs.tel.clientUsageJson(usageMessage.Mbody.MACAddress, usageMessage.Mbody.Period)
+		if err == nil {
+			fmt.Fprintf(w, string(usage))
+		} else {
+			rs.l.Error("Error while dumping client usage", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) exportConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var configMessage messages.ConfigMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		if len(body) > 0 {
+			err := json.Unmarshal(body, &configMessage)
+			if err != nil {
+				rs.l.Error("Error while unmarshalling config Message", err)
+				fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+				return
+			}
+		}
+		archive, err := rs.tel.exportConfig(configMessage.Mbody.Passphrase)
+		if err == nil {
+			fmt.Fprint(w, string(archive))
+		} else {
+			rs.l.Error("Error while exporting the configuration", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) importConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var configMessage messages.ConfigMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &configMessage)
+		if err != nil || configMessage.Mbody.Archive == nil {
+			rs.l.Error("Error while unmarshalling config Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString("Invalid configuration archive"))
+			return
+		}
+		err = rs.tel.importConfig(*configMessage.Mbody.Archive, configMessage.Mbody.Passphrase)
+		if err != nil {
+			rs.l.Error("Error while importing the configuration", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		groups, err := rs.tel.groupsJson()
+		if err == nil {
+			fmt.Fprintf(w, string(groups))
+		} else {
+			rs.l.Error("Error while dumping client groups", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+// Handles create, delete, assign and pause of the client groups
+func (rs *RouterServer) updateGroup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var groupMessage messages.GroupMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &groupMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling group Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		var output string
+		switch r.URL.Path {
+		case "/creategroup":
+			output = rs.tel.createGroup(groupMessage.Mbody.Name)
+		case "/deletegroup":
+			output = rs.tel.deleteGroup(groupMessage.Mbody.Name)
+		case "/assigngroup":
+			output = rs.tel.assignGroup(groupMessage.Mbody.Name, groupMessage.Mbody.Clients)
+		case "/pausegroup":
+			output = rs.tel.pauseGroup(groupMessage.Mbody.Name, groupMessage.Mbody.Pause)
+		}
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) setGroupPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var policyMessage messages.GroupPolicyMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &policyMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling group policy Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setGroupPolicy(policyMessage.Mbody)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getAnomalyConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		config, err := rs.tel.anomalyConfigJson()
+		if err == nil {
+			fmt.Fprintf(w, string(config))
+		} else {
+			rs.l.Error("Error while dumping anomaly config", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setAnomalyConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var configMessage messages.AnomalyConfigMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &configMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling anomaly config Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setAnomalyConfig(configMessage.Mbody)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getFlows(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var flowsMessage messages.FlowsMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &flowsMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling flows Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		flows, err := rs.tel.clientFlowsJson(flowsMessage.Mbody.MACAddress, flowsMessage.Mbody.Period, flowsMessage.Mbody.Count)
+		if err == nil {
+			fmt.Fprintf(w, string(flows))
+		} else {
+			rs.l.Error("Error while dumping client flows", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) getDNSActivity(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var activityMessage messages.DNSActivityMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &activityMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling dns activity Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		activity, err := rs.tel.dnsActivityJson(activityMessage.Mbody.MACAddress, activityMessage.Mbody.Count)
+		if err == nil {
+			fmt.Fprintf(w, string(activity))
+		} else {
+			rs.l.Error("Error while dumping dns activity", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) getBlockCategories(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		categories, err := rs.tel.Filters.categoriesJson()
+		if err == nil {
+			fmt.Fprintf(w, string(categories))
+		} else {
+			rs.l.Error("Error while dumping blocklist categories", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) getFilterProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		profiles, err := rs.tel.Filters.profilesJson()
+		if err == nil {
+			fmt.Fprintf(w, string(profiles))
+		} else {
+			rs.l.Error("Error while dumping filter profiles", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setFilterProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var profilesMessage messages.FilterProfilesMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &profilesMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling filter profiles Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setFilterProfiles(profilesMessage.Mbody.Profiles)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) createGuestPass(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var passMessage messages.GuestPassMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &passMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling guest pass Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		pass, err := rs.tel.Guest.create(passMessage.Mbody)
+		if err != nil {
+			rs.l.Error("Error while creating guest pass ", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		fmt.Fprint(w, pass)
+	}
+}
+
+func (rs *RouterServer) listGuestPasses(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		passes, err := rs.tel.Guest.listJson()
+		if err == nil {
+			fmt.Fprintf(w, string(passes))
+		} else {
+			rs.l.Error("Error while dumping guest passes", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) revokeGuestPass(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var passMessage messages.GuestPassMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &passMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling guest pass Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		err = rs.tel.Guest.revoke(passMessage.Mbody.Id)
+		if err != nil {
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getQuarantine(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		quarantine, err := rs.tel.quarantineJson()
+		if err == nil {
+			fmt.Fprintf(w, string(quarantine))
+		} else {
+			rs.l.Error("Error while dumping quarantine", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setQuarantine(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var quarantineMessage messages.QuarantineMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &quarantineMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling quarantine Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setQuarantine(quarantineMessage.Mbody.Mode)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) approveClient(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var approveMessage messages.ApproveClientMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &approveMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling approve client Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.approveClient(approveMessage.Mbody.MACAddress, approveMessage.Mbody.Approve)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) wakeClient(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var wakeMessage messages.WakeClientMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &wakeMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling wake client Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.wakeClient(wakeMessage.Mbody.Client)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getPresence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		presence, err := rs.tel.presenceJson()
+		if err == nil {
+			fmt.Fprintf(w, string(presence))
+		} else {
+			rs.l.Error("Error while dumping presence", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setPresence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var presenceMessage messages.PresenceMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &presenceMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling presence Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setPresence(presenceMessage.Mbody)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getStationHistory(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var historyMessage messages.StationHistoryMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &historyMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling station history Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		history, err := rs.tel.stationHistoryJson(historyMessage.Mbody.MACAddress)
+		if err == nil {
+			fmt.Fprintf(w, string(history))
+		} else {
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) getSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var scheduleMessage messages.ScheduleMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &scheduleMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling schedule Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		schedules, err := rs.tel.schedulesJson(scheduleMessage.Mbody.MACAddress)
+		if err == nil {
+			fmt.Fprintf(w, string(schedules))
+		} else {
+			rs.l.Error("Error while dumping schedules", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var scheduleMessage messages.ScheduleMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &scheduleMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling schedule Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setSchedules(scheduleMessage.Mbody.MACAddress, scheduleMessage.Mbody.Schedules)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getQuotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		quotas, err := rs.tel.quotasJson()
+		if err == nil {
+			fmt.Fprintf(w, string(quotas))
+		} else {
+			rs.l.Error("Error while dumping quotas", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setQuotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var quotasMessage messages.QuotasMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &quotasMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling quotas Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setQuotas(quotasMessage.Mbody.Quotas)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getIPBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		feeds, err := rs.tel.Blocklist.feedsJson()
+		if err == nil {
+			fmt.Fprintf(w, string(feeds))
+		} else {
+			rs.l.Error("Error while dumping blocklist feeds", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setIPBlocklist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var blocklistMessage messages.IPBlocklistMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &blocklistMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling ip blocklist Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		err = rs.tel.Blocklist.setFeeds(blocklistMessage.Mbody.Feeds)
+		if err != nil {
+			rs.l.Error("Error while setting blocklist feeds", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		// Fetch the new feeds on the next telemetry tick
+		rs.tel.Lock()
+		rs.tel.blocklistupdated = 0
+		rs.tel.Unlock()
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var eventsMessage messages.EventsMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &eventsMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling events Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		filter := EventFilter{
+			Since:      eventsMessage.Mbody.Since,
+			Etypes:     eventsMessage.Mbody.Etypes,
+			MACAddress: eventsMessage.Mbody.MACAddress,
+			Limit:      eventsMessage.Mbody.Limit,
+		}
+		jsonData, err := json.Marshal(rs.tel.Journal.query(filter))
+		if err != nil {
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		fmt.Fprintf(w, string(jsonData))
+	}
+}
+
+// Streams the journal as server-sent events. Query parameters since, etype
+// (comma separated) and mac filter the events. A client reconnecting with
+// Last-Event-ID continues where it left off
+func (rs *RouterServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var filter EventFilter
+	since := r.URL.Query().Get("since")
+	if lastid := r.Header.Get("Last-Event-ID"); lastid != "" {
+		since = lastid
+	}
+	if since != "" {
+		filter.Since, _ = strconv.ParseUint(since, 10, 64)
+	}
+	filter.MACAddress = r.URL.Query().Get("mac")
+	if etypes := r.URL.Query().Get("etype"); etypes != "" {
+		for _, etype := range strings.Split(etypes, ",") {
+			value, err := strconv.Atoi(etype)
+			if err == nil {
+				filter.Etypes = append(filter.Etypes, value)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Subscribe before replaying so that nothing falls in between
+	ch := rs.tel.Journal.subscribe()
+	defer rs.tel.Journal.unsubscribe(ch)
+
+	send := func(ev messages.EventInfo) bool {
+		if !filter.match(&ev) {
+			return true
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: router_event\ndata: %s\n\n", ev.Seq, data)
+		if err != nil {
+			return false
+		}
+		filter.Since = ev.Seq
+		return true
+	}
+	for {
+		events := rs.tel.Journal.query(filter)
+		for _, ev := range events {
+			if !send(ev) {
+				return
+			}
+		}
+		if len(events) < MAX_EVENTS_PER_QUERY {
+			break
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				// Fell behind. The client reconnects with Last-Event-ID
+				return
+			}
+			if !send(ev) {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
 func (rs *RouterServer) pauseClient(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
@@ -156,12 +829,17 @@ func (rs *RouterServer) registerRepeater(w http.ResponseWriter, r *http.Request)
 	case "POST":
 		body, _ := ioutil.ReadAll(r.Body) // check for errors
 
-		err := rs.tel.registerRepeater(body)
+		var vpnip string
+		if ip := addrIP(r.RemoteAddr); rs.overTunnel(localIP(r), ip) {
+			vpnip = ip.String()
+		}
+		token, err := rs.tel.registerRepeater(body, vpnip)
 		if err != nil {
 			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
 			return
 		}
-		fmt.Fprintf(w, "{\"status\":\"success\"}")
+		jsonData, _ := json.Marshal(mp{"status": "success", "token": token})
+		fmt.Fprintf(w, string(jsonData))
 	}
 }
 
@@ -178,6 +856,85 @@ func (rs *RouterServer) getRepeaters(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (rs *RouterServer) getTopology(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		topology, err := rs.tel.topologyJson()
+		if err == nil {
+			fmt.Fprintf(w, string(topology))
+		} else {
+			rs.l.Error("Error while dumping topology", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) upgrade(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var upgradeMessage messages.UpgradeMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &upgradeMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling upgrade Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.Upgrade.start(upgradeMessage.Mbody)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
+func (rs *RouterServer) getUpgradeStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		status, err := rs.tel.Upgrade.statusJson()
+		if err == nil {
+			fmt.Fprintf(w, string(status))
+		} else {
+			rs.l.Error("Error while dumping upgrade status", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) getChannelPlan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		plan, err := rs.tel.channelPlanJson()
+		if err == nil {
+			fmt.Fprintf(w, string(plan))
+		} else {
+			rs.l.Error("Error while dumping channel plan", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+		}
+	}
+}
+
+func (rs *RouterServer) setChannelPlan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var planMessage messages.ChannelPlanMessage
+		body, _ := ioutil.ReadAll(r.Body) // check for errors
+		err := json.Unmarshal(body, &planMessage)
+		if err != nil {
+			rs.l.Error("Error while unmarshalling channel plan Message", err)
+			fmt.Fprintf(w, nh_util.NH_getErrorStatusString(err.Error()))
+			return
+		}
+		output := rs.tel.setChannelPlan(planMessage.Mbody)
+		if output != "" {
+			fmt.Fprintf(w, output)
+			return
+		}
+		fmt.Fprintf(w, "{\"status\":\"success\"}")
+	}
+}
+
 func (rs *RouterServer) isOnboardingOpen(w http.ResponseWriter, r *http.Request) {
 	cmd := "/sbin/uci"
 	args := []string{"get", "wireless.onboard.device"}
@@ -224,6 +981,7 @@ func (rs *RouterServer) GetRouterEventMessage(event *RouterEvent) ([]byte, error
 		"name":       event.Client.Name,
 		"extra":      event.Extra,
 		"tstamp":     event.Tstamp,
+		"source":     event.Source,
 	}
 	jc1 := mp{
 		"type":  "router_event",
@@ -239,21 +997,70 @@ func (rs *RouterServer) GetRouterEventMessage(event *RouterEvent) ([]byte, error
 }
 
 func (rs *RouterServer) StartRouterServer() error {
-	http.HandleFunc("/telemetry", rs.telemetry)
-	http.HandleFunc("/radios", rs.wireless)
-	http.HandleFunc("/command", rs.processCommand)
-	http.HandleFunc("/clients", rs.dumpClients)
-	http.HandleFunc("/setclientdetails", rs.setClientDetails)
-	http.HandleFunc("/pause", rs.pauseClient)
-	http.HandleFunc("/unpause", rs.pauseClient)
-	http.HandleFunc("/pauseall", rs.pauseClient)
-	http.HandleFunc("/unpauseall", rs.pauseClient)
-	http.HandleFunc("/register_repeater", rs.registerRepeater)
-	http.HandleFunc("/repeaters", rs.getRepeaters)
-	http.HandleFunc("/isonboardingopen", rs.isOnboardingOpen)
-	http.HandleFunc("/router_onboard_status", rs.router_onboard_status)
-	http.HandleFunc("/uploadlogs", rs.uploadLogs)
+	http.HandleFunc("/telemetry", rs.authenticate(rs.telemetry))
+	http.HandleFunc("/radios", rs.authenticate(rs.wireless))
+	http.HandleFunc("/command", rs.authenticate(rs.processCommand))
+	http.HandleFunc("/clients", rs.authenticate(rs.dumpClients))
+	http.HandleFunc("/setclientdetails", rs.authenticate(rs.setClientDetails))
+	http.HandleFunc("/usage", rs.authenticate(rs.getUsage))
+	http.HandleFunc("/exportconfig", rs.authenticate(rs.exportConfig))
+	http.HandleFunc("/importconfig", rs.authenticate(rs.importConfig))
+	http.HandleFunc("/groups", rs.authenticate(rs.getGroups))
+	http.HandleFunc("/creategroup", rs.authenticate(rs.updateGroup))
+	http.HandleFunc("/deletegroup", rs.authenticate(rs.updateGroup))
+	http.HandleFunc("/assigngroup", rs.authenticate(rs.updateGroup))
+	http.HandleFunc("/pausegroup", rs.authenticate(rs.updateGroup))
+	http.HandleFunc("/setgrouppolicy", rs.authenticate(rs.setGroupPolicy))
+	http.HandleFunc("/getanomalyconfig", rs.authenticate(rs.getAnomalyConfig))
+	http.HandleFunc("/setanomalyconfig", rs.authenticate(rs.setAnomalyConfig))
+	http.HandleFunc("/flows", rs.authenticate(rs.getFlows))
+	http.HandleFunc("/dnsactivity", rs.authenticate(rs.getDNSActivity))
+	http.HandleFunc("/blockcategories", rs.authenticate(rs.getBlockCategories))
+	http.HandleFunc("/getfilterprofiles", rs.authenticate(rs.getFilterProfiles))
+	http.HandleFunc("/setfilterprofiles", rs.authenticate(rs.setFilterProfiles))
+	http.HandleFunc("/createguestpass", rs.authenticate(rs.createGuestPass))
+	http.HandleFunc("/guestpasses", rs.authenticate(rs.listGuestPasses))
+	http.HandleFunc("/revokeguestpass", rs.authenticate(rs.revokeGuestPass))
+	http.HandleFunc("/getquarantine", rs.authenticate(rs.getQuarantine))
+	http.HandleFunc("/setquarantine", rs.authenticate(rs.setQuarantine))
+	http.HandleFunc("/approveclient", rs.authenticate(rs.approveClient))
+	http.HandleFunc("/wakeclient", rs.authenticate(rs.wakeClient))
+	http.HandleFunc("/getpresence", rs.authenticate(rs.getPresence))
+	http.HandleFunc("/setpresence", rs.authenticate(rs.setPresence))
+	http.HandleFunc("/stationhistory", rs.authenticate(rs.getStationHistory))
+	http.HandleFunc("/getschedules", rs.authenticate(rs.getSchedules))
+	http.HandleFunc("/setschedules", rs.authenticate(rs.setSchedules))
+	http.HandleFunc("/getquotas", rs.authenticate(rs.getQuotas))
+	http.HandleFunc("/setquotas", rs.authenticate(rs.setQuotas))
+	http.HandleFunc("/getipblocklist", rs.authenticate(rs.getIPBlocklist))
+	http.HandleFunc("/setipblocklist", rs.authenticate(rs.setIPBlocklist))
+	http.HandleFunc("/getevents", rs.authenticate(rs.getEvents))
+	http.HandleFunc("/events", rs.authenticate(rs.streamEvents))
+	http.HandleFunc("/pause", rs.authenticate(rs.pauseClient))
+	http.HandleFunc("/unpause", rs.authenticate(rs.pauseClient))
+	http.HandleFunc("/pauseall", rs.authenticate(rs.pauseClient))
+	http.HandleFunc("/unpauseall", rs.authenticate(rs.pauseClient))
+	http.HandleFunc("/register_repeater", rs.authenticate(rs.registerRepeater))
+	http.HandleFunc("/repeaters", rs.authenticate(rs.getRepeaters))
+	http.HandleFunc("/topology", rs.authenticate(rs.getTopology))
+	http.HandleFunc("/getchannelplan", rs.authenticate(rs.getChannelPlan))
+	http.HandleFunc("/setchannelplan", rs.authenticate(rs.setChannelPlan))
+	http.HandleFunc("/upgrade", rs.authenticate(rs.upgrade))
+	http.HandleFunc("/upgradestatus", rs.authenticate(rs.getUpgradeStatus))
+	http.HandleFunc("/isonboardingopen", rs.authenticate(rs.isOnboardingOpen))
+	http.HandleFunc("/router_onboard_status", rs.authenticate(rs.router_onboard_status))
+	http.HandleFunc("/uploadlogs", rs.authenticate(rs.uploadLogs))
 
+	// The other units of the mesh come in over mutual TLS
+	if rs.identity != nil {
+		go func() {
+			server := &http.Server{
+				Addr:      "0.0.0.0:" + strconv.Itoa(ROUTER_API_TLS_PORT),
+				TLSConfig: rs.identity.serverConfig(),
+			}
+			rs.l.Error("Router api over TLS stopped ", server.ListenAndServeTLS("", ""))
+		}()
+	}
 	rs.l.Fatal(http.ListenAndServe("0.0.0.0:11000", nil))
 	rs.l.Info("SServer started at port 11000\n")
 
@@ -0,0 +1,169 @@
+//go:build sim
+// +build sim
+
+package router
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// Simulated router for development and tests. The state is kept under
+// SIM_BASE and what the scripts do on a router is recorded by the simulator
+const SIM_BASE_DEFAULT = "/tmp/nearhop_sim/"
+
+// Overrides SIM_BASE_DEFAULT, e.g. to run two simulated routers side by side
+const SIM_BASE_ENV = "NEARHOP_SIM_BASE"
+const SIM_FW_VERSION = "sim-1.0.0"
+
+const LAN_IFNAME = "sim0"
+
+// Set by SetSimBase
+var SIM_BASE string
+var DB_CLIENTS_LOCATION string
+var DB_USAGE_LOCATION string
+var DB_QUOTAS_FILE string
+var DB_BLOCKLIST_LOCATION string
+var DB_BLOCKLIST_FEEDS_FILE string
+var DB_EVENTS_FILE string
+var DB_API_SECRET_FILE string
+var DB_UPGRADE_FILE string
+var DB_FW_PUBKEY_FILE string
+var FW_IMAGE_FILE string
+var DB_CHANNEL_PLAN_FILE string
+var DB_PRESENCE_FILE string
+var DB_GUEST_PASSES_FILE string
+var DB_BLOCK_CATEGORIES_FILE string
+var DB_FILTER_PROFILES_FILE string
+var DB_FILTER_CONFIG_FILE string
+var DB_DNS_ACTIVITY_LOCATION string
+var DNS_QUERY_LOG_FILE string
+var DB_QUARANTINE_FILE string
+var DB_ANOMALY_FILE string
+var DB_GROUPS_FILE string
+var DHCP_LEASES_FILE string
+var DB_CATEGORY_DOMAINS_LOCATION string
+var DB_REPEATERS_FILE string
+var nearhop_hostnames string
+
+// The scripts of the simulated router succeed without doing anything
+const fw_upgrade_script = "true"
+const fw_rollback_script = "true"
+const get_hostname_cmd = "true"
+const applyFilterProfilesScript = "true"
+const updateBlockedURLsScript = "true"
+
+func init() {
+	base := os.Getenv(SIM_BASE_ENV)
+	if base == "" {
+		base = SIM_BASE_DEFAULT
+	}
+	SetSimBase(base)
+}
+
+// Keeps the state of the simulated router under dir from now on. Tests call
+// it with a directory of their own before creating the router server
+func SetSimBase(dir string) {
+	SIM_BASE = strings.TrimSuffix(dir, "/") + "/"
+	DB_CLIENTS_LOCATION = SIM_BASE + "clients/"
+	DB_USAGE_LOCATION = SIM_BASE + "usage/"
+	DB_QUOTAS_FILE = SIM_BASE + "quotas.json"
+	DB_BLOCKLIST_LOCATION = SIM_BASE + "blocklist/"
+	DB_BLOCKLIST_FEEDS_FILE = SIM_BASE + "blocklist_feeds.json"
+	DB_EVENTS_FILE = SIM_BASE + "events.log"
+	DB_API_SECRET_FILE = SIM_BASE + "api_secret"
+	DB_UPGRADE_FILE = SIM_BASE + "upgrade.json"
+	DB_FW_PUBKEY_FILE = SIM_BASE + "fw_signing.pub"
+	FW_IMAGE_FILE = SIM_BASE + "nearhop_fw.img"
+	DB_CHANNEL_PLAN_FILE = SIM_BASE + "channel_plan.json"
+	DB_PRESENCE_FILE = SIM_BASE + "presence.json"
+	DB_GUEST_PASSES_FILE = SIM_BASE + "guest_passes.json"
+	DB_BLOCK_CATEGORIES_FILE = SIM_BASE + "block_categories.json"
+	DB_FILTER_PROFILES_FILE = SIM_BASE + "filter_profiles.json"
+	DB_FILTER_CONFIG_FILE = SIM_BASE + "nearhop_filter_profiles.conf"
+	DB_DNS_ACTIVITY_LOCATION = SIM_BASE + "dns_activity/"
+	DNS_QUERY_LOG_FILE = SIM_BASE + "nearhop_dns_queries.log"
+	DB_QUARANTINE_FILE = SIM_BASE + "quarantine.json"
+	DB_ANOMALY_FILE = SIM_BASE + "anomaly.json"
+	DB_GROUPS_FILE = SIM_BASE + "groups.json"
+	DHCP_LEASES_FILE = SIM_BASE + "dhcp.leases"
+	DB_CATEGORY_DOMAINS_LOCATION = SIM_BASE + "categories/"
+	DB_REPEATERS_FILE = SIM_BASE + "repeaters.json"
+	nearhop_hostnames = SIM_BASE + "hostnames.txt"
+	nh_util.NH_create_dir(SIM_BASE, 0755)
+	messages.Sim_set_base(SIM_BASE)
+}
+
+func Router_onboarded(opmode string) {
+}
+
+func getFileName(mac string) string {
+	filename := DB_CLIENTS_LOCATION + strings.Replace(mac, ":", "_", -1)
+	return filename
+}
+
+func getUsageFileName(mac string) string {
+	filename := DB_USAGE_LOCATION + strings.Replace(mac, ":", "_", -1)
+	return filename
+}
+
+func pauseClient(mac string, ip string, name string, pause bool) string {
+	currentSimulator().setPaused(mac, pause)
+	return ""
+}
+
+// Limits the client to the internet, no access to the LAN
+func isolateClient(mac string, ip string, isolate bool) string {
+	currentSimulator().setIsolated(mac, isolate)
+	return ""
+}
+
+func pauseAll(pause bool) string {
+	currentSimulator().setPausedAll(pause)
+	return ""
+}
+
+func getSignalQuality(rssi int) int {
+	if rssi > -40 {
+		return SIGNAL_QUALITY_EXCELLENT
+	} else if rssi > -75 {
+		return SIGNAL_QUALITY_GOOD
+	} else {
+		return SIGNAL_QUALITY_AVERAGE
+	}
+}
+
+// DHCP option 55 (parameter request list) of the client, "na" when not known
+func getDHCPFingerprint(mac string) string {
+	return currentSimulator().fingerprint(mac)
+}
+
+func getFwVersion() string {
+	return SIM_FW_VERSION
+}
+
+func get_host_name(mac string) string {
+	return currentSimulator().hostName(mac)
+}
+
+func addDNSEntryPlatform(client *RouterClient) {
+}
+
+// Has dnsmasq log the queries with the client address (log-queries=extra)
+func setDNSQueryLog(enable bool) {
+}
+
+// The simulator feeds the telemetry as the capture daemon would
+func platformTelemetrySource(name string, interval time.Duration) TelemetrySource {
+	if name == TELEMETRY_SOURCE_SIM {
+		return &simSource{interval: interval}
+	}
+	return nil
+}
+
+func applyDNSEntries() {
+}
@@ -0,0 +1,488 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	messages "messages"
+)
+
+// Generated by the simulator instead of pushed by the capture daemon
+const TELEMETRY_SOURCE_SIM = "sim"
+
+// Destination a simulated client talks to
+type SimDestination struct {
+	Ip    string
+	Port  int
+	Proto int
+	// Name the client looked up, empty for none
+	Host string
+}
+
+type SimClient struct {
+	Mac  string
+	Ip   string
+	Name string
+	// DHCP option 55 of the client
+	Fingerprint string
+	// Radio of the node the client is associated to, empty for a wired client
+	Radio string
+	// Repeater the client is connected through, empty for the root
+	Repeater string
+	Rssi     int
+	// Average bytes per second, received and sent
+	RateIn  int
+	RateOut int
+	// Picked from for the connections of each round
+	Destinations []SimDestination
+	Offline      bool
+}
+
+type SimRepeater struct {
+	Mac   string
+	MMac  string
+	Ip    string
+	Name  string
+	Fwver string
+	// Signal of the mesh backhaul at the root
+	BackhaulRssi int
+	Offline      bool
+}
+
+type simRadio struct {
+	name    string
+	band    string
+	channel int
+}
+
+var simRadios = []simRadio{
+	{"wl0", BAND_2G, 6},
+	{"wl1", BAND_5G, 36},
+}
+
+var simCloud = []SimDestination{
+	{"142.250.74.46", 443, 6, "www.google.com"},
+	{"157.240.22.35", 443, 6, "www.facebook.com"},
+	{"52.94.236.248", 443, 6, "api.amazon.com"},
+	{"23.246.2.136", 443, 6, "occ-0-2705-1001.1.nflxso.net"},
+	{"17.253.144.10", 443, 6, "www.apple.com"},
+	{"140.82.121.4", 443, 6, "github.com"},
+	{"142.250.185.110", 443, 17, "rr3---sn-4g5e6nsz.googlevideo.com"},
+}
+
+var simIoTCloud = []SimDestination{
+	{"35.157.112.41", 8883, 6, "a1x2y3.iot.eu-central-1.amazonaws.com"},
+	{"52.28.190.8", 443, 6, "device-metrics-us.amazon.com"},
+}
+
+// A household with phones, laptops, a TV, IoT devices and a repeater upstairs
+func simHousehold() ([]*SimClient, []*SimRepeater) {
+	clients := []*SimClient{
+		{Mac: "f0:25:b7:10:20:01", Ip: "192.168.1.101", Name: "Galaxy-S21", Fingerprint: "1,3,6,15,26,28,51,58,59,43",
+			Radio: "wl1", Rssi: -52, RateIn: 40000, RateOut: 4000, Destinations: simCloud},
+		{Mac: "a4:5e:60:10:20:02", Ip: "192.168.1.102", Name: "MacBook-Air", Fingerprint: "1,121,3,6,15,119,252,95,44,46",
+			Radio: "wl1", Rssi: -47, RateIn: 250000, RateOut: 30000, Destinations: simCloud},
+		{Mac: "b8:ac:6f:10:20:03", Ip: "192.168.1.103", Name: "Office-PC", Fingerprint: "1,3,6,15,31,33,43,44,46,47,119,121,249,252",
+			RateIn: 120000, RateOut: 20000, Destinations: simCloud},
+		{Mac: "5c:0a:5b:10:20:04", Ip: "192.168.1.104", Name: "Living-Room-TV",
+			Radio: "wl1", Rssi: -61, RateIn: 700000, RateOut: 5000, Destinations: simCloud[3:4]},
+		{Mac: "24:0a:c4:10:20:05", Ip: "192.168.1.105", Name: "esp-thermostat", Fingerprint: "1,3,28,6",
+			Radio: "wl0", Rssi: -71, RateIn: 100, RateOut: 300, Destinations: simIoTCloud},
+		{Mac: "c0:ee:fb:10:20:06", Ip: "192.168.1.106", Name: "OnePlus-Kids", Fingerprint: "1,3,6,15,26,28,51,58,59",
+			Radio: "wl0", Repeater: "02:5e:11:00:00:01", Rssi: -58, RateIn: 60000, RateOut: 6000, Destinations: simCloud},
+	}
+	repeaters := []*SimRepeater{
+		{Mac: "02:5e:11:00:00:01", MMac: "02:5e:11:00:00:02", Ip: "192.168.1.2", Name: "Upstairs",
+			Fwver: SIM_FW_VERSION, BackhaulRssi: -63},
+	}
+	return clients, repeaters
+}
+
+// Generates the telemetry of a simulated household and records what the
+// platform was asked to do. Tests drive it through RouterServer.Simulator
+type Simulator struct {
+	sync.Mutex
+	tel       *Telemetry
+	rand      *rand.Rand
+	clients   []*SimClient
+	repeaters []*SimRepeater
+	// Connections to report in the next round
+	pending   map[string][]Con
+	paused    map[string]bool
+	isolated  map[string]bool
+	pausedAll bool
+	started   bool
+}
+
+func NewSimulator(seed int64) *Simulator {
+	sim := &Simulator{
+		rand:     rand.New(rand.NewSource(seed)),
+		pending:  make(map[string][]Con),
+		paused:   make(map[string]bool),
+		isolated: make(map[string]bool),
+	}
+	sim.clients, sim.repeaters = simHousehold()
+	return sim
+}
+
+// Used by the platform functions of router_sim.go, see currentSimulator
+var simulator = NewSimulator(1)
+var simulatorLock sync.Mutex
+
+func currentSimulator() *Simulator {
+	simulatorLock.Lock()
+	defer simulatorLock.Unlock()
+	return simulator
+}
+
+// Starts over with a new household from seed and the settings of a new
+// router. Tests call it between cases, after SetSimBase
+func ResetSimulator(seed int64) {
+	simulatorLock.Lock()
+	simulator = NewSimulator(seed)
+	simulatorLock.Unlock()
+	messages.Sim_reset_settings()
+}
+
+// The simulator behind the platform functions. It is attached to the
+// telemetry of rs, so Tick and InjectEvent work without the sim source
+func (rs *RouterServer) Simulator() *Simulator {
+	sim := currentSimulator()
+	sim.attach(rs.tel)
+	return sim
+}
+
+// Registers the repeaters the first time, as they would on boot
+func (sim *Simulator) attach(tel *Telemetry) {
+	sim.Lock()
+	sim.tel = tel
+	if sim.started {
+		sim.Unlock()
+		return
+	}
+	sim.started = true
+	repeaters := make([]RepeaterMessage, 0, len(sim.repeaters))
+	for _, r := range sim.repeaters {
+		repeaters = append(repeaters, RepeaterMessage{Type: "repeater", Name: r.Name, Mac: r.Mac, MMac: r.MMac, Ip: r.Ip, Fwver: r.Fwver})
+	}
+	sim.Unlock()
+	for _, r := range repeaters {
+		rbytes, _ := json.Marshal(r)
+		_, err := tel.registerRepeater(rbytes, "")
+		if err != nil {
+			tel.l.WithField("repeater", r.Mac).Error("Error while registering the simulated repeater ", err)
+		}
+	}
+}
+
+func (sim *Simulator) client(mac string) *SimClient {
+	for _, c := range sim.clients {
+		if c.Mac == mac {
+			return c
+		}
+	}
+	return nil
+}
+
+func (sim *Simulator) repeater(mac string) *SimRepeater {
+	for _, r := range sim.repeaters {
+		if r.Mac == mac {
+			return r
+		}
+	}
+	return nil
+}
+
+// Adds the client, or replaces the one with the same MAC
+func (sim *Simulator) AddClient(client SimClient) {
+	sim.Lock()
+	defer sim.Unlock()
+	for i, c := range sim.clients {
+		if c.Mac == client.Mac {
+			sim.clients[i] = &client
+			return
+		}
+	}
+	sim.clients = append(sim.clients, &client)
+}
+
+// Takes the client off the network, or brings it back
+func (sim *Simulator) SetClientOffline(mac string, offline bool) error {
+	sim.Lock()
+	defer sim.Unlock()
+	c := sim.client(mac)
+	if c == nil {
+		return fmt.Errorf("No simulated client %s", mac)
+	}
+	c.Offline = offline
+	return nil
+}
+
+// Moves the client to a radio of the root or of a repeater. An empty radio
+// makes it wired
+func (sim *Simulator) MoveClient(mac string, repeater string, radio string, rssi int) error {
+	sim.Lock()
+	defer sim.Unlock()
+	c := sim.client(mac)
+	if c == nil {
+		return fmt.Errorf("No simulated client %s", mac)
+	}
+	if repeater != "" && sim.repeater(repeater) == nil {
+		return fmt.Errorf("No simulated repeater %s", repeater)
+	}
+	c.Repeater = repeater
+	c.Radio = radio
+	c.Rssi = rssi
+	return nil
+}
+
+// Takes the repeater off the network, with the clients behind it
+func (sim *Simulator) SetRepeaterOffline(mac string, offline bool) error {
+	sim.Lock()
+	defer sim.Unlock()
+	r := sim.repeater(mac)
+	if r == nil {
+		return fmt.Errorf("No simulated repeater %s", mac)
+	}
+	r.Offline = offline
+	return nil
+}
+
+// Reports a connection of the client in the next round, e.g. to a blocklisted IP
+func (sim *Simulator) Connect(mac string, dest SimDestination, bytesin int, bytesout int) error {
+	sim.Lock()
+	defer sim.Unlock()
+	if sim.client(mac) == nil {
+		return fmt.Errorf("No simulated client %s", mac)
+	}
+	sim.pending[mac] = append(sim.pending[mac], Con{
+		R_port: dest.Port,
+		R_ip:   dest.Ip,
+		Proto:  dest.Proto,
+		B_in:   []int{bytesin},
+		B_out:  []int{bytesout},
+	})
+	return nil
+}
+
+// What pause_client.sh, isolate_client.sh and pause_all.sh were last told
+func (sim *Simulator) Paused(mac string) bool {
+	sim.Lock()
+	defer sim.Unlock()
+	return sim.paused[mac] || sim.pausedAll
+}
+
+func (sim *Simulator) Isolated(mac string) bool {
+	sim.Lock()
+	defer sim.Unlock()
+	return sim.isolated[mac]
+}
+
+func (sim *Simulator) setPaused(mac string, pause bool) {
+	sim.Lock()
+	defer sim.Unlock()
+	sim.paused[mac] = pause
+}
+
+func (sim *Simulator) setIsolated(mac string, isolate bool) {
+	sim.Lock()
+	defer sim.Unlock()
+	sim.isolated[mac] = isolate
+}
+
+func (sim *Simulator) setPausedAll(pause bool) {
+	sim.Lock()
+	defer sim.Unlock()
+	sim.pausedAll = pause
+}
+
+func (sim *Simulator) hostName(mac string) string {
+	sim.Lock()
+	defer sim.Unlock()
+	if c := sim.client(mac); c != nil {
+		return c.Name
+	}
+	if r := sim.repeater(mac); r != nil {
+		return r.Name
+	}
+	return "na"
+}
+
+func (sim *Simulator) fingerprint(mac string) string {
+	sim.Lock()
+	defer sim.Unlock()
+	if c := sim.client(mac); c != nil && c.Fingerprint != "" {
+		return c.Fingerprint
+	}
+	return "na"
+}
+
+// Around the rate, for seconds
+func (sim *Simulator) bytes(rate int, seconds int) int {
+	return rate * seconds * (50 + sim.rand.Intn(100)) / 100
+}
+
+// Called with the simulator lock held
+func (sim *Simulator) online(c *SimClient) bool {
+	if c.Offline {
+		return false
+	}
+	if c.Repeater != "" {
+		r := sim.repeater(c.Repeater)
+		return r != nil && !r.Offline
+	}
+	return true
+}
+
+// One round of the capture daemon over seconds. Paused clients are seen but
+// their traffic is dropped
+// Called with the simulator lock held
+func (sim *Simulator) traffic(seconds int) (*TelemetryData, map[string]string) {
+	data := &TelemetryData{Devices: make([]Device, 0), Interfaces: make([]Interface, 0)}
+	names := make(map[string]string)
+	for _, c := range sim.clients {
+		if !sim.online(c) {
+			continue
+		}
+		device := Device{Ifname: LAN_IFNAME, Ip: c.Ip, Mac: c.Mac, Conn: make([]Con, 0)}
+		if !sim.paused[c.Mac] && !sim.pausedAll && len(c.Destinations) > 0 {
+			conns := 1 + sim.rand.Intn(len(c.Destinations))
+			for i := 0; i < conns; i++ {
+				dest := c.Destinations[sim.rand.Intn(len(c.Destinations))]
+				if dest.Host != "" {
+					names[dest.Ip] = dest.Host
+				}
+				device.Conn = append(device.Conn, Con{
+					R_port: dest.Port,
+					R_ip:   dest.Ip,
+					Proto:  dest.Proto,
+					B_in:   []int{sim.bytes(c.RateIn, seconds) / conns},
+					B_out:  []int{sim.bytes(c.RateOut, seconds) / conns},
+				})
+			}
+		}
+		device.Conn = append(device.Conn, sim.pending[c.Mac]...)
+		delete(sim.pending, c.Mac)
+		data.Devices = append(data.Devices, device)
+	}
+	return data, names
+}
+
+func simBssid(node string, radio int) string {
+	return fmt.Sprintf("%s%02x", node[:len(node)-2], radio+0x10)
+}
+
+// The radios of the root and of each online repeater, with their stations
+// Called with the simulator lock held
+func (sim *Simulator) radios() []*WirelessTelemetryData {
+	nodes := []*WirelessTelemetryData{{}}
+	nodeMacs := []string{"02:5e:10:00:00:00"}
+	for _, r := range sim.repeaters {
+		if !r.Offline {
+			nodes = append(nodes, &WirelessTelemetryData{Mac: r.Mac})
+			nodeMacs = append(nodeMacs, r.Mac)
+		}
+	}
+	for n, data := range nodes {
+		for i, sr := range simRadios {
+			radio := Radio{Name: sr.name, Channel: sr.channel, Band: sr.band}
+			vap := VAP{Interface: sr.name, Ssid: "NearhopSim", Bssid: simBssid(nodeMacs[n], i), Mode: "ap", Stas: make([]Station, 0)}
+			for _, c := range sim.clients {
+				if c.Radio == sr.name && c.Repeater == data.Mac && sim.online(c) {
+					rssi := c.Rssi + sim.rand.Intn(7) - 3
+					vap.Stas = append(vap.Stas, Station{Mac: c.Mac, Rssi: rssi})
+				}
+			}
+			radio.Vaps = append(radio.Vaps, vap)
+			if n == 0 && sr.band == BAND_5G {
+				// The repeaters hang off the mesh of the root
+				mesh := VAP{Interface: sr.name + ".mesh", Bssid: simBssid(nodeMacs[n], i+len(simRadios)), Mode: "mesh", Stas: make([]Station, 0)}
+				for _, r := range sim.repeaters {
+					if !r.Offline {
+						mesh.Stas = append(mesh.Stas, Station{Mac: r.MMac, Rssi: r.BackhaulRssi + sim.rand.Intn(5) - 2})
+					}
+				}
+				radio.Vaps = append(radio.Vaps, mesh)
+			}
+			data.Radios = append(data.Radios, radio)
+		}
+	}
+	return nodes
+}
+
+// Feeds one round of telemetry over seconds to the attached telemetry
+func (sim *Simulator) round(seconds int) error {
+	sim.Lock()
+	tel := sim.tel
+	if tel == nil {
+		sim.Unlock()
+		return fmt.Errorf("The simulator is not attached to a router")
+	}
+	data, names := sim.traffic(seconds)
+	nodes := sim.radios()
+	sim.Unlock()
+
+	// As if the clients had looked the names up
+	tel.Lock()
+	for ip, host := range names {
+		tel.rememberDNSName(host, ip)
+	}
+	tel.Unlock()
+	err := tel.processTelemetry(data)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		err = tel.processWirelessTelemetry(node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Feeds one round of telemetry now. Tests call it instead of waiting for the sim source
+func (sim *Simulator) Tick() error {
+	return sim.round(int(TELEMETRY_SOURCE_DEFAULT_INTERVAL / time.Second))
+}
+
+// Raises an event for the client as the router would, e.g. ARRIVEDEVENT
+func (sim *Simulator) InjectEvent(etype EventType, mac string, extra string, source string) error {
+	sim.Lock()
+	tel := sim.tel
+	sim.Unlock()
+	if tel == nil {
+		return fmt.Errorf("The simulator is not attached to a router")
+	}
+	tel.Lock()
+	defer tel.Unlock()
+	client := tel.RouterClients[mac]
+	if client == nil {
+		return fmt.Errorf("No such client %s", mac)
+	}
+	tel.newEvent(etype, extra, client, source)
+	return nil
+}
+
+type simSource struct {
+	interval time.Duration
+}
+
+func (ss *simSource) Name() string {
+	return TELEMETRY_SOURCE_SIM
+}
+
+func (ss *simSource) Run(ctx context.Context, tel *Telemetry) {
+	sim := currentSimulator()
+	sim.attach(tel)
+	pollSource(ctx, tel, ss.Name(), ss.interval, func() error {
+		return sim.round(int(ss.interval / time.Second))
+	})
+}
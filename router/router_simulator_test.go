@@ -0,0 +1,158 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	messages "messages"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMac = "a4:5e:60:10:20:02"
+
+// A router with the simulated household, its state in a directory of the test
+func newSimRouter(t *testing.T) (*RouterServer, *Simulator) {
+	SetSimBase(t.TempDir())
+	ResetSimulator(1)
+	l := test.NewLogger()
+	rs := &RouterServer{l: l, push: true, tel: NewTelemetry(l)}
+	return rs, rs.Simulator()
+}
+
+func post(t *testing.T, handler http.HandlerFunc, message interface{}) []byte {
+	body, err := json.Marshal(message)
+	assert.Nil(t, err)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+	return w.Body.Bytes()
+}
+
+func getClients(t *testing.T, rs *RouterServer) map[string]messages.ClientInfo {
+	var clients []messages.ClientInfo
+	err := json.Unmarshal(post(t, rs.dumpClients, nil), &clients)
+	assert.Nil(t, err)
+	byMac := make(map[string]messages.ClientInfo)
+	for _, c := range clients {
+		byMac[c.MACAddress] = c
+	}
+	return byMac
+}
+
+func TestSimGetClients(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Empty(t, getClients(t, rs))
+
+	assert.Nil(t, sim.Tick())
+	clients := getClients(t, rs)
+	assert.Contains(t, clients, "f0:25:b7:10:20:01")
+	assert.Contains(t, clients, "c0:ee:fb:10:20:06")
+	c := clients[testMac]
+	assert.Equal(t, "192.168.1.102", c.IPAddress)
+	// Names are kept with underscores
+	assert.Equal(t, "MacBook_Air", c.Name)
+	assert.False(t, c.Paused)
+
+	// A new client shows up in the next round
+	sim.AddClient(SimClient{Mac: "3c:22:fb:10:20:07", Ip: "192.168.1.107", Name: "iPad", Radio: "wl1", Rssi: -55})
+	assert.NotContains(t, getClients(t, rs), "3c:22:fb:10:20:07")
+	assert.Nil(t, sim.Tick())
+	assert.Equal(t, "192.168.1.107", getClients(t, rs)["3c:22:fb:10:20:07"].IPAddress)
+}
+
+func pauseMessage(mac string, pause bool) messages.PauseMessage {
+	return messages.PauseMessage{Type: "pause_client", Mbody: messages.InnerPauseMessage{MACAddress: mac, Pause: pause}}
+}
+
+func TestSimPauseClient(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+
+	var status map[string]interface{}
+	assert.Nil(t, json.Unmarshal(post(t, rs.pauseClient, pauseMessage(testMac, true)), &status))
+	assert.Equal(t, "success", status["status"])
+	assert.True(t, sim.Paused(testMac))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+	assert.False(t, sim.Paused("f0:25:b7:10:20:01"))
+
+	post(t, rs.pauseClient, pauseMessage(testMac, false))
+	assert.False(t, sim.Paused(testMac))
+	assert.False(t, getClients(t, rs)[testMac].Paused)
+
+	post(t, rs.pauseClient, pauseMessage("all", true))
+	assert.True(t, sim.Paused("f0:25:b7:10:20:01"))
+	for mac, c := range getClients(t, rs) {
+		assert.True(t, c.Paused, mac)
+	}
+	post(t, rs.pauseClient, pauseMessage("all", false))
+	assert.False(t, sim.Paused(testMac))
+}
+
+func TestSimPauseQuarantined(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	assert.Equal(t, "", rs.tel.pauseClient(testMac, true))
+	rs.tel.Lock()
+	rs.tel.RouterClients[testMac].Quarantine = QUARANTINE_PAUSE
+	rs.tel.Unlock()
+
+	assert.NotEqual(t, "", rs.tel.pauseClient(testMac, false))
+	assert.True(t, sim.Paused(testMac))
+
+	// Unpausing everybody leaves the quarantined client paused
+	assert.Equal(t, "", rs.tel.pauseAll(false))
+	assert.True(t, sim.Paused(testMac))
+	assert.False(t, sim.Paused("f0:25:b7:10:20:01"))
+	assert.True(t, getClients(t, rs)[testMac].Paused)
+}
+
+func getEvents(t *testing.T, rs *RouterServer, filter messages.InnerEventsMessage) []messages.EventInfo {
+	var events []messages.EventInfo
+	err := json.Unmarshal(post(t, rs.getEvents, messages.EventsMessage{Type: "get_events", Mbody: filter}), &events)
+	assert.Nil(t, err)
+	return events
+}
+
+func TestSimEvents(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+
+	events := getEvents(t, rs, messages.InnerEventsMessage{Etypes: []int{int(NEWCLIENTEVENT)}, MACAddress: testMac})
+	assert.Len(t, events, 1)
+	assert.Equal(t, "192.168.1.102", events[0].IPAddress)
+
+	// Known clients are not new on the next round
+	last := getEvents(t, rs, messages.InnerEventsMessage{})
+	since := last[len(last)-1].Seq
+	assert.Nil(t, sim.Tick())
+	assert.Empty(t, getEvents(t, rs, messages.InnerEventsMessage{Since: since, Etypes: []int{int(NEWCLIENTEVENT)}}))
+
+	assert.Nil(t, sim.InjectEvent(ANOMALYEVENT, testMac, "port scan", "test"))
+	events = getEvents(t, rs, messages.InnerEventsMessage{Since: since, Etypes: []int{int(ANOMALYEVENT)}})
+	assert.Len(t, events, 1)
+	assert.Equal(t, testMac, events[0].MACAddress)
+	assert.Equal(t, "port scan", events[0].Extra)
+	assert.Equal(t, "test", events[0].Source)
+	assert.Greater(t, events[0].Seq, since)
+
+	assert.NotNil(t, sim.InjectEvent(ANOMALYEVENT, "00:11:22:33:44:55", "", "test"))
+}
+
+func TestSimReset(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	post(t, rs.pauseClient, pauseMessage(testMac, true))
+	assert.FileExists(t, getFileName(testMac))
+
+	// The next router starts empty, with nothing paused
+	rs, sim = newSimRouter(t)
+	assert.False(t, sim.Paused(testMac))
+	assert.Empty(t, getClients(t, rs))
+}
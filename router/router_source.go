@@ -0,0 +1,460 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The capture daemon posts to /telemetry and /radios
+	TELEMETRY_SOURCE_PUSH = "push"
+	// Connections read from the kernel, clients from the DHCP leases and the ARP table
+	TELEMETRY_SOURCE_CONNTRACK = "conntrack"
+	// Wireless clients read with iw, or hostapd_cli
+	TELEMETRY_SOURCE_STATIONS = "stations"
+)
+
+const TELEMETRY_SOURCE_DEFAULT_INTERVAL = 30 * time.Second
+
+const CONNTRACK_FILE = "/proc/net/nf_conntrack"
+const CONNTRACK_ACCT_FILE = "/proc/sys/net/netfilter/nf_conntrack_acct"
+const ARP_FILE = "/proc/net/arp"
+
+// Feeds the telemetry from somewhere. Several sources can run together,
+// e.g. conntrack for the traffic and stations for the wireless clients
+type TelemetrySource interface {
+	Name() string
+	// Feeds tel until ctx is done
+	Run(ctx context.Context, tel *Telemetry)
+}
+
+func newTelemetrySource(name string, interval time.Duration) (TelemetrySource, error) {
+	switch name {
+	case TELEMETRY_SOURCE_PUSH:
+		return &pushSource{}, nil
+	case TELEMETRY_SOURCE_CONNTRACK:
+		return &conntrackSource{interval: interval}, nil
+	case TELEMETRY_SOURCE_STATIONS:
+		return &stationSource{interval: interval}, nil
+	}
+	if source := platformTelemetrySource(name, interval); source != nil {
+		return source, nil
+	}
+	return nil, fmt.Errorf("Unknown telemetry source %s", name)
+}
+
+// Selects where the telemetry comes from. Without it only the capture daemon
+// pushes it. Called before StartRouterServer
+func (rs *RouterServer) SetTelemetrySources(names []string, interval time.Duration) error {
+	if interval <= 0 {
+		interval = TELEMETRY_SOURCE_DEFAULT_INTERVAL
+	}
+	sources := make([]TelemetrySource, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		source, err := newTelemetrySource(name, interval)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("No telemetry source configured")
+	}
+	rs.push = seen[TELEMETRY_SOURCE_PUSH]
+	for _, source := range sources {
+		rs.l.WithField("source", source.Name()).Info("Starting telemetry source")
+		go source.Run(rs.ctx, rs.tel)
+	}
+	return nil
+}
+
+// Runs poll every interval until ctx is done
+func pollSource(ctx context.Context, tel *Telemetry, name string, interval time.Duration, poll func() error) {
+	clockSource := time.NewTicker(interval)
+	defer clockSource.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _ = <-clockSource.C:
+			err := poll()
+			if err != nil && !failing {
+				// Logged once until it works again
+				tel.l.WithField("source", name).Error("Error while reading the telemetry ", err)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// The router api handlers do the work
+type pushSource struct{}
+
+func (ps *pushSource) Name() string {
+	return TELEMETRY_SOURCE_PUSH
+}
+
+func (ps *pushSource) Run(ctx context.Context, tel *Telemetry) {
+}
+
+type conntrackEntry struct {
+	key      string
+	proto    int
+	src      string
+	dst      string
+	dport    int
+	bytesin  uint64
+	bytesout uint64
+}
+
+// Parses a line of /proc/net/nf_conntrack:
+// ipv4 2 tcp 6 431999 ESTABLISHED src=192.168.1.10 dst=93.184.216.34 sport=51234 dport=443 packets=10 bytes=1234 src=93.184.216.34 dst=203.0.113.5 ...
+// The first src/dst/bytes are of the original direction, the second of the reply.
+// The bytes are there when nf_conntrack_acct is on
+func parseConntrackLine(line string) (conntrackEntry, bool) {
+	var e conntrackEntry
+	fields := strings.Fields(line)
+	if len(fields) < 4 || (fields[0] != "ipv4" && fields[0] != "ipv6") {
+		return e, false
+	}
+	proto, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return e, false
+	}
+	e.proto = proto
+	sport := ""
+	direction := 0
+	for _, field := range fields[4:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "src":
+			direction++
+			if direction == 1 {
+				e.src = kv[1]
+			}
+		case "dst":
+			if direction == 1 {
+				e.dst = kv[1]
+			}
+		case "sport":
+			if direction == 1 {
+				sport = kv[1]
+			}
+		case "dport":
+			if direction == 1 {
+				e.dport, _ = strconv.Atoi(kv[1])
+			}
+		case "bytes":
+			b, _ := strconv.ParseUint(kv[1], 10, 64)
+			if direction == 1 {
+				e.bytesout = b
+			} else if direction == 2 {
+				e.bytesin = b
+			}
+		}
+	}
+	if e.src == "" || e.dst == "" {
+		return e, false
+	}
+	e.key = fmt.Sprintf("%d/%s/%s/%s/%d", e.proto, e.src, sport, e.dst, e.dport)
+	return e, true
+}
+
+// IP to MAC of the LAN clients. The DHCP leases (dnsmasq format), then the
+// ARP table for the clients with a static address
+func lanClients() map[string]string {
+	macs := make(map[string]string)
+	content, err := ioutil.ReadFile(DHCP_LEASES_FILE)
+	if err == nil {
+		// <expiry> <mac> <ip> <hostname> <client id>
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				macs[fields[2]] = strings.ToLower(fields[1])
+			}
+		}
+	}
+	content, err = ioutil.ReadFile(ARP_FILE)
+	if err == nil {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 6 || fields[5] != LAN_IFNAME || fields[2] == "0x0" ||
+				fields[3] == "00:00:00:00:00:00" || macs[fields[0]] != "" {
+				continue
+			}
+			macs[fields[0]] = strings.ToLower(fields[3])
+		}
+	}
+	return macs
+}
+
+// B_in and B_out are ints
+func conntrackBytes(b uint64) int {
+	if b > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(b)
+}
+
+// Turns the conntrack counters into the telemetry of the capture daemon. The
+// bytes of a connection are counted from the previous read
+type conntrackSource struct {
+	interval time.Duration
+	counters map[string][2]uint64
+}
+
+func (cs *conntrackSource) Name() string {
+	return TELEMETRY_SOURCE_CONNTRACK
+}
+
+func (cs *conntrackSource) Run(ctx context.Context, tel *Telemetry) {
+	err := ioutil.WriteFile(CONNTRACK_ACCT_FILE, []byte("1"), 0644)
+	if err != nil {
+		tel.l.Warn("Could not turn on conntrack accounting. Only new connections are seen ", err)
+	}
+	pollSource(ctx, tel, cs.Name(), cs.interval, func() error {
+		data, err := cs.poll()
+		if err != nil || data == nil {
+			return err
+		}
+		return tel.processTelemetry(data)
+	})
+}
+
+// Returns nil on the first read. It only learns the counters of the
+// connections that are already open
+func (cs *conntrackSource) poll() (*TelemetryData, error) {
+	content, err := ioutil.ReadFile(CONNTRACK_FILE)
+	if err != nil {
+		return nil, err
+	}
+	macs := lanClients()
+	counters := make(map[string][2]uint64)
+	devices := make(map[string]*Device)
+	order := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		e, ok := parseConntrackLine(line)
+		if !ok {
+			continue
+		}
+		mac := macs[e.src]
+		if mac == "" {
+			// Not started by a LAN client
+			continue
+		}
+		counters[e.key] = [2]uint64{e.bytesin, e.bytesout}
+		if cs.counters == nil {
+			continue
+		}
+		device := devices[mac]
+		if device == nil {
+			device = &Device{Ifname: LAN_IFNAME, Ip: e.src, Mac: mac, Conn: make([]Con, 0)}
+			devices[mac] = device
+			order = append(order, mac)
+		}
+		prev, seen := cs.counters[e.key]
+		if seen && (e.bytesin < prev[0] || e.bytesout < prev[1]) {
+			// The entry was reused by a new connection
+			seen = false
+		}
+		if seen {
+			e.bytesin -= prev[0]
+			e.bytesout -= prev[1]
+			if e.bytesin == 0 && e.bytesout == 0 {
+				continue
+			}
+		}
+		device.Conn = append(device.Conn, Con{
+			R_port: e.dport,
+			R_ip:   e.dst,
+			Proto:  e.proto,
+			B_in:   []int{conntrackBytes(e.bytesin)},
+			B_out:  []int{conntrackBytes(e.bytesout)},
+		})
+	}
+	primed := cs.counters != nil
+	cs.counters = counters
+	if !primed {
+		return nil, nil
+	}
+	data := &TelemetryData{Devices: make([]Device, 0, len(order)), Interfaces: make([]Interface, 0)}
+	for _, mac := range order {
+		data.Devices = append(data.Devices, *devices[mac])
+	}
+	return data, nil
+}
+
+// Reads the stations of the access points with iw. hostapd_cli is tried for
+// the interfaces iw can't dump
+type stationSource struct {
+	interval time.Duration
+}
+
+func (ss *stationSource) Name() string {
+	return TELEMETRY_SOURCE_STATIONS
+}
+
+func (ss *stationSource) Run(ctx context.Context, tel *Telemetry) {
+	pollSource(ctx, tel, ss.Name(), ss.interval, func() error {
+		data, err := ss.poll(ctx)
+		if err != nil {
+			return err
+		}
+		return tel.processWirelessTelemetry(data)
+	})
+}
+
+func (ss *stationSource) poll(ctx context.Context) (*WirelessTelemetryData, error) {
+	out, err := exec.CommandContext(ctx, "iw", "dev").Output()
+	if err != nil {
+		return nil, err
+	}
+	data := &WirelessTelemetryData{Radios: parseIwDev(out)}
+	for i := range data.Radios {
+		radio := &data.Radios[i]
+		for j := range radio.Vaps {
+			vap := &radio.Vaps[j]
+			out, err := exec.CommandContext(ctx, "iw", "dev", vap.Interface, "station", "dump").Output()
+			if err == nil {
+				vap.Stas = parseIwStations(out)
+				continue
+			}
+			out, err = exec.CommandContext(ctx, "hostapd_cli", "-i", vap.Interface, "all_sta").Output()
+			if err != nil {
+				return nil, fmt.Errorf("Stations of %s: %s", vap.Interface, err)
+			}
+			vap.Stas = parseHostapdStations(out)
+		}
+	}
+	return data, nil
+}
+
+func bandOfFrequency(mhz int) string {
+	if mhz < 3000 {
+		return BAND_2G
+	}
+	if mhz >= 5925 {
+		return BAND_6G
+	}
+	return BAND_5G
+}
+
+// Radios of `iw dev` with their access point and mesh interfaces. Each phy#N
+// is followed by its Interface blocks with addr, ssid, type and channel lines,
+// e.g. "channel 36 (5180 MHz), width: 80 MHz"
+func parseIwDev(out []byte) []Radio {
+	radios := make([]Radio, 0)
+	var radio *Radio
+	var vap *VAP
+	addVap := func() {
+		if radio != nil && vap != nil && (vap.Mode == "ap" || vap.Mode == "mesh") {
+			radio.Vaps = append(radio.Vaps, *vap)
+		}
+		vap = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(fields[0], "phy#"):
+			addVap()
+			radios = append(radios, Radio{Name: "phy" + strings.TrimPrefix(fields[0], "phy#"), Vaps: make([]VAP, 0)})
+			radio = &radios[len(radios)-1]
+		case fields[0] == "Interface" && len(fields) > 1:
+			addVap()
+			vap = &VAP{Interface: fields[1], Stas: make([]Station, 0)}
+		case vap == nil:
+		case fields[0] == "addr" && len(fields) > 1:
+			vap.Bssid = strings.ToLower(fields[1])
+		case fields[0] == "ssid":
+			vap.Ssid = strings.TrimSpace(strings.TrimPrefix(line, "ssid"))
+		case fields[0] == "type":
+			switch strings.TrimPrefix(line, "type ") {
+			case "AP":
+				vap.Mode = "ap"
+			case "mesh point":
+				vap.Mode = "mesh"
+			default:
+				vap.Mode = strings.ToLower(strings.TrimPrefix(line, "type "))
+			}
+		case fields[0] == "channel" && len(fields) > 2 && radio != nil:
+			radio.Channel, _ = strconv.Atoi(fields[1])
+			mhz, err := strconv.Atoi(strings.TrimPrefix(fields[2], "("))
+			if err == nil {
+				radio.Band = bandOfFrequency(mhz)
+			}
+		}
+	}
+	addVap()
+	// Radios without an access point have nobody to report
+	aps := make([]Radio, 0, len(radios))
+	for _, radio := range radios {
+		if len(radio.Vaps) > 0 {
+			aps = append(aps, radio)
+		}
+	}
+	return aps
+}
+
+// `iw dev <if> station dump` starts each station with "Station <mac> (on <if>)"
+// followed by lines like "signal: -52 [-54, -55] dBm"
+func parseIwStations(out []byte) []Station {
+	stas := make([]Station, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "Station" {
+			stas = append(stas, Station{Mac: strings.ToLower(fields[1])})
+			continue
+		}
+		if fields[0] == "signal:" && len(stas) > 0 {
+			stas[len(stas)-1].Rssi, _ = strconv.Atoi(fields[1])
+		}
+	}
+	return stas
+}
+
+// hostapd_cli all_sta prints the MAC of each station followed by its key=value lines
+func parseHostapdStations(out []byte) []Station {
+	stas := make([]Station, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "signal=") && len(stas) > 0 {
+			stas[len(stas)-1].Rssi, _ = strconv.Atoi(strings.TrimPrefix(line, "signal="))
+			continue
+		}
+		if len(line) == 17 && strings.Count(line, ":") == 5 {
+			stas = append(stas, Station{Mac: strings.ToLower(line)})
+		}
+	}
+	return stas
+}
@@ -0,0 +1,103 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConntrackLine(t *testing.T) {
+	e, ok := parseConntrackLine("ipv4     2 tcp      6 431999 ESTABLISHED src=192.168.1.10 dst=93.184.216.34 sport=51234 dport=443 packets=10 bytes=1234 src=93.184.216.34 dst=203.0.113.5 sport=443 dport=51234 packets=12 bytes=5678 [ASSURED] mark=0 zone=0 use=2")
+	assert.True(t, ok)
+	assert.Equal(t, conntrackEntry{
+		key:      "6/192.168.1.10/51234/93.184.216.34/443",
+		proto:    6,
+		src:      "192.168.1.10",
+		dst:      "93.184.216.34",
+		dport:    443,
+		bytesin:  5678,
+		bytesout: 1234,
+	}, e)
+
+	// Without nf_conntrack_acct there are no bytes
+	e, ok = parseConntrackLine("ipv6     10 udp      17 29 src=fd00::10 dst=2606:4700::1111 sport=40000 dport=53 src=2606:4700::1111 dst=fd00::10 sport=53 dport=40000 mark=0 use=2")
+	assert.True(t, ok)
+	assert.Equal(t, "17/fd00::10/40000/2606:4700::1111/53", e.key)
+	assert.Equal(t, uint64(0), e.bytesin)
+	assert.Equal(t, uint64(0), e.bytesout)
+
+	// No ports for icmp
+	e, ok = parseConntrackLine("ipv4     2 icmp     1 29 src=192.168.1.10 dst=8.8.8.8 type=8 code=0 id=7 packets=1 bytes=84 src=8.8.8.8 dst=192.168.1.10 type=0 code=0 id=7 packets=1 bytes=84 mark=0 use=2")
+	assert.True(t, ok)
+	assert.Equal(t, 1, e.proto)
+	assert.Equal(t, 0, e.dport)
+
+	_, ok = parseConntrackLine("")
+	assert.False(t, ok)
+	_, ok = parseConntrackLine("arp 2 tcp 6 src=192.168.1.10 dst=93.184.216.34")
+	assert.False(t, ok)
+	_, ok = parseConntrackLine("ipv4 2 tcp x 431999 src=192.168.1.10 dst=93.184.216.34")
+	assert.False(t, ok)
+	_, ok = parseConntrackLine("ipv4 2 tcp 6 431999 ESTABLISHED sport=51234 dport=443")
+	assert.False(t, ok)
+}
+
+const testIwDev = `phy#1
+	Interface wlan1-mesh
+		ifindex 12
+		wdev 0x100000003
+		addr 02:5E:10:00:00:13
+		type mesh point
+		channel 36 (5180 MHz), width: 80 MHz, center1: 5210 MHz
+	Interface wlan1
+		ifindex 10
+		wdev 0x100000002
+		addr 02:5e:10:00:00:11
+		ssid Nearhop Home
+		type AP
+		channel 36 (5180 MHz), width: 80 MHz, center1: 5210 MHz
+		txpower 23.00 dBm
+phy#0
+	Interface wlan0
+		ifindex 9
+		wdev 0x1
+		addr 02:5e:10:00:00:10
+		ssid Nearhop Home
+		type AP
+		channel 6 (2437 MHz), width: 20 MHz, center1: 2437 MHz
+	Interface wlan0-sta
+		ifindex 11
+		addr 02:5e:10:00:00:20
+		type managed
+phy#2
+	Interface wlan2-sta
+		addr 02:5e:10:00:00:30
+		type managed
+		channel 149 (5745 MHz), width: 80 MHz, center1: 5775 MHz
+`
+
+func TestParseIwDev(t *testing.T) {
+	radios := parseIwDev([]byte(testIwDev))
+	// The station only radio has nobody to report
+	assert.Len(t, radios, 2)
+
+	assert.Equal(t, "phy1", radios[0].Name)
+	assert.Equal(t, 36, radios[0].Channel)
+	assert.Equal(t, BAND_5G, radios[0].Band)
+	assert.Equal(t, []VAP{
+		{Interface: "wlan1-mesh", Bssid: "02:5e:10:00:00:13", Mode: "mesh", Stas: []Station{}},
+		{Interface: "wlan1", Ssid: "Nearhop Home", Bssid: "02:5e:10:00:00:11", Mode: "ap", Stas: []Station{}},
+	}, radios[0].Vaps)
+
+	assert.Equal(t, "phy0", radios[1].Name)
+	assert.Equal(t, 6, radios[1].Channel)
+	assert.Equal(t, BAND_2G, radios[1].Band)
+	assert.Equal(t, []VAP{
+		{Interface: "wlan0", Ssid: "Nearhop Home", Bssid: "02:5e:10:00:00:10", Mode: "ap", Stas: []Station{}},
+	}, radios[1].Vaps)
+
+	assert.Empty(t, parseIwDev(nil))
+}
@@ -0,0 +1,188 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+
+	messages "messages"
+)
+
+// One sample per station every 5 minutes, for a day
+const STATION_SAMPLE_INTERVAL = 5 * 60
+const MAX_STATION_SAMPLES = 288
+
+const MAX_STATION_ROAMS = 32
+
+// A station below this RSSI for STICKY_DURATION, while another of our access
+// points on the same band is up, is flagged as sticky
+const STICKY_RSSI_THRESHOLD = -75
+const STICKY_DURATION = 10 * 60
+
+type StationSample struct {
+	Tstamp  int64
+	Rssi    int
+	Channel int
+	Node    string
+}
+
+type StationRoam struct {
+	Tstamp    int64
+	FromNode  string
+	ToNode    string
+	FromBssid string
+	ToBssid   string
+	Rssi      int
+}
+
+// Signal history of a wireless client and the access points it moved between
+type StationHistory struct {
+	MACAddress string
+	Node       string
+	Bssid      string
+	Band       string
+	Rssi       int
+	Lastseen   int64
+	WeakSince  int64
+	Sticky     bool
+	Samples    []StationSample
+	Roams      []StationRoam
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) updateStationHistory(node string, bssid string, radio *Radio, sta Station, now int64) {
+	client := tel.RouterClients[sta.Mac]
+	if client == nil {
+		return
+	}
+	sh := tel.stations[sta.Mac]
+	if sh == nil {
+		sh = &StationHistory{
+			MACAddress: sta.Mac,
+			Samples:    make([]StationSample, 0),
+			Roams:      make([]StationRoam, 0),
+		}
+		tel.stations[sta.Mac] = sh
+	}
+
+	if sh.Bssid != "" && bssid != "" && sh.Bssid != bssid {
+		roam := StationRoam{
+			Tstamp:    now,
+			FromNode:  sh.Node,
+			ToNode:    node,
+			FromBssid: sh.Bssid,
+			ToBssid:   bssid,
+			Rssi:      sta.Rssi,
+		}
+		if len(sh.Roams) >= MAX_STATION_ROAMS {
+			sh.Roams = sh.Roams[1:]
+		}
+		sh.Roams = append(sh.Roams, roam)
+		sh.WeakSince = 0
+		sh.Sticky = false
+		tel.newEvent(ROAMEVENT, tel.nodeName(sh.Node)+" -> "+tel.nodeName(node), client, "station")
+	}
+	sh.Node = node
+	sh.Bssid = bssid
+	sh.Band = radioBand(radio)
+	sh.Rssi = sta.Rssi
+	sh.Lastseen = now
+
+	last := len(sh.Samples) - 1
+	if last < 0 || now-sh.Samples[last].Tstamp >= STATION_SAMPLE_INTERVAL || sh.Samples[last].Node != node {
+		if len(sh.Samples) >= MAX_STATION_SAMPLES {
+			sh.Samples = sh.Samples[1:]
+		}
+		sh.Samples = append(sh.Samples, StationSample{Tstamp: now, Rssi: sta.Rssi, Channel: radio.Channel, Node: node})
+	}
+	tel.checkSticky(sh, client, now)
+}
+
+// Drops the history of clients that are no longer kept
+func (tel *Telemetry) pruneStations(curtime int64) {
+	tel.Lock()
+	defer tel.Unlock()
+	for mac := range tel.stations {
+		if tel.clientGone(mac, curtime) {
+			delete(tel.stations, mac)
+		}
+	}
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) checkSticky(sh *StationHistory, client *RouterClient, now int64) {
+	if sh.Rssi >= STICKY_RSSI_THRESHOLD {
+		sh.WeakSince = 0
+		sh.Sticky = false
+		return
+	}
+	if sh.WeakSince == 0 {
+		sh.WeakSince = now
+	}
+	if sh.Sticky || now-sh.WeakSince < STICKY_DURATION || !tel.otherAccessPoint(sh.Node, sh.Band, now) {
+		return
+	}
+	sh.Sticky = true
+	tel.l.WithField("mac", sh.MACAddress).WithField("rssi", sh.Rssi).Info("Sticky client")
+	tel.newEvent(STICKYCLIENTEVENT, fmt.Sprintf("%s %d", tel.nodeName(sh.Node), sh.Rssi), client, "station")
+}
+
+// Tells whether another of our nodes has a radio up on the band
+func (tel *Telemetry) otherAccessPoint(node string, band string, now int64) bool {
+	for _, rs := range tel.radios {
+		if rs.Node != node && rs.Band == band && now-rs.Updated < STICKY_DURATION {
+			return true
+		}
+	}
+	return false
+}
+
+func (tel *Telemetry) nodeName(node string) string {
+	if repeater := tel.repeaterOf(node); repeater != nil {
+		return repeater.Name
+	}
+	return "router"
+}
+
+func (tel *Telemetry) stationHistoryJson(mac string) ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	sh := tel.stations[mac]
+	if sh == nil {
+		return nil, fmt.Errorf("No wireless history for %s", mac)
+	}
+	history := messages.StationHistoryInfo{
+		MACAddress: sh.MACAddress,
+		Node:       sh.Node,
+		NodeName:   tel.nodeName(sh.Node),
+		Bssid:      sh.Bssid,
+		Rssi:       sh.Rssi,
+		Lastseen:   sh.Lastseen,
+		Sticky:     sh.Sticky,
+		WeakSince:  sh.WeakSince,
+		Samples:    make([]messages.StationSampleInfo, len(sh.Samples)),
+		Roams:      make([]messages.StationRoamInfo, len(sh.Roams)),
+	}
+	for i, s := range sh.Samples {
+		history.Samples[i] = messages.StationSampleInfo{
+			Tstamp:  s.Tstamp,
+			Rssi:    s.Rssi,
+			Channel: s.Channel,
+			Node:    s.Node,
+		}
+	}
+	for i, r := range sh.Roams {
+		history.Roams[i] = messages.StationRoamInfo{
+			Tstamp:    r.Tstamp,
+			FromNode:  r.FromNode,
+			ToNode:    r.ToNode,
+			FromBssid: r.FromBssid,
+			ToBssid:   r.ToBssid,
+			Rssi:      r.Rssi,
+		}
+	}
+	return json.Marshal(history)
+}
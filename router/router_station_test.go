@@ -0,0 +1,25 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStationDroppedWithClient(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	_, err := rs.tel.stationHistoryJson(testMac)
+	assert.Nil(t, err)
+
+	expireClient(rs, testMac)
+	rs.tel.pruneStations(time.Now().Unix())
+	_, err = rs.tel.stationHistoryJson(testMac)
+	assert.NotNil(t, err)
+	_, err = rs.tel.stationHistoryJson("f0:25:b7:10:20:01")
+	assert.Nil(t, err)
+}
@@ -28,12 +28,40 @@ type Telemetry struct {
 	RouterClients         map[string]*RouterClient
 	l                     *logrus.Logger
 	Repeaters             map[string]*Repeater
-	blocklistips          map[string]bool
+	Blocklist             *Blocklist
+	Journal               *EventJournal
 	NewRepeater           *Repeater
 	blocklistupdated      int64
 	blockedurllistupdated int64
 	clientsdumped         int64
 	EventRing             *ring.Ring
+	Usage                 map[string]*ClientUsage
+	usagedumped           int64
+	rootMac               string
+	telemetryreceived     int64
+	metricClients         map[string]bool
+	Upgrade               *UpgradeManager
+	radios                map[string]*radioState
+	ownBssids             map[string]bool
+	channelPlan           *ChannelPlan
+	stations              map[string]*StationHistory
+	presence              PresenceConfig
+	Guest                 *GuestPasses
+	Filters               *Filters
+	quarantine            QuarantineConfig
+	DNSActivity           map[string]*DNSActivity
+	dnsquerylog           bool
+	dnslogoffset          int64
+	dnsQueries            map[string]dnsQuery
+	dnsNames              map[string]string
+	dnsNamesOld           map[string]string
+	flows                 map[string]*ClientFlows
+	anomaly               AnomalyConfig
+	anomalies             map[string]*anomalyState
+	groups                map[string]*ClientGroup
+	Quotas                map[string]*Quota
+	quotasdirty           bool
+	identity              *NebulaIdentity
 }
 
 func readClientDetails(callback addClient, l *logrus.Logger) error {
@@ -47,6 +75,7 @@ func readClientDetails(callback addClient, l *logrus.Logger) error {
 			var client RouterClient
 			err = json.Unmarshal(content, &client)
 			if err == nil {
+				client.migrateType()
 				callback(&client)
 			}
 		} else {
@@ -56,6 +85,20 @@ func readClientDetails(callback addClient, l *logrus.Logger) error {
 	return nil
 }
 
+// Clients not seen for 7 days are dropped, unless they are someone's or were
+// approved or rejected
+func clientExpired(client *RouterClient, curtime int64) bool {
+	approved := client.Approval == APPROVAL_APPROVED || client.Approval == APPROVAL_REJECTED
+	return curtime-client.Lastseen >= (24*7*3600) && client.Person == "" && !approved
+}
+
+// Tells whether the client is no longer kept, so neither is anything about it
+// Called with the telemetry lock held
+func (tel *Telemetry) clientGone(mac string, curtime int64) bool {
+	client := tel.RouterClients[mac]
+	return client == nil || clientExpired(client, curtime)
+}
+
 func dumpClientStats(client *RouterClient) error {
 	// Marshal client details
 	c, err := json.Marshal(*client)
@@ -66,12 +109,16 @@ func dumpClientStats(client *RouterClient) error {
 
 	nh_util.NH_create_dir(DB_CLIENTS_LOCATION, 0755)
 	filename := getFileName(client.MACAddress)
-	if curtime-client.Lastseen < (24 * 7 * 3600) {
+	if !clientExpired(client, curtime) {
 		return nh_util.NH_dump_to_file(filename, c, 0644)
 	} else {
-		// More than 7 days, Remove this entry
-		return os.Remove(filename)
-		return nil
+		// More than 7 days, Remove this entry. A client that was never seen,
+		// e.g. a repeater that just registered, has no file yet
+		err = os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
 
 }
@@ -82,14 +129,49 @@ func NewTelemetry(l1 *logrus.Logger) *Telemetry {
 		Repeaters:     make(map[string]*Repeater),
 		l:             l1,
 		EventRing:     ring.New(MAX_NUMBER_OF_EVENTS),
+		Usage:         make(map[string]*ClientUsage),
+		Quotas:        make(map[string]*Quota),
+		Blocklist:     NewBlocklist(),
+		Journal:       NewEventJournal(),
+		rootMac:       getRootMac(),
+		radios:        make(map[string]*radioState),
+		ownBssids:     make(map[string]bool),
+		stations:      make(map[string]*StationHistory),
+		Filters:       NewFilters(),
+		DNSActivity:   make(map[string]*DNSActivity),
+		dnsNames:      make(map[string]string),
+		flows:         make(map[string]*ClientFlows),
+		anomalies:     make(map[string]*anomalyState),
+		groups:        make(map[string]*ClientGroup),
+	}
+	err := t.Journal.open()
+	if err != nil {
+		l1.Error("Error while opening the event journal ", err)
 	}
 	readClientDetails(func(client *RouterClient) {
 		t.RouterClients[client.MACAddress] = client
 		t.RouterClients[client.MACAddress].Dirty = false
 		addDNSEntryPlatform(client)
+		restoreQuarantine(client)
 	}, l1)
+	t.readClientUsage()
+	t.readDNSActivity()
+	t.readQuotas()
 	t.readRepeaterInfo()
-	t.getBlockListIPs()
+	t.readChannelPlan()
+	t.readPresenceConfig()
+	t.readQuarantineConfig()
+	t.readAnomalyConfig()
+	t.readGroups()
+	t.Guest = readGuestPasses()
+	err = t.Filters.read()
+	if err != nil {
+		l1.Error("Error while reading filter profiles ", err)
+	}
+	// Block with the last good copy till the feeds are refreshed by Run
+	t.Blocklist.readCache()
+	t.Upgrade = NewUpgradeManager(&t)
+	t.Upgrade.read()
 	go t.updateBlockedURLs()
 	t.updateClientsList()
 	applyDNSEntries()
@@ -108,30 +190,31 @@ func NewRouterClient(mac string, ip string, name string, isrepeater bool, fwver
 }
 
 func (tel *Telemetry) getBlockListIPs() {
-	bytes, err := nh_util.NH_http_get_req(blocklisturl)
+	err := tel.Blocklist.refresh()
 	if err != nil {
-		tel.l.Error("Error while fetching blocklist ips")
-		tel.blocklistupdated = 0
-		return
-	}
-	entries := strings.Split(string(bytes), "\n")
-	if entries == nil {
-		tel.l.Error("Error while parsing blocklist ips")
-		tel.blocklistupdated = 0
+		tel.l.Error("Error while updating blocklist ips ", err)
+		// Try again in an hour
+		tel.Lock()
+		tel.blocklistupdated = time.Now().Unix() - 23*60*60
+		tel.Unlock()
 		return
 	}
-	tel.blocklistips = make(map[string]bool)
-	for _, entry := range entries {
-		tel.blocklistips[entry] = true
-	}
 	tel.l.Info("Updated Blocklist ips")
+	tel.Lock()
 	tel.blocklistupdated = time.Now().Unix()
+	tel.Unlock()
 }
 
 func (tel *Telemetry) updateBlockedURLs() {
 	args := []string{""}
 	nh_util.NH_read_cmd_output(updateBlockedURLsScript, args)
+	err := tel.Filters.update()
+	if err != nil {
+		tel.l.Error("Error while updating blocklist categories ", err)
+	}
+	tel.Lock()
 	tel.blockedurllistupdated = time.Now().Unix()
+	tel.Unlock()
 }
 
 func (tel *Telemetry) dumpRouterClients() {
@@ -159,6 +242,8 @@ func (tel *Telemetry) dumpRouterClients() {
 func (tel *Telemetry) Run(ctx context.Context) {
 	clockSource := time.NewTicker(30 * time.Second)
 	defer clockSource.Stop()
+	// Changing channels waits on the repeaters, the planner has its own loop
+	go tel.runChannelPlanner(ctx)
 
 	for {
 		select {
@@ -171,23 +256,39 @@ func (tel *Telemetry) Run(ctx context.Context) {
 				tel.dumpRouterClients()
 				tel.clientsdumped = curtime
 			}
-			if curtime-tel.blocklistupdated >= 24*60*60 {
+			tel.applySchedules(time.Now())
+			tel.resetQuotas(time.Now())
+			tel.checkRepeaters(curtime)
+			tel.checkPresence(curtime)
+			err := tel.Guest.expire(curtime)
+			if err != nil {
+				tel.l.Error("Error while turning off the expired guest passes ", err)
+			}
+			tel.Upgrade.check(curtime)
+			tel.updateDNSActivity(curtime)
+			tel.updateMetrics(curtime)
+			if curtime-tel.usagedumped >= USAGE_DUMP_INTERVAL {
+				tel.dumpUsage()
+				tel.dumpDNSActivity()
+				tel.pruneStations(curtime)
+				tel.usagedumped = curtime
+			}
+			tel.RLock()
+			blocklistupdated := tel.blocklistupdated
+			blockedurllistupdated := tel.blockedurllistupdated
+			tel.RUnlock()
+			if curtime-blocklistupdated >= 24*60*60 {
 				// It is 24 hours since we updated the blocklist ips
 				// Update now
 				tel.getBlockListIPs()
 			}
-			if curtime-tel.blockedurllistupdated >= 24*60*60 {
+			if curtime-blockedurllistupdated >= 24*60*60 {
 				go tel.updateBlockedURLs()
 			}
 		}
 	}
 }
 
-func get_host_name(mac string) string {
-	args := []string{mac}
-	return nh_util.NH_read_cmd_output(get_hostname_cmd, args)
-}
-
 func (tel *Telemetry) createClient(mac string, ip string, isrepeater bool, extramac string, fwver string) error {
 	if tel.RouterClients[mac] == nil {
 		// The device does n't exist. Create one
@@ -207,14 +308,27 @@ func (tel *Telemetry) createClient(mac string, ip string, isrepeater bool, extra
 			name = name[0:CLIENT_NAME_MAX_LENGTH]
 		}
 		rc := NewRouterClient(mac, ip, name, isrepeater, fwver)
+		rc.classify()
+		tel.quarantineClient(rc)
 		tel.RouterClients[mac] = rc
 		tel.RouterClients[mac].Dirty = true
-		tel.newEvent(NEWCLIENTEVENT, ip, tel.RouterClients[mac])
+		source := ""
+		if rc.Quarantine != "" {
+			source = "quarantine"
+		}
+		tel.newEvent(NEWCLIENTEVENT, ip, tel.RouterClients[mac], source)
 		// Add a domain name entry
 		addDNSEntryPlatform(tel.RouterClients[mac])
 		applyDNSEntries()
 	} else {
 		tel.RouterClients[mac].Fwver = fwver
+		if isrepeater && tel.RouterClients[mac].Approval == APPROVAL_PENDING {
+			// Seen before it registered. Registered repeaters need no approval
+			tel.RouterClients[mac].Approval = APPROVAL_APPROVED
+			tel.RouterClients[mac].PendingSince = 0
+			tel.releaseClient(tel.RouterClients[mac])
+			tel.RouterClients[mac].Dirty = true
+		}
 	}
 	if extramac != "" {
 		tel.RouterClients[extramac] = tel.RouterClients[mac]
@@ -223,25 +337,33 @@ func (tel *Telemetry) createClient(mac string, ip string, isrepeater bool, extra
 	return nil
 }
 
-func (tel *Telemetry) anyIPBlockListed(device Device) (bool, string) {
+func (tel *Telemetry) anyIPBlockListed(device Device) (bool, string, string) {
 	for _, conn := range device.Conn {
-		if tel.blocklistips[conn.R_ip] == true {
-			return true, conn.R_ip
+		feed := tel.Blocklist.match(conn.R_ip)
+		if feed != "" {
+			return true, conn.R_ip, feed
 		}
 	}
-	return false, ""
+	return false, "", ""
 }
 
-func (tel *Telemetry) newEvent(etype EventType, ip string, client *RouterClient) {
+func (tel *Telemetry) newEvent(etype EventType, ip string, client *RouterClient, source string) *RouterEvent {
 	event := &RouterEvent{
 		Etype:  etype,
 		Extra:  ip,
 		Client: client,
 		Active: true,
 		Tstamp: time.Now().Unix(),
+		Source: source,
 	}
+	err := tel.Journal.append(event)
+	if err != nil {
+		tel.l.Error("Error while writing the event journal ", err)
+	}
+	countEvent(etype)
 	tel.EventRing.Value = event
 	tel.EventRing = tel.EventRing.Next()
+	return event
 }
 
 func (tel *Telemetry) getNextEvent() *RouterEvent {
@@ -265,13 +387,15 @@ func (tel *Telemetry) getNextEvent() *RouterEvent {
 func (tel *Telemetry) processTelemetry(telemetryData *TelemetryData) error {
 	tel.Lock()
 	defer tel.Unlock()
+	tel.telemetryreceived = time.Now().Unix()
 	for _, device := range telemetryData.Devices {
-		blocked, ip := tel.anyIPBlockListed(device)
+		blocked, ip, feed := tel.anyIPBlockListed(device)
 		if blocked {
+			countBlocklistHit(feed)
 			if tel.RouterClients[device.Mac] != nil {
-				tel.newEvent(BLOCKEDIPEVENT, ip, tel.RouterClients[device.Mac])
+				tel.newEvent(BLOCKEDIPEVENT, ip, tel.RouterClients[device.Mac], feed)
 			}
-			tel.l.Error("Traffic to Blocklisted IP")
+			tel.l.WithField("feed", feed).Error("Traffic to Blocklisted IP")
 		}
 		err := tel.createClient(device.Mac, device.Ip, false, "", "")
 		if err != nil {
@@ -281,6 +405,11 @@ func (tel *Telemetry) processTelemetry(telemetryData *TelemetryData) error {
 			tel.RouterClients[device.Mac].Lastseen = time.Now().Unix()
 			tel.RouterClients[device.Mac].IPAddress = device.Ip
 		}
+		tel.classifyByTraffic(device)
+		tel.updateUsage(device)
+		tel.updateFlows(device, time.Now())
+		tel.detectAnomalies(device, time.Now().Unix())
+		tel.updateQuotas(device, time.Now())
 	}
 	return nil
 }
@@ -289,7 +418,10 @@ func (tel *Telemetry) updateWireless(sta Station, channel int) error {
 	if tel.RouterClients[sta.Mac] == nil {
 		return nil
 	}
-	tel.RouterClients[sta.Mac].Type = WIRELESS
+	if tel.RouterClients[sta.Mac].Type == WIRED {
+		tel.RouterClients[sta.Mac].Type = WIRELESS
+		tel.RouterClients[sta.Mac].classify()
+	}
 	tel.RouterClients[sta.Mac].Channel = channel
 	tel.RouterClients[sta.Mac].Rssi = sta.Rssi
 	tel.RouterClients[sta.Mac].Dirty = true
@@ -300,10 +432,22 @@ func (tel *Telemetry) updateWireless(sta Station, channel int) error {
 func (tel *Telemetry) processWirelessTelemetry(wirelessTelemetryData *WirelessTelemetryData) error {
 	tel.Lock()
 	defer tel.Unlock()
-	for _, radio := range wirelessTelemetryData.Radios {
+	tel.telemetryreceived = time.Now().Unix()
+	node := tel.wirelessNode(wirelessTelemetryData)
+	if repeater := tel.repeaterOf(node); repeater != nil {
+		repeater.Lastseen = time.Now().Unix()
+	}
+	for i := range wirelessTelemetryData.Radios {
+		radio := &wirelessTelemetryData.Radios[i]
+		tel.updateRadioState(node, radio, time.Now().Unix())
 		for _, vap := range radio.Vaps {
 			for _, station := range vap.Stas {
+				if tel.updateTopology(node, station) {
+					// Backhaul of a repeater
+					continue
+				}
 				tel.updateWireless(station, radio.Channel)
+				tel.updateStationHistory(node, vap.Bssid, radio, station, time.Now().Unix())
 			}
 		}
 	}
@@ -325,7 +469,11 @@ func (tel *Telemetry) readRepeaterInfo() {
 		tel.l.Error("Error while unmarshalling repeater info")
 		return
 	}
-	for i := 0; i < MAX_NUM_OF_REPEATERS; i++ {
+	for i := 0; i < len(repeaters); i++ {
+		if repeaters[i].Mac == "" {
+			// Unused slot
+			continue
+		}
 		tel.Repeaters[repeaters[i].Mac] = &repeaters[i]
 	}
 }
@@ -348,6 +496,12 @@ func (tel *Telemetry) RepeatersJson() ([]byte, error) {
 		repeaters[i].Ip = repeater.Ip
 		repeaters[i].Name = repeater.Name
 		repeaters[i].Fwver = repeater.Fwver
+		repeaters[i].Upstream = repeater.Upstream
+		repeaters[i].BackhaulRssi = repeater.BackhaulRssi
+		repeaters[i].Lastseen = repeater.Lastseen
+		repeaters[i].Online = repeater.Online
+		repeaters[i].Vpnip = repeater.Vpnip
+		repeaters[i].TokenHash = repeater.TokenHash
 		i++
 	}
 	rbytes, err := json.Marshal(repeaters)
@@ -357,22 +511,41 @@ func (tel *Telemetry) RepeatersJson() ([]byte, error) {
 	return rbytes, nil
 }
 
-func (tel *Telemetry) registerRepeater(data []byte) error {
+// vpnip is the Nebula address the repeater registered from, empty when it
+// did not come over the tunnel. Returns the token of the repeater for /radios
+func (tel *Telemetry) registerRepeater(data []byte, vpnip string) (string, error) {
 	var repeaterMessage RepeaterMessage
 	err := json.Unmarshal(data, &repeaterMessage)
 	if err != nil {
-		return err
+		return "", err
+	}
+	token, hash, err := newRepeaterToken()
+	if err != nil {
+		return "", err
 	}
+	tel.Lock()
 	repeater := &Repeater{
-		Name:  repeaterMessage.Name,
-		Mac:   repeaterMessage.Mac,
-		MMac:  repeaterMessage.MMac,
-		Ip:    repeaterMessage.Ip,
-		Fwver: repeaterMessage.Fwver,
+		Name:      repeaterMessage.Name,
+		Mac:       repeaterMessage.Mac,
+		MMac:      repeaterMessage.MMac,
+		Ip:        repeaterMessage.Ip,
+		Fwver:     repeaterMessage.Fwver,
+		Vpnip:     vpnip,
+		Lastseen:  time.Now().Unix(),
+		Online:    true,
+		TokenHash: hash,
+	}
+	if old := tel.Repeaters[repeaterMessage.Mac]; old != nil {
+		repeater.Upstream = old.Upstream
+		repeater.BackhaulRssi = old.BackhaulRssi
+		if repeater.Vpnip == "" {
+			repeater.Vpnip = old.Vpnip
+		}
 	}
-	if len(tel.Repeaters) >= MAX_NUM_OF_REPEATERS {
+	if len(tel.Repeaters) >= MAX_NUM_OF_REPEATERS && tel.Repeaters[repeater.Mac] == nil {
+		tel.Unlock()
 		tel.l.Error(nh_util.NH_getErrorStatusString("Maximum number of repeater reached"))
-		return fmt.Errorf("Maximum number of repeater reached")
+		return "", fmt.Errorf("Maximum number of repeater reached")
 	}
 	if tel.Repeaters[repeater.Mac] == nil {
 		// New Repeater
@@ -381,21 +554,36 @@ func (tel *Telemetry) registerRepeater(data []byte) error {
 	tel.Repeaters[repeater.Mac] = repeater
 
 	rbytes, err := tel.RepeatersJson()
-	if err != nil {
-		return err
+	if err == nil {
+		err = nh_util.NH_dump_to_file(DB_REPEATERS_FILE, rbytes, 0600)
 	}
-	err = nh_util.NH_dump_to_file(DB_REPEATERS_FILE, rbytes, 0644)
-	if err != nil {
-		return err
+	if err == nil {
+		err = tel.createClient(repeater.Mac, repeater.Ip, true, repeaterMessage.MMac, repeaterMessage.Fwver)
+		if err != nil {
+			tel.l.WithField("Client MAC Address", repeater.Mac).Error(err.Error())
+		}
 	}
-	err = tel.createClient(repeater.Mac, repeater.Ip, true, repeaterMessage.MMac, repeaterMessage.Fwver)
+	tel.Unlock()
 	if err != nil {
-		tel.l.WithField("Client MAC Address", repeater.Mac).Error(err.Error())
-		return err
+		return "", err
 	}
 	// Dump the clients into Json
 	tel.dumpRouterClients()
-	return nil
+	return token, nil
+}
+
+// True when a schedule, a quota, the group or the quarantine holds the pause
+// of the client
+func (client *RouterClient) pausedAutomatically() bool {
+	return client.ScheduleHeld || client.QuotaPaused || client.GroupHeld || client.Quarantine == QUARANTINE_PAUSE
+}
+
+// Pausing or unpausing by hand takes the client over from the schedules,
+// quotas and group holding it
+func (client *RouterClient) releaseHolds() {
+	client.ScheduleHeld = false
+	client.QuotaPaused = false
+	client.GroupHeld = false
 }
 
 func (tel *Telemetry) pauseClient(mac string, pause bool) string {
@@ -405,7 +593,12 @@ func (tel *Telemetry) pauseClient(mac string, pause bool) string {
 		tel.l.Error("Received a pause/unpause request for a client that does n't exist")
 		return nh_util.NH_getErrorStatusString("Received a pause/unpause request for a client that does n't exist")
 	}
+	if !pause && tel.RouterClients[mac].Quarantine == QUARANTINE_PAUSE {
+		// Only approving the client releases it
+		return nh_util.NH_getErrorStatusString("Client is held in quarantine")
+	}
 	tel.RouterClients[mac].Paused = pause
+	tel.RouterClients[mac].releaseHolds()
 	err := dumpClientStats(tel.RouterClients[mac])
 	if err != nil {
 		tel.l.Error("Error while saving (pause) the client details", tel.RouterClients[mac].MACAddress)
@@ -415,19 +608,32 @@ func (tel *Telemetry) pauseClient(mac string, pause bool) string {
 	return pauseClient(mac, ip, tel.RouterClients[mac].Name, pause)
 }
 
+// Clients held in quarantine stay paused on unpauseall
 func (tel *Telemetry) pauseAll(pause bool) string {
-	tel.RLock()
-	defer tel.RUnlock()
+	tel.Lock()
+	defer tel.Unlock()
 
 	for _, client := range tel.RouterClients {
+		if !pause && client.Quarantine == QUARANTINE_PAUSE {
+			continue
+		}
 		client.Paused = pause
+		client.releaseHolds()
 		err := dumpClientStats(client)
 		if err != nil {
 			tel.l.Error("Error while saving (pauseall) the client details", client.MACAddress)
 			return nh_util.NH_getErrorStatusString("Error while saving the client details")
 		}
 	}
-	return pauseAll(pause)
+	status := pauseAll(pause)
+	if !pause {
+		for mac, client := range tel.RouterClients {
+			if mac == client.MACAddress && client.Quarantine == QUARANTINE_PAUSE {
+				pauseClient(mac, client.IPAddress, client.Name, true)
+			}
+		}
+	}
+	return status
 }
 
 func (tel *Telemetry) dumpClientsJson() ([]byte, error) {
@@ -455,6 +661,18 @@ func (tel *Telemetry) dumpClientsJson() ([]byte, error) {
 		clients[index].Paused = client.Paused
 		clients[index].IsRepeater = client.IsRepeater
 		clients[index].Lastseen = client.Lastseen
+		clients[index].Vendor = client.Vendor
+		clients[index].TypeConfidence = client.TypeConfidence
+		clients[index].TypeManual = client.TypeManual
+		clients[index].Person = client.Person
+		clients[index].Profile = tel.Filters.profileOfClient(client.MACAddress)
+		clients[index].Home = client.Home
+		clients[index].Approval = client.Approval
+		clients[index].Group = client.Group
+		if q := tel.quotaOfClient(client.MACAddress); q != nil {
+			quota := q.info()
+			clients[index].Quota = &quota
+		}
 		index++
 	}
 	jsonData, err := json.Marshal(clients[0:index])
@@ -473,6 +691,7 @@ func (tel *Telemetry) setClientDetails(mac string, name string, Type uint8) stri
 	}
 	tel.RouterClients[mac].Name = name
 	tel.RouterClients[mac].Type = (ClientType)(Type)
+	tel.RouterClients[mac].TypeManual = true
 	err := dumpClientStats(tel.RouterClients[mac])
 	if err != nil {
 		tel.l.Error("Error while saving the client details", tel.RouterClients[mac].MACAddress)
@@ -486,6 +705,17 @@ func (tel *Telemetry) setClientDetails(mac string, name string, Type uint8) stri
 	return ""
 }
 
+// Called with the telemetry lock held
+func (tel *Telemetry) clientMacs() map[string]bool {
+	macs := make(map[string]bool)
+	for mac, client := range tel.RouterClients {
+		if mac == client.MACAddress {
+			macs[mac] = true
+		}
+	}
+	return macs
+}
+
 func (tel *Telemetry) updateClientsList() {
 	out := ""
 	for mac, client := range tel.RouterClients {
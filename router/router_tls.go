@@ -0,0 +1,303 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Port of the router api over mutual TLS, used between the units of a mesh
+const ROUTER_API_TLS_PORT = 11001
+const ROUTER_API_TLS_TIMEOUT = 30 * time.Second
+
+// The x509 certificates of the TLS handshake are throwaway ones. They carry
+// the Nebula certificate of the unit in this extension, with a proof that the
+// holder of the Nebula key made the certificate
+var nebulaCertOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59470, 11000, 1}
+
+// The client sends its Nebula public key as the server name, so that the
+// server can make its proof for that client
+const NEBULA_SERVER_NAME_SUFFIX = ".nebula"
+
+const (
+	proofServer = "nearhop router api server"
+	proofClient = "nearhop router api client"
+)
+
+var serverNameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type nebulaExtension struct {
+	Cert  []byte
+	Proof []byte
+}
+
+// The Nebula certificate and key of this unit and the CA it trusts.
+//
+// Nebula keys are X25519 keys and can't sign a TLS handshake. Each side signs
+// the handshake with a TLS key of its own instead, and binds it to its Nebula
+// certificate with an HMAC keyed by the X25519 secret both ends share. Only
+// the holders of the two Nebula keys can compute it
+type NebulaIdentity struct {
+	cert    *cert.NebulaCertificate
+	rawCert []byte
+	key     []byte
+	caPool  *cert.NebulaCAPool
+	tlsKey  ed25519.PrivateKey
+	client  *http.Client
+}
+
+// Like the pki section of the config, each argument is a path or PEM data
+func readPathOrPEM(pathOrPEM string) ([]byte, error) {
+	if strings.Contains(pathOrPEM, "-----BEGIN") {
+		return []byte(pathOrPEM), nil
+	}
+	return ioutil.ReadFile(pathOrPEM)
+}
+
+func LoadNebulaIdentity(caPathOrPEM string, certPathOrPEM string, keyPathOrPEM string) (*NebulaIdentity, error) {
+	rawCA, err := readPathOrPEM(caPathOrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pki.ca: %s", err)
+	}
+	caPool, err := cert.NewCAPoolFromBytes(rawCA)
+	if err != nil && !errors.Is(err, cert.ErrExpired) {
+		return nil, fmt.Errorf("unable to load pki.ca: %s", err)
+	}
+	pemCert, err := readPathOrPEM(certPathOrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pki.cert: %s", err)
+	}
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(pemCert)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load pki.cert: %s", err)
+	}
+	pemKey, err := readPathOrPEM(keyPathOrPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pki.key: %s", err)
+	}
+	key, _, err := cert.UnmarshalX25519PrivateKey(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load pki.key: %s", err)
+	}
+	if err = nc.VerifyPrivateKey(key); err != nil {
+		return nil, fmt.Errorf("pki.key does not match pki.cert")
+	}
+	rawCert, err := nc.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	_, tlsKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := &NebulaIdentity{cert: nc, rawCert: rawCert, key: key, caPool: caPool, tlsKey: tlsKey}
+	id.client = &http.Client{
+		Timeout: ROUTER_API_TLS_TIMEOUT,
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				dialer := tls.Dialer{Config: id.clientConfig()}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	return id, nil
+}
+
+func (id *NebulaIdentity) Name() string {
+	return id.cert.Details.Name
+}
+
+func (id *NebulaIdentity) proof(peerKey []byte, label string, tlsKey ed25519.PublicKey) ([]byte, error) {
+	shared, err := curve25519.X25519(id.key, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(label))
+	mac.Write(tlsKey)
+	return mac.Sum(nil), nil
+}
+
+// A certificate for the TLS key with our proof for the peer
+func (id *NebulaIdentity) certificate(peerKey []byte, label string) (*tls.Certificate, error) {
+	tlsPub := id.tlsKey.Public().(ed25519.PublicKey)
+	proof, err := id.proof(peerKey, label, tlsPub)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := asn1.Marshal(nebulaExtension{Cert: id.rawCert, Proof: proof})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(now.UnixNano()),
+		Subject:         pkix.Name{CommonName: id.cert.Details.Name},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: nebulaCertOID, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, tlsPub, id.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.tlsKey}, nil
+}
+
+// Returns the Nebula certificate of the peer once it verifies against our CA
+// pool and the peer proved it holds the key of it
+func (id *NebulaIdentity) verifyPeer(rawCerts [][]byte, label string) (*cert.NebulaCertificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, fmt.Errorf("No certificate")
+	}
+	c, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	tlsPub, ok := c.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected key type %T", c.PublicKey)
+	}
+	var ext nebulaExtension
+	found := false
+	for _, e := range c.Extensions {
+		if e.Id.Equal(nebulaCertOID) {
+			_, err = asn1.Unmarshal(e.Value, &ext)
+			if err != nil {
+				return nil, err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No Nebula certificate")
+	}
+	nc, err := cert.UnmarshalNebulaCertificate(ext.Cert)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := nc.Verify(time.Now(), id.caPool)
+	if !valid {
+		return nil, fmt.Errorf("Nebula certificate of %s is not valid: %v", nc.Details.Name, err)
+	}
+	if nc.Details.NetworkID != id.cert.Details.NetworkID {
+		return nil, fmt.Errorf("Nebula certificate of %s is for another network", nc.Details.Name)
+	}
+	proof, err := id.proof(nc.Details.PublicKey, label, tlsPub)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(proof, ext.Proof) {
+		return nil, fmt.Errorf("%s does not hold the key of its Nebula certificate", nc.Details.Name)
+	}
+	return nc, nil
+}
+
+func (id *NebulaIdentity) serverName() string {
+	return strings.ToLower(serverNameEncoding.EncodeToString(id.cert.Details.PublicKey)) + NEBULA_SERVER_NAME_SUFFIX
+}
+
+func serverNameKey(name string) ([]byte, error) {
+	if !strings.HasSuffix(name, NEBULA_SERVER_NAME_SUFFIX) {
+		return nil, fmt.Errorf("Not a Nebula server name: %s", name)
+	}
+	key, err := serverNameEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(name, NEBULA_SERVER_NAME_SUFFIX)))
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("Not a Nebula server name: %s", name)
+	}
+	return key, nil
+}
+
+func (id *NebulaIdentity) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			peerKey, err := serverNameKey(hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+			return id.certificate(peerKey, proofServer)
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := id.verifyPeer(rawCerts, proofClient)
+			return err
+		},
+	}
+}
+
+// For one connection. The client certificate is made for the server that
+// verified
+func (id *NebulaIdentity) clientConfig() *tls.Config {
+	var peerKey []byte
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: id.serverName(),
+		// There is no x509 chain, the server is verified against the Nebula CA below
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			nc, err := id.verifyPeer(rawCerts, proofServer)
+			if err != nil {
+				return err
+			}
+			peerKey = nc.Details.PublicKey
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if peerKey == nil {
+				return nil, fmt.Errorf("The server is not verified")
+			}
+			return id.certificate(peerKey, proofClient)
+		},
+	}
+}
+
+// Name in the Nebula certificate of the client of a request that came in over
+// mutual TLS
+func (id *NebulaIdentity) peerName(state *tls.ConnectionState) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("No client certificate")
+	}
+	nc, err := id.verifyPeer([][]byte{state.PeerCertificates[0].Raw}, proofClient)
+	if err != nil {
+		return "", err
+	}
+	return nc.Details.Name, nil
+}
+
+// Posts to the router api of the unit at ip over mutual TLS
+func (id *NebulaIdentity) Post(ip string, path string, jsonData []byte) ([]byte, error) {
+	url := "https://" + net.JoinHostPort(ip, strconv.Itoa(ROUTER_API_TLS_PORT)) + path
+	resp, err := id.client.Post(url, "application/json; charset=UTF-8", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http Error %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
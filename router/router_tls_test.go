@@ -0,0 +1,155 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+)
+
+type testCA struct {
+	cert *cert.NebulaCertificate
+	key  ed25519.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, networkID uint64) *testCA {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "test ca",
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			IsCA:      true,
+			NetworkID: networkID,
+		},
+	}
+	assert.Nil(t, nc.Sign(priv))
+	pem, err := nc.MarshalToPEM()
+	assert.Nil(t, err)
+	return &testCA{cert: nc, key: priv, pem: pem}
+}
+
+// Identity of a unit with a certificate of ca, trusting the trusted CAs
+func newTestIdentity(t *testing.T, ca *testCA, name string, trusted ...*testCA) *NebulaIdentity {
+	key := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(key)
+	assert.Nil(t, err)
+	pub, err := curve25519.X25519(key, curve25519.Basepoint)
+	assert.Nil(t, err)
+	issuer, err := ca.cert.Sha256Sum()
+	assert.Nil(t, err)
+	nc := &cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			NotBefore: time.Now().Add(-time.Minute),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub,
+			Issuer:    issuer,
+			NetworkID: ca.cert.Details.NetworkID,
+		},
+	}
+	assert.Nil(t, nc.Sign(ca.key))
+	pem, err := nc.MarshalToPEM()
+	assert.Nil(t, err)
+	var caPEM []byte
+	for _, c := range trusted {
+		caPEM = append(caPEM, c.pem...)
+	}
+	id, err := LoadNebulaIdentity(string(caPEM), string(pem), string(cert.MarshalX25519PrivateKey(key)))
+	assert.Nil(t, err)
+	return id
+}
+
+// A server that answers with the name of the client it verified
+func newTestTLSServer(t *testing.T, id *NebulaIdentity) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := id.peerName(r.TLS)
+		assert.Nil(t, err)
+		fmt.Fprintf(w, name)
+	}))
+	server.TLS = id.serverConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Nil(t, err)
+	return port
+}
+
+func postTLS(id *NebulaIdentity, port string) (string, error) {
+	resp, err := id.client.Post("https://127.0.0.1:"+port+"/", "application/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body [64]byte
+	n, _ := resp.Body.Read(body[:])
+	return string(body[:n]), nil
+}
+
+func TestNebulaIdentityMutualTLS(t *testing.T) {
+	ca := newTestCA(t, 1)
+	// The root also trusts the CA of another network
+	otherNetwork := newTestCA(t, 2)
+	root := newTestIdentity(t, ca, "root", ca, otherNetwork)
+	repeater := newTestIdentity(t, ca, "repeater", ca)
+	port := newTestTLSServer(t, root)
+
+	name, err := postTLS(repeater, port)
+	assert.Nil(t, err)
+	assert.Equal(t, "repeater", name)
+
+	// A certificate of another CA is refused both ways
+	other := newTestCA(t, 1)
+	stranger := newTestIdentity(t, other, "stranger", other)
+	_, err = postTLS(stranger, port)
+	assert.NotNil(t, err)
+	trusting := newTestIdentity(t, other, "trusting", ca)
+	_, err = postTLS(trusting, port)
+	assert.NotNil(t, err)
+
+	// So is a trusted one of another network
+	neighbour := newTestIdentity(t, otherNetwork, "neighbour", ca, otherNetwork)
+	_, err = postTLS(neighbour, port)
+	assert.NotNil(t, err)
+}
+
+func TestNebulaIdentityProof(t *testing.T) {
+	ca := newTestCA(t, 1)
+	root := newTestIdentity(t, ca, "root", ca)
+	repeater := newTestIdentity(t, ca, "repeater", ca)
+
+	// A certificate made for another peer does not verify
+	c, err := repeater.certificate(repeater.cert.Details.PublicKey, proofClient)
+	assert.Nil(t, err)
+	_, err = root.verifyPeer(c.Certificate, proofClient)
+	assert.NotNil(t, err)
+
+	c, err = repeater.certificate(root.cert.Details.PublicKey, proofClient)
+	assert.Nil(t, err)
+	nc, err := root.verifyPeer(c.Certificate, proofClient)
+	assert.Nil(t, err)
+	assert.Equal(t, "repeater", nc.Details.Name)
+	// Nor does a proof for the other direction
+	_, err = root.verifyPeer(c.Certificate, proofServer)
+	assert.NotNil(t, err)
+
+	key, err := serverNameKey(root.serverName())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(root.cert.Details.PublicKey), key)
+	_, err = serverNameKey("router.lan")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,184 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+// A repeater not heard of for this long is marked offline
+const REPEATER_OFFLINE_TIMEOUT = 5 * 60
+
+// Maximum number of hops in the mesh. Guards against loops in the upstream links
+const MAX_MESH_DEPTH = MAX_NUM_OF_REPEATERS + 1
+
+// Returns the repeater whose bridge or mesh interface has this MAC, nil for the root
+func (tel *Telemetry) repeaterOf(mac string) *Repeater {
+	if mac == "" {
+		return nil
+	}
+	for _, repeater := range tel.Repeaters {
+		if repeater.Mac == mac || repeater.MMac == mac {
+			return repeater
+		}
+	}
+	return nil
+}
+
+// Records which node the station is associated to. A station that is the
+// mesh interface of a repeater is the backhaul of that repeater.
+// Called with the telemetry lock held
+func (tel *Telemetry) updateTopology(node string, sta Station) bool {
+	now := time.Now().Unix()
+	repeater := tel.repeaterOf(sta.Mac)
+	if repeater != nil {
+		repeater.Upstream = node
+		repeater.BackhaulRssi = sta.Rssi
+		repeater.Lastseen = now
+		return true
+	}
+	if tel.RouterClients[sta.Mac] != nil {
+		tel.RouterClients[sta.Mac].ApMac = node
+	}
+	return false
+}
+
+// Where the root reaches the router api of a repeater
+type repeaterAddress struct {
+	Ip    string
+	Vpnip string
+}
+
+// Called with the telemetry lock held
+func (repeater *Repeater) address() repeaterAddress {
+	return repeaterAddress{Ip: repeater.Ip, Vpnip: repeater.Vpnip}
+}
+
+// Sends a message to the router api of the repeater. Over mutual TLS on its
+// LAN address, else over its Nebula tunnel where the repeater verifies us as
+// a peer
+func (tel *Telemetry) sendRepeaterCommand(addr repeaterAddress, message interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	tel.RLock()
+	id := tel.identity
+	tel.RUnlock()
+	err = fmt.Errorf("Repeater is not reachable without a Nebula identity or tunnel")
+	if id != nil && addr.Ip != "" {
+		var data []byte
+		data, err = id.Post(addr.Ip, "/command", jsonData)
+		if err == nil {
+			return data, nil
+		}
+	}
+	if addr.Vpnip == "" {
+		return nil, err
+	}
+	data, err, _ := nh_util.Nh_http_send_req("http://"+addr.Vpnip+":11000/command", jsonData)
+	return data, err
+}
+
+func (tel *Telemetry) repeaterEventClient(repeater *Repeater) *RouterClient {
+	if tel.RouterClients[repeater.Mac] != nil {
+		return tel.RouterClients[repeater.Mac]
+	}
+	return NewRouterClient(repeater.Mac, repeater.Ip, repeater.Name, true, repeater.Fwver)
+}
+
+// Flags repeaters going offline or coming back
+func (tel *Telemetry) checkRepeaters(now int64) {
+	tel.Lock()
+	defer tel.Unlock()
+
+	for _, repeater := range tel.Repeaters {
+		if client := tel.RouterClients[repeater.Mac]; client != nil && client.Lastseen > repeater.Lastseen {
+			repeater.Lastseen = client.Lastseen
+		}
+		online := now-repeater.Lastseen < REPEATER_OFFLINE_TIMEOUT
+		if online == repeater.Online {
+			continue
+		}
+		repeater.Online = online
+		client := tel.repeaterEventClient(repeater)
+		if online {
+			tel.newEvent(REPEATERONLINEEVENT, repeater.Ip, client, "topology")
+		} else {
+			tel.l.WithField("repeater", repeater.Mac).Error("Repeater went offline")
+			tel.newEvent(REPEATEROFFLINEEVENT, repeater.Ip, client, "topology")
+		}
+	}
+}
+
+// Builds the subtree under the repeater, or under the root when repeater is nil.
+// Called with the telemetry lock held
+func (tel *Telemetry) topologyNode(repeater *Repeater, depth int) messages.TopologyNode {
+	node := messages.TopologyNode{
+		Stations: make([]string, 0),
+		Children: make([]messages.TopologyNode, 0),
+	}
+	if repeater != nil {
+		node.Mac = repeater.Mac
+		node.Name = repeater.Name
+		node.Ip = repeater.Ip
+		node.Fwver = repeater.Fwver
+		node.Online = repeater.Online
+		node.Lastseen = repeater.Lastseen
+		node.BackhaulRssi = repeater.BackhaulRssi
+	} else {
+		node.Mac = tel.rootMac
+		node.IsRoot = true
+		node.Online = true
+	}
+	for m, client := range tel.RouterClients {
+		if m != client.MACAddress || client.IsRepeater || client.ApMac == "" {
+			continue
+		}
+		if tel.repeaterOf(client.ApMac) == repeater {
+			node.Stations = append(node.Stations, client.MACAddress)
+		}
+	}
+	if depth >= MAX_MESH_DEPTH {
+		return node
+	}
+	for _, child := range tel.Repeaters {
+		if child != repeater && tel.repeaterOf(child.Upstream) == repeater {
+			node.Children = append(node.Children, tel.topologyNode(child, depth+1))
+		}
+	}
+	return node
+}
+
+func (tel *Telemetry) topologyJson() ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	root := tel.topologyNode(nil, 0)
+	return json.Marshal(root)
+}
+
+// Node that reported the wireless telemetry. Repeaters send their bridge MAC
+func (tel *Telemetry) wirelessNode(data *WirelessTelemetryData) string {
+	if data.Mac != "" {
+		return data.Mac
+	}
+	if tel.rootMac != "" {
+		return tel.rootMac
+	}
+	return "root"
+}
+
+func getRootMac() string {
+	mac, err := nh_util.NH_get_macaddress(LAN_IFNAME)
+	if err != nil {
+		return ""
+	}
+	return mac
+}
@@ -0,0 +1,70 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	messages "messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRepeater = "02:5e:11:00:00:01"
+
+func getTopology(t *testing.T, rs *RouterServer) messages.TopologyNode {
+	tbytes, err := rs.tel.topologyJson()
+	assert.Nil(t, err)
+	var root messages.TopologyNode
+	assert.Nil(t, json.Unmarshal(tbytes, &root))
+	return root
+}
+
+func repeaterOnline(rs *RouterServer, mac string) bool {
+	rs.tel.RLock()
+	defer rs.tel.RUnlock()
+	return rs.tel.Repeaters[mac].Online
+}
+
+func TestTopology(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+
+	root := getTopology(t, rs)
+	assert.True(t, root.IsRoot)
+	assert.Contains(t, root.Stations, testMac)
+	assert.NotContains(t, root.Stations, "c0:ee:fb:10:20:06")
+	assert.Len(t, root.Children, 1)
+	upstairs := root.Children[0]
+	assert.Equal(t, testRepeater, upstairs.Mac)
+	assert.Equal(t, []string{"c0:ee:fb:10:20:06"}, upstairs.Stations)
+	assert.InDelta(t, -63, upstairs.BackhaulRssi, 5)
+
+	// The client roams upstairs
+	assert.Nil(t, sim.MoveClient(testMac, testRepeater, "wl1", -50))
+	assert.Nil(t, sim.Tick())
+	root = getTopology(t, rs)
+	assert.NotContains(t, root.Stations, testMac)
+	assert.Contains(t, root.Children[0].Stations, testMac)
+}
+
+func TestRepeaterHealth(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	now := time.Now().Unix()
+	rs.tel.checkRepeaters(now)
+	assert.True(t, repeaterOnline(rs, testRepeater))
+
+	// Not heard of for longer than the timeout
+	assert.Nil(t, sim.SetRepeaterOffline(testRepeater, true))
+	rs.tel.checkRepeaters(now + REPEATER_OFFLINE_TIMEOUT + 1)
+	assert.False(t, repeaterOnline(rs, testRepeater))
+
+	assert.Nil(t, sim.SetRepeaterOffline(testRepeater, false))
+	assert.Nil(t, sim.Tick())
+	rs.tel.checkRepeaters(time.Now().Unix())
+	assert.True(t, repeaterOnline(rs, testRepeater))
+}
@@ -0,0 +1,552 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const (
+	UPGRADE_IDLE                = "idle"
+	UPGRADE_DOWNLOADING         = "downloading"
+	UPGRADE_UPGRADING_REPEATERS = "upgrading_repeaters"
+	UPGRADE_UPGRADING           = "upgrading"
+	UPGRADE_INSTALLING          = "installing"
+	UPGRADE_REBOOTING           = "rebooting"
+	UPGRADE_HEALTHY             = "healthy"
+	UPGRADE_ROLLINGBACK         = "rollingback"
+	UPGRADE_ROLLEDBACK          = "rolledback"
+	UPGRADE_FAILED              = "failed"
+)
+
+// States of a single router or repeater in the upgrade
+const (
+	UPGRADE_TARGET_PENDING  = "pending"
+	UPGRADE_TARGET_SENT     = "sent"
+	UPGRADE_TARGET_DONE     = "done"
+	UPGRADE_TARGET_SKIPPED  = "skipped"
+	UPGRADE_TARGET_FAILED   = "failed"
+	UPGRADE_TARGET_UPGRADED = "upgraded"
+)
+
+// Time to download the firmware image
+const UPGRADE_DOWNLOAD_TIMEOUT = 10 * 60 * time.Second
+
+// A repeater has this long to come back with the new version
+const UPGRADE_REPEATER_TIMEOUT = 20 * 60
+const UPGRADE_REPEATER_POLL_INTERVAL = 15
+
+// After a reboot into the new image, wait this long before the health check
+// and roll back if the router is not healthy this long after the boot
+const UPGRADE_HEALTH_DELAY = 3 * 60
+const UPGRADE_HEALTH_TIMEOUT = 10 * 60
+
+// Changes on every boot of the kernel
+const BOOT_ID_FILE = "/proc/sys/kernel/random/boot_id"
+
+type UpgradeTarget struct {
+	Mac         string
+	Name        string
+	Ip          string
+	IsRoot      bool
+	FromVersion string
+	State       string
+	Error       string
+}
+
+// Persisted so that the upgrade can be checked and rolled back after the reboot
+type UpgradeState struct {
+	State       string
+	Version     string
+	PrevVersion string
+	Url         string
+	Started     int64
+	Updated     int64
+	Error       string
+	// Boot the image was flashed or the rollback started in, to tell when
+	// the router has rebooted
+	BootId  string
+	Flashed int64
+	Targets []*UpgradeTarget
+}
+
+// Upgrades the repeaters one at a time and then the root router
+type UpgradeManager struct {
+	sync.Mutex
+	tel    *Telemetry
+	state  UpgradeState
+	booted int64
+}
+
+func NewUpgradeManager(tel *Telemetry) *UpgradeManager {
+	m := &UpgradeManager{
+		tel:    tel,
+		state:  UpgradeState{State: UPGRADE_IDLE},
+		booted: time.Now().Unix(),
+	}
+	return m
+}
+
+func (m *UpgradeManager) read() {
+	m.Lock()
+	defer m.Unlock()
+
+	content, err := nh_util.NH_read_file(DB_UPGRADE_FILE)
+	if err != nil {
+		return
+	}
+	var state UpgradeState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		m.tel.l.Error("Error while unmarshalling upgrade state", err)
+		return
+	}
+	m.state = state
+}
+
+// Called with the upgrade lock held
+func (m *UpgradeManager) dump() {
+	m.state.Updated = time.Now().Unix()
+	sbytes, err := json.Marshal(m.state)
+	if err != nil {
+		m.tel.l.Error("Error while marshalling upgrade state", err)
+		return
+	}
+	err = nh_util.NH_dump_to_file(DB_UPGRADE_FILE, sbytes, 0644)
+	if err != nil {
+		m.tel.l.Error("Error while saving upgrade state", err)
+	}
+}
+
+func (m *UpgradeManager) busy() bool {
+	switch m.state.State {
+	case UPGRADE_DOWNLOADING, UPGRADE_UPGRADING_REPEATERS, UPGRADE_UPGRADING, UPGRADE_INSTALLING, UPGRADE_REBOOTING, UPGRADE_ROLLINGBACK:
+		return true
+	}
+	return false
+}
+
+// Raises an upgrade progress event for the router or repeater
+func (m *UpgradeManager) event(target *UpgradeTarget, extra string) {
+	m.tel.l.WithField("target", target.Mac).Info("Upgrade: ", extra)
+	m.tel.Lock()
+	defer m.tel.Unlock()
+	client := m.tel.RouterClients[target.Mac]
+	if client == nil {
+		client = NewRouterClient(target.Mac, target.Ip, target.Name, !target.IsRoot, target.FromVersion)
+	}
+	m.tel.newEvent(UPGRADEEVENT, extra, client, "upgrade")
+}
+
+func (m *UpgradeManager) setState(state string, errstr string) {
+	m.Lock()
+	defer m.Unlock()
+	m.state.State = state
+	m.state.Error = errstr
+	m.dump()
+}
+
+// Moves to a state that ends with a reboot, remembering the boot it started in
+func (m *UpgradeManager) setRebootState(state string, errstr string) {
+	m.Lock()
+	defer m.Unlock()
+	m.state.State = state
+	m.state.Error = errstr
+	m.state.BootId = bootId()
+	m.state.Flashed = time.Now().Unix()
+	m.dump()
+}
+
+func bootId() string {
+	id, err := nh_util.NH_read_file(BOOT_ID_FILE)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// True once the router booted again after the image was flashed or the
+// rollback started. Without a boot id the restart of the daemon is taken
+// as the reboot
+func (m *UpgradeManager) rebooted() bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.state.BootId != "" {
+		return bootId() != m.state.BootId
+	}
+	return m.booted > m.state.Flashed
+}
+
+func (m *UpgradeManager) setTarget(target *UpgradeTarget, state string, errstr string) {
+	m.Lock()
+	defer m.Unlock()
+	target.State = state
+	target.Error = errstr
+	m.dump()
+}
+
+// Called with the upgrade lock held
+func (m *UpgradeManager) rootTarget() *UpgradeTarget {
+	for _, target := range m.state.Targets {
+		if target.IsRoot {
+			return target
+		}
+	}
+	return &UpgradeTarget{Mac: m.tel.rootMac, Name: "router", IsRoot: true}
+}
+
+func validateUpgrade(req messages.UpgradeInnerMessage) error {
+	if !strings.HasPrefix(req.Url, "https://") && !strings.HasPrefix(req.Url, "http://") {
+		return fmt.Errorf("Invalid firmware image url")
+	}
+	if req.Version == "" {
+		return fmt.Errorf("Firmware version is required")
+	}
+	if _, err := hex.DecodeString(req.Signature); err != nil || len(req.Signature) != 2*ed25519.SignatureSize {
+		return fmt.Errorf("Invalid firmware image signature")
+	}
+	if req.Sha256 != "" {
+		if _, err := hex.DecodeString(req.Sha256); err != nil || len(req.Sha256) != 2*sha256.Size {
+			return fmt.Errorf("Invalid firmware image checksum")
+		}
+	}
+	return nil
+}
+
+// Starts the upgrade in the background. Returns an error status string or "" when started
+func (m *UpgradeManager) start(req messages.UpgradeInnerMessage) string {
+	err := validateUpgrade(req)
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.busy() {
+		return nh_util.NH_getErrorStatusString("Upgrade already in progress")
+	}
+
+	targets := make([]*UpgradeTarget, 0)
+	m.tel.RLock()
+	for _, repeater := range m.tel.Repeaters {
+		targets = append(targets, &UpgradeTarget{
+			Mac:         repeater.Mac,
+			Name:        repeater.Name,
+			Ip:          repeater.Ip,
+			FromVersion: repeater.Fwver,
+			State:       UPGRADE_TARGET_PENDING,
+		})
+	}
+	m.tel.RUnlock()
+	curversion := getFwVersion()
+	targets = append(targets, &UpgradeTarget{
+		Mac:         m.tel.rootMac,
+		Name:        "router",
+		IsRoot:      true,
+		FromVersion: curversion,
+		State:       UPGRADE_TARGET_PENDING,
+	})
+	m.state = UpgradeState{
+		State:       UPGRADE_DOWNLOADING,
+		Version:     req.Version,
+		PrevVersion: curversion,
+		Url:         req.Url,
+		Started:     time.Now().Unix(),
+		Targets:     targets,
+	}
+	m.dump()
+	go m.run(req)
+	return ""
+}
+
+// Downloads the image into FW_IMAGE_FILE and checks it is signed by the
+// firmware signing key. The image is streamed to the file, a router has no
+// memory to spare for it. The file is removed when the image is not good
+func downloadFirmware(req messages.UpgradeInnerMessage) error {
+	digest, err := fetchFirmware(req.Url)
+	if err == nil {
+		err = verifyFirmware(req, digest)
+	}
+	if err != nil {
+		os.Remove(FW_IMAGE_FILE)
+	}
+	return err
+}
+
+// Returns the sha256 of the image
+func fetchFirmware(url string) ([]byte, error) {
+	client := &http.Client{Timeout: UPGRADE_DOWNLOAD_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http Error %d while downloading the firmware image", resp.StatusCode)
+	}
+	f, err := os.OpenFile(FW_IMAGE_FILE, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	cerr := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return hash.Sum(nil), nil
+}
+
+func verifyFirmware(req messages.UpgradeInnerMessage, digest []byte) error {
+	if req.Sha256 != "" && !strings.EqualFold(req.Sha256, hex.EncodeToString(digest)) {
+		return fmt.Errorf("Firmware image checksum mismatch")
+	}
+	keyhex, err := nh_util.NH_read_file(DB_FW_PUBKEY_FILE)
+	if err != nil {
+		return fmt.Errorf("No firmware signing key")
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyhex)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid firmware signing key")
+	}
+	signature, _ := hex.DecodeString(req.Signature)
+	if !ed25519.Verify(ed25519.PublicKey(key), digest, signature) {
+		return fmt.Errorf("Firmware image signature verification failed")
+	}
+	return nil
+}
+
+func (m *UpgradeManager) run(req messages.UpgradeInnerMessage) {
+	m.Lock()
+	root := m.rootTarget()
+	targets := m.state.Targets
+	m.Unlock()
+	m.event(root, "Downloading firmware "+req.Version)
+	err := downloadFirmware(req)
+	if err != nil {
+		m.setState(UPGRADE_FAILED, err.Error())
+		m.event(root, "Upgrade failed: "+err.Error())
+		return
+	}
+
+	m.setState(UPGRADE_UPGRADING_REPEATERS, "")
+	// A repeater that can't be upgraded is reported in its target. It stays
+	// on its version and the others and the root go on
+	for _, target := range targets {
+		if target.IsRoot {
+			continue
+		}
+		err = m.upgradeRepeater(target, req)
+		if err != nil {
+			m.setTarget(target, UPGRADE_TARGET_FAILED, err.Error())
+			m.event(target, "Repeater not upgraded: "+err.Error())
+		}
+	}
+
+	m.setState(UPGRADE_UPGRADING, "")
+	if root.FromVersion == req.Version {
+		m.setTarget(root, UPGRADE_TARGET_SKIPPED, "")
+		m.setState(UPGRADE_HEALTHY, "")
+		m.event(root, "Already running "+req.Version)
+		return
+	}
+	m.setTarget(root, UPGRADE_TARGET_SENT, "")
+	m.setRebootState(UPGRADE_INSTALLING, "")
+	m.event(root, "Installing firmware "+req.Version)
+	// The script flashes the image and reboots. We pick up from the saved state after the boot
+	out, err := exec.Command(fw_upgrade_script, FW_IMAGE_FILE).CombinedOutput()
+	if err != nil {
+		errstr := strings.TrimSpace(string(out))
+		if errstr == "" {
+			errstr = err.Error()
+		}
+		m.setTarget(root, UPGRADE_TARGET_FAILED, errstr)
+		m.setState(UPGRADE_FAILED, errstr)
+		m.event(root, "Upgrade failed: "+errstr)
+	}
+}
+
+func (m *UpgradeManager) repeaterVersion(mac string) (string, bool) {
+	m.tel.RLock()
+	defer m.tel.RUnlock()
+	repeater := m.tel.Repeaters[mac]
+	if repeater == nil {
+		return "", false
+	}
+	return repeater.Fwver, repeater.Online
+}
+
+// Sends the upgrade to the repeater and waits until it registers again with the new version
+func (m *UpgradeManager) upgradeRepeater(target *UpgradeTarget, req messages.UpgradeInnerMessage) error {
+	m.tel.RLock()
+	repeater := m.tel.Repeaters[target.Mac]
+	var addr repeaterAddress
+	if repeater != nil {
+		addr = repeater.address()
+	}
+	m.tel.RUnlock()
+	if repeater == nil {
+		m.setTarget(target, UPGRADE_TARGET_SKIPPED, "Repeater removed")
+		return nil
+	}
+	if target.FromVersion == req.Version {
+		m.setTarget(target, UPGRADE_TARGET_SKIPPED, "")
+		return nil
+	}
+	if _, online := m.repeaterVersion(target.Mac); !online {
+		return fmt.Errorf("Repeater is offline")
+	}
+
+	m.event(target, "Upgrading repeater to "+req.Version)
+	data, err := m.tel.sendRepeaterCommand(addr, messages.UpgradeMessage{Type: "upgrade_fw", Mbody: req})
+	if err != nil {
+		return err
+	}
+	var status map[string]interface{}
+	if json.Unmarshal(data, &status) == nil && status["status"] == "fail" {
+		return fmt.Errorf("%v", status["error"])
+	}
+	m.setTarget(target, UPGRADE_TARGET_SENT, "")
+
+	deadline := time.Now().Unix() + UPGRADE_REPEATER_TIMEOUT
+	for time.Now().Unix() < deadline {
+		time.Sleep(UPGRADE_REPEATER_POLL_INTERVAL * time.Second)
+		version, online := m.repeaterVersion(target.Mac)
+		if version == req.Version && online {
+			m.setTarget(target, UPGRADE_TARGET_DONE, "")
+			m.event(target, "Repeater upgraded to "+req.Version)
+			return nil
+		}
+	}
+	return fmt.Errorf("Repeater did not come back with %s", req.Version)
+}
+
+// The router is healthy when it runs the new image, has its LAN up and the
+// telemetry is flowing again
+func (m *UpgradeManager) healthy(want string) (bool, string) {
+	version := getFwVersion()
+	if version != want {
+		return false, "Running " + version + " instead of " + want
+	}
+	if _, err := nh_util.NH_get_ipv4address(LAN_IFNAME); err != nil {
+		return false, "LAN is down"
+	}
+	m.tel.RLock()
+	lasttelemetry := m.tel.telemetryreceived
+	m.tel.RUnlock()
+	if lasttelemetry < m.booted {
+		return false, "No telemetry since boot"
+	}
+	return true, ""
+}
+
+// Finishes an upgrade interrupted by the reboot. Called from the telemetry loop
+func (m *UpgradeManager) check(now int64) {
+	m.Lock()
+	state := m.state.State
+	version := m.state.Version
+	prevVersion := m.state.PrevVersion
+	reason := m.state.Error
+	root := m.rootTarget()
+	m.Unlock()
+
+	switch state {
+	case UPGRADE_INSTALLING:
+		if !m.rebooted() {
+			// Still flashing
+			return
+		}
+		m.setState(UPGRADE_REBOOTING, "")
+		m.event(root, "Rebooted after installing "+version)
+	case UPGRADE_REBOOTING:
+		if now-m.booted < UPGRADE_HEALTH_DELAY {
+			return
+		}
+		ok, reason := m.healthy(version)
+		if ok {
+			m.setTarget(root, UPGRADE_TARGET_UPGRADED, "")
+			m.setState(UPGRADE_HEALTHY, "")
+			m.event(root, "Upgraded to "+version)
+			return
+		}
+		if getFwVersion() == prevVersion {
+			// The new image never booted. Nothing to roll back
+			m.setTarget(root, UPGRADE_TARGET_FAILED, reason)
+			m.setState(UPGRADE_FAILED, reason)
+			m.event(root, "Upgrade failed: "+reason)
+			return
+		}
+		if now-m.booted < UPGRADE_HEALTH_TIMEOUT {
+			return
+		}
+		m.setTarget(root, UPGRADE_TARGET_FAILED, reason)
+		m.setRebootState(UPGRADE_ROLLINGBACK, reason)
+		m.event(root, "Health check failed, rolling back to "+prevVersion+": "+reason)
+		out, err := exec.Command(fw_rollback_script).CombinedOutput()
+		if err != nil {
+			errstr := strings.TrimSpace(string(out))
+			if errstr == "" {
+				errstr = err.Error()
+			}
+			m.setState(UPGRADE_FAILED, "Rollback failed: "+errstr)
+			m.event(root, "Rollback failed: "+errstr)
+		}
+	case UPGRADE_ROLLINGBACK:
+		if !m.rebooted() || now-m.booted < UPGRADE_HEALTH_DELAY {
+			return
+		}
+		if getFwVersion() == prevVersion {
+			m.setState(UPGRADE_ROLLEDBACK, reason)
+			m.event(root, "Rolled back to "+prevVersion)
+		} else {
+			m.setState(UPGRADE_FAILED, "Rollback failed: "+reason)
+			m.event(root, "Rollback failed")
+		}
+	}
+}
+
+func (m *UpgradeManager) statusJson() ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	status := messages.UpgradeStatusInfo{
+		State:       m.state.State,
+		Version:     m.state.Version,
+		PrevVersion: m.state.PrevVersion,
+		Url:         m.state.Url,
+		Started:     m.state.Started,
+		Updated:     m.state.Updated,
+		Error:       m.state.Error,
+		Targets:     make([]messages.UpgradeTargetInfo, 0, len(m.state.Targets)),
+	}
+	for _, target := range m.state.Targets {
+		status.Targets = append(status.Targets, messages.UpgradeTargetInfo{
+			Mac:         target.Mac,
+			Name:        target.Name,
+			Ip:          target.Ip,
+			IsRoot:      target.IsRoot,
+			FromVersion: target.FromVersion,
+			State:       target.State,
+			Error:       target.Error,
+		})
+	}
+	return json.Marshal(status)
+}
@@ -0,0 +1,99 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves the image and returns an upgrade to it, signed by the key the
+// router trusts
+func newTestImage(t *testing.T, image []byte) messages.UpgradeInnerMessage {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	assert.Nil(t, nh_util.NH_dump_to_file(DB_FW_PUBKEY_FILE, []byte(hex.EncodeToString(pub)), 0600))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	t.Cleanup(server.Close)
+	digest := sha256.Sum256(image)
+	return messages.UpgradeInnerMessage{
+		Url:       server.URL,
+		Version:   "9.9.9",
+		Sha256:    hex.EncodeToString(digest[:]),
+		Signature: hex.EncodeToString(ed25519.Sign(priv, digest[:])),
+	}
+}
+
+func TestDownloadFirmware(t *testing.T) {
+	newSimRouter(t)
+	image := []byte("firmware image")
+	req := newTestImage(t, image)
+
+	assert.Nil(t, downloadFirmware(req))
+	content, err := nh_util.NH_read_file(FW_IMAGE_FILE)
+	assert.Nil(t, err)
+	assert.Equal(t, image, content)
+
+	// A bad image is not left behind
+	req.Signature = hex.EncodeToString(make([]byte, ed25519.SignatureSize))
+	assert.NotNil(t, downloadFirmware(req))
+	assert.NoFileExists(t, FW_IMAGE_FILE)
+	req = newTestImage(t, image)
+	req.Sha256 = hex.EncodeToString(make([]byte, sha256.Size))
+	assert.NotNil(t, downloadFirmware(req))
+	assert.NoFileExists(t, FW_IMAGE_FILE)
+}
+
+func TestUpgradeUnreachableRepeater(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	// The repeaters registered over the LAN and this router has no Nebula
+	// identity to reach them with
+	assert.NotEmpty(t, rs.tel.Repeaters)
+
+	m := rs.tel.Upgrade
+	assert.Equal(t, "", m.start(newTestImage(t, []byte("firmware image"))))
+	deadline := time.Now().Add(5 * time.Second)
+	var state UpgradeState
+	for time.Now().Before(deadline) {
+		m.Lock()
+		state = m.state
+		m.Unlock()
+		if !(state.State == UPGRADE_DOWNLOADING || state.State == UPGRADE_UPGRADING_REPEATERS) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The root is upgraded all the same
+	assert.Equal(t, UPGRADE_INSTALLING, state.State)
+	for _, target := range state.Targets {
+		if target.IsRoot {
+			assert.Equal(t, UPGRADE_TARGET_SENT, target.State)
+		} else {
+			assert.Equal(t, UPGRADE_TARGET_FAILED, target.State)
+			assert.NotEqual(t, "", target.Error)
+		}
+	}
+}
+
+func TestUpgradeWithoutImage(t *testing.T) {
+	// The app may still send upgrade_fw without a body
+	status := messages.ProcessMessage([]byte(`{"type":"upgrade_fw"}`), test.NewLogger(), nil)
+	assert.Equal(t, `{"status": ""}`, status)
+}
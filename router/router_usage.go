@@ -0,0 +1,198 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	messages "messages"
+	nh_util "nh_util"
+)
+
+const USAGE_PERIOD_MINUTE = "minute"
+const USAGE_PERIOD_HOUR = "hour"
+const USAGE_PERIOD_DAY = "day"
+const USAGE_PERIOD_MONTH = "month"
+
+// Dump the usage history every 5 minutes so that we don't lose much on a reboot
+const USAGE_DUMP_INTERVAL = 5 * 60
+
+func NewClientUsage(mac string) *ClientUsage {
+	cu := ClientUsage{
+		MACAddress: mac,
+	}
+	return &cu
+}
+
+func (tel *Telemetry) readClientUsage() {
+	files, _ := ioutil.ReadDir(DB_USAGE_LOCATION)
+	for _, file := range files {
+		content, err := nh_util.NH_read_file(DB_USAGE_LOCATION + file.Name())
+		if err != nil {
+			tel.l.Error("Error", err)
+			continue
+		}
+		var cu ClientUsage
+		err = json.Unmarshal(content, &cu)
+		if err != nil {
+			tel.l.WithField("file", file.Name()).Error("Error while unmarshalling client usage", err)
+			continue
+		}
+		cu.Dirty = false
+		tel.Usage[cu.MACAddress] = &cu
+	}
+}
+
+func dumpClientUsage(cu *ClientUsage) error {
+	c, err := json.Marshal(*cu)
+	if err != nil {
+		return err
+	}
+	nh_util.NH_create_dir(DB_USAGE_LOCATION, 0755)
+	return nh_util.NH_dump_to_file(getUsageFileName(cu.MACAddress), c, 0644)
+}
+
+// Adds bytes to the bucket starting at tstamp. A new bucket is appended
+// when tstamp moves on and the oldest ones are dropped beyond max entries
+func addUsageEntry(entries []UsageEntry, tstamp int64, bytesin uint64, bytesout uint64, max int) []UsageEntry {
+	last := len(entries) - 1
+	if last >= 0 && entries[last].Tstamp == tstamp {
+		entries[last].BytesIn += bytesin
+		entries[last].BytesOut += bytesout
+		return entries
+	}
+	entries = append(entries, UsageEntry{
+		Tstamp:   tstamp,
+		BytesIn:  bytesin,
+		BytesOut: bytesout,
+	})
+	if len(entries) > max {
+		entries = entries[len(entries)-max:]
+	}
+	return entries
+}
+
+func (cu *ClientUsage) add(now time.Time, bytesin uint64, bytesout uint64) {
+	minute := now.Truncate(time.Minute).Unix()
+	hour := now.Truncate(time.Hour).Unix()
+	// Days and months follow the local time of the router
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).Unix()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Unix()
+
+	cu.Minutes = addUsageEntry(cu.Minutes, minute, bytesin, bytesout, MAX_CLIENT_MINUTE_STATS_ENTRIES)
+	cu.Hours = addUsageEntry(cu.Hours, hour, bytesin, bytesout, MAX_CLIENT_HOUR_STATS_ENTRIES)
+	cu.Days = addUsageEntry(cu.Days, day, bytesin, bytesout, MAX_CLIENT_DAY_STATS_ENTRIES)
+	cu.Months = addUsageEntry(cu.Months, month, bytesin, bytesout, MAX_CLIENT_MONTH_STATS_ENTRIES)
+	cu.Dirty = true
+}
+
+func (cu *ClientUsage) entries(period string) ([]UsageEntry, error) {
+	switch period {
+	case USAGE_PERIOD_MINUTE:
+		return cu.Minutes, nil
+	case USAGE_PERIOD_HOUR:
+		return cu.Hours, nil
+	case USAGE_PERIOD_DAY:
+		return cu.Days, nil
+	case USAGE_PERIOD_MONTH:
+		return cu.Months, nil
+	}
+	return nil, fmt.Errorf("Unknown usage period %s", period)
+}
+
+func deviceBytes(device Device) (uint64, uint64) {
+	var bytesin uint64
+	var bytesout uint64
+	for _, conn := range device.Conn {
+		in, out := conBytes(conn)
+		bytesin += in
+		bytesout += out
+	}
+	return bytesin, bytesout
+}
+
+// Called with the telemetry lock held
+func (tel *Telemetry) updateUsage(device Device) {
+	if tel.RouterClients[device.Mac] == nil {
+		return
+	}
+	bytesin, bytesout := deviceBytes(device)
+	if bytesin == 0 && bytesout == 0 {
+		return
+	}
+	cu := tel.Usage[device.Mac]
+	if cu == nil {
+		cu = NewClientUsage(device.Mac)
+		tel.Usage[device.Mac] = cu
+	}
+	cu.add(time.Now(), bytesin, bytesout)
+	countClientBytes(device.Mac, bytesin, bytesout)
+}
+
+func (tel *Telemetry) dumpUsage() {
+	tel.Lock()
+	defer tel.Unlock()
+	curtime := time.Now().Unix()
+	for mac, cu := range tel.Usage {
+		// Dropped along with the client
+		if tel.clientGone(mac, curtime) {
+			delete(tel.Usage, mac)
+			os.Remove(getUsageFileName(mac))
+			continue
+		}
+		if !cu.Dirty {
+			continue
+		}
+		err := dumpClientUsage(cu)
+		if err != nil {
+			tel.l.WithField("mac=", cu.MACAddress).Error("Error while dumping client usage", err)
+			continue
+		}
+		cu.Dirty = false
+	}
+	if tel.quotasdirty {
+		err := tel.dumpQuotas()
+		if err != nil {
+			tel.l.Error("Error while saving quotas", err)
+		}
+	}
+}
+
+func (tel *Telemetry) clientUsageJson(mac string, period string) ([]byte, error) {
+	tel.RLock()
+	defer tel.RUnlock()
+
+	if period == "" {
+		period = USAGE_PERIOD_DAY
+	}
+	usage := make([]messages.ClientUsageInfo, 0)
+	for _, cu := range tel.Usage {
+		if mac != "all" && mac != cu.MACAddress {
+			continue
+		}
+		entries, err := cu.entries(period)
+		if err != nil {
+			return nil, err
+		}
+		info := messages.ClientUsageInfo{
+			MACAddress: cu.MACAddress,
+			Period:     period,
+			Entries:    make([]messages.UsageEntryInfo, len(entries)),
+		}
+		for i, entry := range entries {
+			info.Entries[i].Tstamp = entry.Tstamp
+			info.Entries[i].BytesIn = entry.BytesIn
+			info.Entries[i].BytesOut = entry.BytesOut
+		}
+		usage = append(usage, info)
+	}
+	if mac != "all" && len(usage) == 0 && tel.RouterClients[mac] == nil {
+		return nil, fmt.Errorf("Received a usage request for a client that does n't exist")
+	}
+	return json.Marshal(usage)
+}
@@ -0,0 +1,33 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Makes the client look unseen for longer than clients are kept
+func expireClient(rs *RouterServer, mac string) {
+	rs.tel.Lock()
+	defer rs.tel.Unlock()
+	rs.tel.RouterClients[mac].Lastseen = time.Now().Unix() - 8*24*3600
+}
+
+func TestUsageDroppedWithClient(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+	assert.Nil(t, sim.Tick())
+	rs.tel.dumpUsage()
+	assert.Contains(t, rs.tel.Usage, testMac)
+	assert.FileExists(t, getUsageFileName(testMac))
+
+	expireClient(rs, testMac)
+	rs.tel.dumpUsage()
+	assert.NotContains(t, rs.tel.Usage, testMac)
+	assert.NoFileExists(t, getUsageFileName(testMac))
+	assert.Contains(t, rs.tel.Usage, "f0:25:b7:10:20:01")
+}
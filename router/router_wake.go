@@ -0,0 +1,124 @@
+//go:build router
+// +build router
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	nh_util "nh_util"
+)
+
+// Magic packets go to the discard port
+const WAKE_PORT = 9
+
+// 6 bytes of 0xff followed by the MAC 16 times
+func magicPacket(mac string) ([]byte, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if len(hw) != 6 {
+		return nil, fmt.Errorf("Invalid MAC Address %s", mac)
+	}
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	packet = append(packet, bytes.Repeat(hw, 16)...)
+	return packet, nil
+}
+
+// Address and broadcast of the IPv4 network on the interface
+func lanBroadcast(iname string) (net.IP, net.IP, error) {
+	ifa, err := net.InterfaceByName(iname)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := ifa.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+		ip := ipnet.IP.To4()
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range ip {
+			broadcast[i] = ip[i] | ^ipnet.Mask[i]
+		}
+		return ip, broadcast, nil
+	}
+	return nil, nil, fmt.Errorf("No IPv4 Address on %s", iname)
+}
+
+// Broadcasts the magic packet on the LAN bridge so that it reaches the wired
+// and the wireless clients alike
+func sendMagicPacket(mac string) error {
+	packet, err := magicPacket(mac)
+	if err != nil {
+		return err
+	}
+	ip, broadcast, err := lanBroadcast(LAN_IFNAME)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: ip}, &net.UDPAddr{IP: broadcast, Port: WAKE_PORT})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(packet)
+	return err
+}
+
+// Finds the client by its MAC Address or else by its name
+// Called with the telemetry lock held
+func (tel *Telemetry) findClient(macOrName string) (*RouterClient, error) {
+	for _, mac := range []string{macOrName, strings.ToLower(macOrName)} {
+		if client := tel.RouterClients[mac]; client != nil {
+			return client, nil
+		}
+	}
+	var found *RouterClient
+	for mac, client := range tel.RouterClients {
+		if mac != client.MACAddress || !strings.EqualFold(client.Name, macOrName) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("More than one client is named %s", macOrName)
+		}
+		found = client
+	}
+	if found == nil {
+		return nil, fmt.Errorf("No such client %s", macOrName)
+	}
+	return found, nil
+}
+
+func (tel *Telemetry) wakeClient(macOrName string) string {
+	tel.RLock()
+	var mac string
+	var isrepeater bool
+	client, err := tel.findClient(macOrName)
+	if err == nil {
+		mac = client.MACAddress
+		isrepeater = client.IsRepeater
+	}
+	tel.RUnlock()
+	if err != nil {
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	if isrepeater {
+		return nh_util.NH_getErrorStatusString("Repeaters can not be woken up")
+	}
+	err = sendMagicPacket(mac)
+	if err != nil {
+		tel.l.WithField("mac", mac).Error("Error while sending the magic packet ", err)
+		return nh_util.NH_getErrorStatusString(err.Error())
+	}
+	tel.l.WithField("mac", mac).Info("Sent magic packet")
+	return ""
+}
@@ -0,0 +1,32 @@
+//go:build router && sim
+// +build router,sim
+
+package router
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMagicPacket(t *testing.T) {
+	packet, err := magicPacket(testMac)
+	assert.Nil(t, err)
+	assert.Len(t, packet, 102)
+	assert.Equal(t, bytes.Repeat([]byte{0xff}, 6), packet[:6])
+	assert.Equal(t, []byte{0xa4, 0x5e, 0x60, 0x10, 0x20, 0x02}, packet[96:])
+	_, err = magicPacket("a4:5e:60")
+	assert.NotNil(t, err)
+}
+
+func TestWakeClient(t *testing.T) {
+	rs, sim := newSimRouter(t)
+	assert.Nil(t, sim.Tick())
+
+	client, err := rs.tel.findClient("macbook_air")
+	assert.Nil(t, err)
+	assert.Equal(t, testMac, client.MACAddress)
+	assert.Contains(t, rs.tel.wakeClient("Nobody"), "No such client")
+	assert.Contains(t, rs.tel.wakeClient("02:5e:11:00:00:01"), "Repeaters can not be woken up")
+}